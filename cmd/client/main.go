@@ -1,13 +1,62 @@
 package main
 
-import "net"
+import (
+	"crypto/tls"
+	"flag"
+	"net"
+
+	"github.com/k1ender/go-stash/internal/handler"
+	"github.com/k1ender/go-stash/internal/tlsconfig"
+)
 
 func main() {
-	conn, err := net.Dial("tcp", "localhost:19201")
+	addr := flag.String("addr", "localhost:19201", "server address")
+	useTLS := flag.Bool("tls", false, "connect using TLS")
+	caFile := flag.String("tls-ca-file", "", "CA certificate to verify the server with (default: system roots)")
+	certFile := flag.String("tls-cert-file", "", "client certificate for mutual TLS")
+	keyFile := flag.String("tls-key-file", "", "client key for mutual TLS")
+	serverName := flag.String("tls-server-name", "", "server name to verify (default: host of -addr)")
+	insecure := flag.Bool("tls-insecure", false, "do not verify the server certificate")
+	user := flag.String("user", "", "user to authenticate as (default: the default user)")
+	password := flag.String("password", "", "password to authenticate with")
+	flag.Parse()
+
+	var conn net.Conn
+	var err error
+	if *useTLS {
+		var cfg *tls.Config
+		cfg, err = tlsconfig.NewClientConfig(tlsconfig.ClientOptions{
+			CAFile:             *caFile,
+			CertFile:           *certFile,
+			KeyFile:            *keyFile,
+			ServerName:         *serverName,
+			InsecureSkipVerify: *insecure,
+		})
+		if err != nil {
+			panic(err)
+		}
+		conn, err = tls.Dial("tcp", *addr, cfg)
+	} else {
+		conn, err = net.Dial("tcp", *addr)
+	}
 	if err != nil {
 		panic(err)
 	}
 
+	if *password != "" {
+		if *user != "" {
+			conn.Write(handler.SerializeArgs(handler.AuthCommand, *user, *password))
+		} else {
+			conn.Write(handler.SerializeArgs(handler.AuthCommand, *password))
+		}
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			panic(err)
+		}
+		println(string(buf[:n]))
+	}
+
 	conn.Write([]byte("SET\0003\000key\0005\000value\r\n"))
 	buf := make([]byte, 1024)
 	n, err := conn.Read(buf)
@@ -1,26 +1,102 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 
+	"github.com/k1ender/go-stash/internal/auth"
 	"github.com/k1ender/go-stash/internal/config"
+	"github.com/k1ender/go-stash/internal/logging"
 	"github.com/k1ender/go-stash/internal/server"
 )
 
 func main() {
 	filepath := flag.String("config", "", "Path to config file")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration, print any problems and exit")
+	hashPassword := flag.Bool("hash-password", false, "Read a password from stdin, print its hash for the users option and exit")
+	cli := config.NewCLIGetter()
+	cli.Register(flag.CommandLine)
 	flag.Parse()
-	// slog.SetLogLoggerLevel(slog.LevelDebug)
 
-	var cfg *config.Config
+	if *hashPassword {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			slog.Error("failed to read password", "error", err)
+			os.Exit(1)
+		}
+		hash, err := auth.HashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			slog.Error("failed to hash password", "error", err)
+			os.Exit(1)
+		}
+		fmt.Println(hash)
+		return
+	}
+	cfg, err := config.LoadConfig(cli, config.WithConfigPath(*filepath))
+	if *checkConfig {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("configuration OK")
+		return
+	}
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	level := new(slog.LevelVar)
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		slog.Error("invalid log_level", "error", err)
+		os.Exit(1)
+	}
+	logger, logFile, err := logging.New(logging.Options{
+		Level:      level,
+		Format:     cfg.Log.Format,
+		File:       cfg.Log.File,
+		MaxSize:    int64(cfg.Log.MaxSize),
+		MaxBackups: cfg.Log.MaxBackups,
+	})
+	if err != nil {
+		slog.Error("failed to set up logging", "error", err)
+		os.Exit(1)
+	}
+	if logFile != nil {
+		defer logFile.Close()
+	}
+	slog.SetDefault(logger)
 
-	if *filepath != "" {
-		cfg = config.LoadConfig("config", config.WithConfigPath(*filepath))
-	} else {
-		cfg = config.LoadConfig("cli")
+	for _, key := range slices.Sorted(maps.Keys(cfg.Sources())) {
+		slog.Info("configuration option set", "option", key, "source", cfg.Source(key))
 	}
 
-	srv := server.NewServer(cfg)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The configuration file is reloaded on SIGHUP and when it changes.
+	rt := config.NewRuntime(cfg)
+	rt.OnChange("log_level", func(cfg *config.Config) error {
+		return level.UnmarshalText([]byte(cfg.Log.Level))
+	})
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go config.NewReloader(rt, cli).Watch(ctx, hup)
 
-	srv.Start()
+	srv := server.NewServer(cfg, server.WithRuntime(rt))
+
+	if err := srv.Start(ctx); err != nil && !errors.Is(err, server.ErrServerClosed) {
+		slog.Error("server stopped with error", "error", err)
+		os.Exit(1)
+	}
 }
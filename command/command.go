@@ -0,0 +1,159 @@
+// Package command lets programs that embed GoStash add their own commands.
+//
+// A command is a three letter code, a decoder that turns the arguments of a
+// frame into a request, and a handler that serves requests against the
+// store:
+//
+//	type mintRequest struct{ user string }
+//
+//	err := command.Register(command.Definition[mintRequest]{
+//		Name:  "TOK",
+//		Arity: 2,
+//		Flags: command.Write,
+//		Decode: func(args []string) (mintRequest, error) {
+//			return mintRequest{user: args[0]}, nil
+//		},
+//		Keys: func(req mintRequest) []string { return []string{"token:" + req.user} },
+//		New: func(st command.Store) command.Handler[mintRequest] {
+//			return command.HandlerFunc[mintRequest](func(req mintRequest) (command.Response, error) {
+//				token := rand.Text()
+//				if err := st.Set("token:"+req.user, token); err != nil {
+//					return nil, err
+//				}
+//				return command.Value(token), nil
+//			})
+//		},
+//	})
+//
+// Commands must be registered before the server starts. They are listed by
+// the CMD command along with the built-in ones.
+package command
+
+import (
+	"errors"
+
+	"github.com/k1ender/go-stash/internal/handler"
+	"github.com/k1ender/go-stash/internal/store"
+)
+
+type (
+	// Store is the key-value store commands run against.
+	Store = store.Store
+	// Response is the reply to a command.
+	Response = handler.Response
+	// Flag describes properties of a command.
+	Flag = handler.CommandFlag
+)
+
+const (
+	ReadOnly = handler.FlagReadOnly
+	Write    = handler.FlagWrite
+	Admin    = handler.FlagAdmin
+	// NoAuth lets the command run before the connection authenticates and
+	// exempts it from ACL rules.
+	NoAuth = handler.FlagNoAuth
+	// Slow marks commands that may take long to run. With io_mode epoll
+	// they run off the event loop, so they do not delay other clients.
+	Slow = handler.FlagSlow
+)
+
+var (
+	// ErrNotFound is returned by Store for missing keys.
+	ErrNotFound = store.ErrNotFound
+
+	ErrExists            = handler.ErrCommandExists
+	ErrBuiltin           = handler.ErrBuiltinCommand
+	ErrInvalidName       = handler.ErrInvalidCommand
+	ErrInvalidDefinition = errors.New("command definition needs Decode and New")
+)
+
+// Handler serves decoded requests of type R.
+type Handler[R any] interface {
+	Handle(req R) (Response, error)
+}
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc[R any] func(req R) (Response, error)
+
+func (f HandlerFunc[R]) Handle(req R) (Response, error) {
+	return f(req)
+}
+
+// Value is a Response with a single line.
+type Value string
+
+func (v Value) Serialize() ([]byte, error) {
+	return []byte(string(v) + "\r\n"), nil
+}
+
+// Definition describes a command with requests of type R.
+type Definition[R any] struct {
+	// Name is the three uppercase letters that start the command's frames.
+	Name string
+	// Arity is the number of parts of a valid frame, counting the name
+	// itself. A negative arity -N means at least N. Frames with a different
+	// number of arguments are answered with ERR without being decoded.
+	Arity int
+	Flags Flag
+
+	// Decode turns the arguments of a frame into a request.
+	Decode func(args []string) (R, error)
+	// Keys returns the keys a request accesses. They are checked against
+	// ACL rules and locked when the command runs in a transaction. Commands
+	// that access keys should set it, otherwise ACL key patterns do not
+	// apply to them.
+	Keys func(req R) []string
+	// New returns a handler serving requests against st. It is called once
+	// per server with the store, and once per run inside a transaction with
+	// a view of the store in which only the request's keys are accessible.
+	New func(st Store) Handler[R]
+}
+
+// Register adds a command to every server started afterwards. It fails if
+// the name is invalid, is used by a built-in command or was registered
+// before.
+func Register[R any](def Definition[R]) error {
+	if len(def.Name) != len(handler.Command{}) {
+		return ErrInvalidName
+	}
+	if def.Decode == nil || def.New == nil {
+		return ErrInvalidDefinition
+	}
+
+	c := handler.CustomCommand{
+		CommandInfo: handler.CommandInfo{
+			Command: handler.Command([]byte(def.Name)),
+			Arity:   def.Arity,
+			Flags:   def.Flags,
+		},
+		Decode: func(args []string) (any, error) {
+			if err := handler.CheckArity(def.Arity, args); err != nil {
+				return nil, err
+			}
+			return def.Decode(args)
+		},
+		Bind: func(st store.Store) handler.HandlerFunc {
+			h := def.New(st)
+			return func(req *handler.Request) (handler.Response, error) {
+				r, _ := req.Decoded.(R)
+				return h.Handle(r)
+			}
+		},
+	}
+	if def.Keys != nil {
+		c.Keys = func(decoded any) []string {
+			r, _ := decoded.(R)
+			return def.Keys(r)
+		}
+	}
+
+	return handler.RegisterCommand(c)
+}
+
+// MustRegister is like Register but panics if the command can not be
+// registered. It is meant for init functions.
+func MustRegister[R any](def Definition[R]) {
+	if err := Register(def); err != nil {
+		panic("command: " + def.Name + ": " + err.Error())
+	}
+}
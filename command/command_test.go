@@ -0,0 +1,136 @@
+package command
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/k1ender/go-stash/internal/acl"
+	"github.com/k1ender/go-stash/internal/handler"
+	"github.com/k1ender/go-stash/internal/store"
+)
+
+type tokenRequest struct{ user string }
+
+// decodes counts the calls of tokenCommand.Decode.
+var decodes atomic.Int32
+
+var tokenCommand = Definition[tokenRequest]{
+	Name:  "TOK",
+	Arity: 2,
+	Flags: Write,
+	Decode: func(args []string) (tokenRequest, error) {
+		decodes.Add(1)
+		return tokenRequest{user: args[0]}, nil
+	},
+	Keys: func(req tokenRequest) []string { return []string{"token:" + req.user} },
+	New: func(st Store) Handler[tokenRequest] {
+		return HandlerFunc[tokenRequest](func(req tokenRequest) (Response, error) {
+			token := "t-" + req.user
+			if err := st.Set("token:"+req.user, token); err != nil {
+				return nil, err
+			}
+			return Value(token), nil
+		})
+	},
+}
+
+func TestRegister(t *testing.T) {
+	if err := Register(tokenCommand); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register(tokenCommand); !errors.Is(err, ErrExists) {
+		t.Errorf("duplicate registration: %v", err)
+	}
+
+	builtin := tokenCommand
+	builtin.Name = "GET"
+	if err := Register(builtin); !errors.Is(err, ErrBuiltin) {
+		t.Errorf("built-in clash: %v", err)
+	}
+	for _, name := range []string{"tok", "TO", "TOKE"} {
+		invalid := tokenCommand
+		invalid.Name = name
+		if err := Register(invalid); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("name %q: %v", name, err)
+		}
+	}
+
+	// ACL rules make the handler check the keys of every request.
+	rules, err := acl.Parse("default +@all ~token:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := store.NewShardedStore(0)
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		h := handler.NewHandler(st, handler.WithACL(rules))
+		conn := handler.NewConn(server)
+		for {
+			if fatal, _ := h.Handle(conn); fatal {
+				return
+			}
+		}
+	}()
+
+	r := bufio.NewReader(client)
+	line := func() string {
+		t.Helper()
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSuffix(l, "\r\n")
+	}
+	do := func(command handler.Command, args ...string) string {
+		t.Helper()
+		if _, err := client.Write(handler.SerializeArgs(command, args...)); err != nil {
+			t.Fatal(err)
+		}
+		return line()
+	}
+
+	tok := handler.Command{'T', 'O', 'K'}
+	if got := do(tok, "alice"); got != "t-alice" {
+		t.Fatalf("TOK = %q", got)
+	}
+	if got, _ := st.Get("token:alice"); got != "t-alice" {
+		t.Fatalf("stored token = %q", got)
+	}
+	if n := decodes.Load(); n != 1 {
+		t.Fatalf("decoded TOK %d times, want once", n)
+	}
+
+	// Custom commands can be queued in a transaction.
+	do(handler.MultiCommand)
+	if got := do(tok, "bob"); got != "QUEUED" {
+		t.Fatalf("queued TOK = %q", got)
+	}
+	if got := do(handler.ExecCommand); got != "1" {
+		t.Fatalf("EXE = %q", got)
+	}
+	if got := line(); got != "t-bob" {
+		t.Fatalf("EXE reply = %q", got)
+	}
+	if n := decodes.Load(); n != 2 {
+		t.Fatalf("decoded TOK %d times for two requests", n)
+	}
+
+	n, err := strconv.Atoi(do(handler.CommandCommand))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for range n {
+		listed = append(listed, line())
+	}
+	if !slices.Contains(listed, "TOK 2 write") || !slices.Contains(listed, "GET 2 readonly") {
+		t.Fatalf("CMD = %q", listed)
+	}
+}
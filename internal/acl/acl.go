@@ -0,0 +1,286 @@
+// Package acl holds per-user permissions: which commands a user may run and
+// which keys those commands may touch.
+//
+// Permissions are written as a list of rules, applied in order:
+//
+//	+<CMD>          allow a command, e.g. +GET
+//	-<CMD>          disallow a command
+//	+@all           allow every command (also: allcommands)
+//	-@all           disallow every command (also: nocommands)
+//	~<pattern>      allow keys matching a glob pattern, e.g. ~metrics:*
+//	allkeys         allow every key, same as ~*
+//	resetkeys       forget all key patterns
+//	reset           disallow everything
+//
+// A pattern may use * for any sequence of characters, ? for a single
+// character and \ to escape either.
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrCommandDenied = errors.New("no permission to run this command")
+	ErrKeyDenied     = errors.New("no permission to access this key")
+)
+
+// Rules are the permissions of a single user.
+type Rules struct {
+	allCommands bool
+	// commands holds exceptions to allCommands.
+	commands map[string]bool
+	patterns []string
+}
+
+// ParseRules applies rules to a user without any permissions.
+func ParseRules(rules []string) (*Rules, error) {
+	r := &Rules{}
+	for _, rule := range rules {
+		if err := r.apply(rule); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *Rules) apply(rule string) error {
+	switch strings.ToLower(rule) {
+	case "+@all", "allcommands":
+		r.allCommands, r.commands = true, nil
+		return nil
+	case "-@all", "nocommands":
+		r.allCommands, r.commands = false, nil
+		return nil
+	case "allkeys":
+		r.patterns = []string{"*"}
+		return nil
+	case "resetkeys":
+		r.patterns = nil
+		return nil
+	case "reset":
+		*r = Rules{}
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(rule, "~"):
+		if !slices.Contains(r.patterns, rule[1:]) {
+			r.patterns = append(r.patterns, rule[1:])
+		}
+		return nil
+	case strings.HasPrefix(rule, "+"), strings.HasPrefix(rule, "-"):
+		command := strings.ToUpper(rule[1:])
+		if !validCommand(command) {
+			return fmt.Errorf("invalid command %q in rule %q", rule[1:], rule)
+		}
+		allow := rule[0] == '+'
+		if allow == r.allCommands {
+			delete(r.commands, command)
+		} else {
+			if r.commands == nil {
+				r.commands = make(map[string]bool)
+			}
+			r.commands[command] = allow
+		}
+		return nil
+	}
+
+	return fmt.Errorf("invalid rule %q", rule)
+}
+
+// validCommand reports whether command looks like a command name: three
+// uppercase letters.
+func validCommand(command string) bool {
+	if len(command) != 3 {
+		return false
+	}
+	for _, c := range []byte(command) {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowsCommand reports whether the user may run command.
+func (r *Rules) AllowsCommand(command string) bool {
+	if allow, ok := r.commands[command]; ok {
+		return allow
+	}
+	return r.allCommands
+}
+
+// AllowsKey reports whether the user may access key.
+func (r *Rules) AllowsKey(key string) bool {
+	for _, pattern := range r.patterns {
+		if Match(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the rules in a form ParseRules accepts.
+func (r *Rules) String() string {
+	var rules []string
+	if r.allCommands {
+		rules = append(rules, "+@all")
+	} else {
+		rules = append(rules, "-@all")
+	}
+	for _, command := range slices.Sorted(maps.Keys(r.commands)) {
+		if r.commands[command] {
+			rules = append(rules, "+"+command)
+		} else {
+			rules = append(rules, "-"+command)
+		}
+	}
+	for _, pattern := range r.patterns {
+		rules = append(rules, "~"+pattern)
+	}
+	return strings.Join(rules, " ")
+}
+
+// Check returns an error unless the rules allow command on keys.
+func (r *Rules) Check(command string, keys []string) error {
+	if !r.AllowsCommand(command) {
+		return ErrCommandDenied
+	}
+	for _, key := range keys {
+		if !r.AllowsKey(key) {
+			return fmt.Errorf("%w %q", ErrKeyDenied, key)
+		}
+	}
+	return nil
+}
+
+// List maps user names to their rules. Users without rules are not
+// restricted, so an empty List allows everything.
+//
+// Lookups are lock free: the map is replaced, never modified, on SetUser.
+type List struct {
+	mu    sync.Mutex
+	users atomic.Pointer[map[string]*Rules]
+}
+
+func NewList() *List {
+	l := &List{}
+	l.users.Store(&map[string]*Rules{})
+	return l
+}
+
+// Parse reads a List from a semicolon separated list of users, each a name
+// followed by its rules separated by spaces:
+//
+//	analytics +GET ~metrics:*; ops +@all allkeys
+func Parse(s string) (*List, error) {
+	users := make(map[string]*Rules)
+	for entry := range strings.SplitSeq(s, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, ok := users[fields[0]]; ok {
+			return nil, fmt.Errorf("rules for user %q are defined twice", fields[0])
+		}
+		rules, err := ParseRules(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %w", fields[0], err)
+		}
+		users[fields[0]] = rules
+	}
+
+	l := &List{}
+	l.users.Store(&users)
+	return l, nil
+}
+
+// Lookup returns the rules of user, or false if the user is unrestricted.
+// The returned rules must not be modified.
+func (l *List) Lookup(user string) (*Rules, bool) {
+	rules, ok := (*l.users.Load())[user]
+	return rules, ok
+}
+
+// SetUser applies rules on top of the current rules of user, creating the
+// user without any permissions if it has none. The change is atomic: if a
+// rule is invalid, the user is left unchanged.
+func (l *List) SetUser(user string, rules []string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	users := *l.users.Load()
+	next := &Rules{}
+	if current, ok := users[user]; ok {
+		next.allCommands = current.allCommands
+		next.commands = maps.Clone(current.commands)
+		next.patterns = slices.Clone(current.patterns)
+	}
+	for _, rule := range rules {
+		if err := next.apply(rule); err != nil {
+			return err
+		}
+	}
+
+	users = maps.Clone(users)
+	users[user] = next
+	l.users.Store(&users)
+	return nil
+}
+
+// Describe returns one line per user with rules, sorted by name, in the form
+//
+//	user <name> <rules>
+func (l *List) Describe() []string {
+	users := *l.users.Load()
+	lines := make([]string, 0, len(users))
+	for _, user := range slices.Sorted(maps.Keys(users)) {
+		lines = append(lines, "user "+user+" "+users[user].String())
+	}
+	return lines
+}
+
+// Match reports whether key matches the glob pattern. It backtracks only to
+// the most recent *, so it runs in O(len(pattern) * len(key)).
+func Match(pattern, key string) bool {
+	p, k := 0, 0
+	star, starKey := -1, 0
+	for k < len(key) {
+		if p < len(pattern) {
+			switch c := pattern[p]; c {
+			case '*':
+				star, starKey = p, k
+				p++
+				continue
+			case '?':
+				p, k = p+1, k+1
+				continue
+			default:
+				next := p + 1
+				if c == '\\' && next < len(pattern) {
+					c, next = pattern[next], next+1
+				}
+				if key[k] == c {
+					p, k = next, k+1
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starKey++
+		p, k = star+1, starKey
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,92 @@
+package acl
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"metrics:*", "metrics:cpu", true},
+		{"metrics:*", "metrics:", true},
+		{"metrics:*", "users:1", false},
+		{"user:?", "user:1", true},
+		{"user:?", "user:10", false},
+		{"*:cpu", "metrics:host:cpu", true},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "aXbY", false},
+		{`literal\*`, "literal*", true},
+		{`literal\*`, "literalX", false},
+		{"exact", "exact", true},
+		{"exact", "exact!", false},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	l, err := Parse("analytics +GET ~metrics:*; ops +@all allkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(user, command, key string) error {
+		t.Helper()
+		rules, ok := l.Lookup(user)
+		if !ok {
+			return nil
+		}
+		return rules.Check(command, []string{key})
+	}
+
+	if err := check("analytics", "GET", "metrics:cpu"); err != nil {
+		t.Errorf("analytics GET metrics:cpu: %v", err)
+	}
+	if err := check("analytics", "GET", "users:1"); !errors.Is(err, ErrKeyDenied) {
+		t.Errorf("analytics GET users:1: %v", err)
+	}
+	if err := check("analytics", "DEL", "metrics:cpu"); !errors.Is(err, ErrCommandDenied) {
+		t.Errorf("analytics DEL: %v", err)
+	}
+	if err := check("ops", "DEL", "users:1"); err != nil {
+		t.Errorf("ops DEL: %v", err)
+	}
+	if err := check("unlisted", "DEL", "users:1"); err != nil {
+		t.Errorf("unlisted user: %v", err)
+	}
+
+	if err := l.SetUser("ops", []string{"-DEL"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := check("ops", "DEL", "users:1"); !errors.Is(err, ErrCommandDenied) {
+		t.Errorf("ops DEL after -DEL: %v", err)
+	}
+	if err := l.SetUser("ops", []string{"+DEL", "bogus"}); err == nil {
+		t.Error("SetUser accepted an invalid rule")
+	}
+	if err := check("ops", "DEL", "users:1"); !errors.Is(err, ErrCommandDenied) {
+		t.Errorf("failed SetUser changed the rules: %v", err)
+	}
+
+	want := []string{
+		"user analytics -@all +GET ~metrics:*",
+		"user ops +@all -DEL ~*",
+	}
+	got := l.Describe()
+	if len(got) != len(want) {
+		t.Fatalf("Describe() = %q", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Describe()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Package auth checks user passwords against scrypt hashes and slows down
+// clients that keep guessing them.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// DefaultUser is the user a single argument AUTH authenticates as.
+const DefaultUser = "default"
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrTooManyAttempts    = errors.New("too many failed authentication attempts, try again later")
+	ErrInvalidHash        = errors.New("invalid password hash")
+)
+
+// Parameters of new hashes. N = 2^15 and r = 8 take 32 MiB and in the order
+// of 100ms per check, which is the point.
+const (
+	hashScheme = "scrypt"
+	hashLogN   = 15
+	hashR      = 8
+	hashP      = 1
+	saltLen    = 16
+	keyLen     = 32
+)
+
+var b64 = base64.RawStdEncoding
+
+// HashPassword returns a hash of password in the form
+//
+//	scrypt$<log2 N>$<r>$<p>$<base64 salt>$<base64 key>
+//
+// which is what the users configuration option expects.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := scryptKey([]byte(password), salt, 1<<hashLogN, hashR, hashP, keyLen)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{
+		hashScheme,
+		strconv.Itoa(hashLogN),
+		strconv.Itoa(hashR),
+		strconv.Itoa(hashP),
+		b64.EncodeToString(salt),
+		b64.EncodeToString(key),
+	}, "$"), nil
+}
+
+type hash struct {
+	logN, r, p int
+	salt, key  []byte
+}
+
+func parseHash(s string) (*hash, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 || parts[0] != hashScheme {
+		return nil, ErrInvalidHash
+	}
+
+	var (
+		h   hash
+		err error
+	)
+	for i, n := range []*int{&h.logN, &h.r, &h.p} {
+		if *n, err = strconv.Atoi(parts[i+1]); err != nil || *n <= 0 {
+			return nil, ErrInvalidHash
+		}
+	}
+	if h.logN > 20 || h.r > 32 || h.p > 16 {
+		return nil, fmt.Errorf("%w: cost parameters are too large", ErrInvalidHash)
+	}
+	if h.salt, err = b64.DecodeString(parts[4]); err != nil {
+		return nil, ErrInvalidHash
+	}
+	if h.key, err = b64.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, ErrInvalidHash
+	}
+	return &h, nil
+}
+
+func (h *hash) matches(password string) bool {
+	key, err := scryptKey([]byte(password), h.salt, 1<<h.logN, h.r, h.p, len(h.key))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// ParseUsers parses a comma separated list of name:hash pairs, as produced by
+// HashPassword.
+func ParseUsers(s string) (map[string]string, error) {
+	users := make(map[string]string)
+	for entry := range strings.SplitSeq(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, hash, ok := strings.Cut(entry, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid user entry %q, expected name:hash", entry)
+		}
+		if _, ok := users[name]; ok {
+			return nil, fmt.Errorf("user %q is defined twice", name)
+		}
+		if _, err := parseHash(hash); err != nil {
+			return nil, fmt.Errorf("user %q: %w", name, err)
+		}
+		users[name] = hash
+	}
+	return users, nil
+}
+
+// Authenticator checks credentials on behalf of clients.
+type Authenticator struct {
+	users map[string]*hash
+	// dummy is checked for unknown users so that the time taken does not
+	// reveal which users exist.
+	dummy *hash
+	// sem bounds the number of concurrent checks, each of which holds a
+	// large scrypt buffer.
+	sem     chan struct{}
+	limiter *limiter
+}
+
+// NewAuthenticator returns an Authenticator for users, a map of user names
+// to password hashes.
+func NewAuthenticator(users map[string]string) (*Authenticator, error) {
+	a := &Authenticator{
+		users:   make(map[string]*hash, len(users)),
+		sem:     make(chan struct{}, runtime.GOMAXPROCS(0)),
+		limiter: newLimiter(),
+	}
+	for name, s := range users {
+		h, err := parseHash(s)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %w", name, err)
+		}
+		a.users[name] = h
+	}
+
+	dummy, err := HashPassword(rand.Text())
+	if err != nil {
+		return nil, err
+	}
+	a.dummy, _ = parseHash(dummy)
+	return a, nil
+}
+
+// Authenticate checks password for user on behalf of the client at
+// remoteAddr. Clients with repeated failures are refused with
+// ErrTooManyAttempts, without checking the password, until their backoff
+// expires.
+func (a *Authenticator) Authenticate(remoteAddr, user, password string) error {
+	client := clientKey(remoteAddr)
+	if err := a.limiter.allow(client); err != nil {
+		return err
+	}
+
+	h, ok := a.users[user]
+	if !ok {
+		h = a.dummy
+	}
+
+	a.sem <- struct{}{}
+	matches := h.matches(password)
+	<-a.sem
+
+	if !ok || !matches {
+		a.limiter.fail(client)
+		return ErrInvalidCredentials
+	}
+	a.limiter.succeed(client)
+	return nil
+}
+
+// clientKey identifies the client by host, so reconnecting does not reset
+// its backoff.
+func clientKey(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
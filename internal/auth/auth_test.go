@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test vectors from RFC 7914, section 12.
+func TestScryptVectors(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		N, r, p        int
+		want           string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+	}
+
+	for _, tt := range tests {
+		got, err := scryptKey([]byte(tt.password), []byte(tt.salt), tt.N, tt.r, tt.p, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("scrypt(%q, %q, %d, %d, %d) = %x", tt.password, tt.salt, tt.N, tt.r, tt.p, got)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := ParseUsers("alice:" + hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthenticator(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Authenticate("10.0.0.1:1000", "alice", "secret"); err != nil {
+		t.Fatalf("valid credentials: %v", err)
+	}
+	if err := a.Authenticate("10.0.0.1:1000", "alice", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("wrong password: %v", err)
+	}
+	if err := a.Authenticate("10.0.0.1:1000", "bob", "secret"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("unknown user: %v", err)
+	}
+}
+
+func TestParseUsers(t *testing.T) {
+	for _, s := range []string{"alice", "alice:plain", ":scrypt$1$1$1$AA$AA", "a:scrypt$15$8$1$AA$AA,a:scrypt$15$8$1$AA$AA"} {
+		if _, err := ParseUsers(s); err == nil {
+			t.Errorf("ParseUsers(%q) succeeded", s)
+		}
+	}
+}
+
+func TestLimiterBackoff(t *testing.T) {
+	now := time.Now()
+	l := newLimiter()
+	l.now = func() time.Time { return now }
+
+	for range freeAttempts {
+		if err := l.allow("c"); err != nil {
+			t.Fatal(err)
+		}
+		l.fail("c")
+	}
+	if err := l.allow("c"); err != nil {
+		t.Fatalf("blocked after %d failures", freeAttempts)
+	}
+
+	l.fail("c")
+	if err := l.allow("c"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("not blocked after %d failures", freeAttempts+1)
+	}
+	if err := l.allow("other"); err != nil {
+		t.Fatal("other client blocked")
+	}
+
+	now = now.Add(baseBackoff)
+	if err := l.allow("c"); err != nil {
+		t.Fatal("still blocked after backoff")
+	}
+	l.fail("c")
+	now = now.Add(baseBackoff)
+	if err := l.allow("c"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatal("backoff did not grow")
+	}
+
+	l.succeed("c")
+	if err := l.allow("c"); err != nil {
+		t.Fatal("blocked after success")
+	}
+}
+
+func TestLimiterConcurrentAttempts(t *testing.T) {
+	l := newLimiter()
+
+	// Every attempt is allowed before any of them fails, like concurrent
+	// AUT commands whose passwords are still being checked.
+	const n = 50
+	var (
+		allowed atomic.Int32
+		checked sync.WaitGroup
+		failed  sync.WaitGroup
+	)
+	checked.Add(n)
+	for range n {
+		failed.Go(func() {
+			ok := l.allow("c") == nil
+			if ok {
+				allowed.Add(1)
+			}
+			checked.Done()
+			checked.Wait()
+			if ok {
+				l.fail("c")
+			}
+		})
+	}
+	failed.Wait()
+
+	if got := allowed.Load(); got != freeAttempts {
+		t.Fatalf("%d concurrent attempts allowed, want %d", got, freeAttempts)
+	}
+
+	// Past the free attempts, only one at a time.
+	if err := l.allow("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.allow("c"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatal("second attempt allowed while one is pending")
+	}
+	l.fail("c")
+	if err := l.allow("c"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatal("not blocked after the failure")
+	}
+}
+
+func TestLimiterBound(t *testing.T) {
+	now := time.Now()
+	l := newLimiter()
+	l.now = func() time.Time { return now }
+
+	for i := range maxTracked + 100 {
+		client := strconv.Itoa(i)
+		if err := l.allow(client); err != nil {
+			t.Fatal(err)
+		}
+		l.fail(client)
+		now = now.Add(time.Millisecond)
+	}
+	if len(l.clients) > maxTracked {
+		t.Fatalf("tracking %d clients, want at most %d", len(l.clients), maxTracked)
+	}
+	if _, ok := l.clients[strconv.Itoa(maxTracked+99)]; !ok {
+		t.Fatal("newest client not tracked")
+	}
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// freeAttempts is the number of failures a client may have before it
+	// is backed off.
+	freeAttempts = 3
+	baseBackoff  = time.Second
+	maxBackoff   = 5 * time.Minute
+	// maxTracked bounds the number of clients remembered. Once it is
+	// reached, expired entries are dropped, and failing that the client
+	// seen least recently.
+	maxTracked = 10_000
+)
+
+type attempts struct {
+	failures int
+	// pending counts the attempts that were allowed and whose outcome is
+	// not known yet.
+	pending      int
+	blockedUntil time.Time
+	last         time.Time
+}
+
+// limiter tracks failed attempts per client and blocks a client for an
+// exponentially growing time after each failure beyond freeAttempts.
+//
+// allow reserves an attempt, which fail or succeed settle, so concurrent
+// attempts count before their passwords are checked: a client gets at most
+// freeAttempts at once, and a single one at a time after that.
+type limiter struct {
+	mu      sync.Mutex
+	clients map[string]*attempts
+	now     func() time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{clients: make(map[string]*attempts), now: time.Now}
+}
+
+func (l *limiter) allow(client string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	a, ok := l.clients[client]
+	if !ok {
+		if len(l.clients) >= maxTracked {
+			l.prune(now)
+		}
+		a = &attempts{}
+		l.clients[client] = a
+	} else if a.pending == 0 && now.Sub(a.last) > maxBackoff {
+		a.failures = 0
+	}
+
+	if now.Before(a.blockedUntil) || (a.pending > 0 && a.failures+a.pending >= freeAttempts) {
+		return ErrTooManyAttempts
+	}
+	a.pending++
+	a.last = now
+	return nil
+}
+
+func (l *limiter) fail(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, ok := l.clients[client]
+	if !ok {
+		// Evicted while the attempt was pending.
+		return
+	}
+	now := l.now()
+	a.pending = max(a.pending-1, 0)
+	a.failures++
+	a.last = now
+	if over := a.failures - freeAttempts; over > 0 {
+		backoff := maxBackoff
+		if over <= 16 {
+			backoff = min(baseBackoff<<(over-1), maxBackoff)
+		}
+		a.blockedUntil = now.Add(backoff)
+	}
+}
+
+func (l *limiter) succeed(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, ok := l.clients[client]
+	if !ok {
+		return
+	}
+	a.pending = max(a.pending-1, 0)
+	if a.pending == 0 {
+		delete(l.clients, client)
+		return
+	}
+	a.failures = 0
+	a.blockedUntil = time.Time{}
+}
+
+// prune forgets clients without pending attempts whose last attempt is older
+// than maxBackoff. If that frees nothing, it forgets the client seen least
+// recently.
+func (l *limiter) prune(now time.Time) {
+	var (
+		oldest     string
+		oldestSeen time.Time
+	)
+	for client, a := range l.clients {
+		if a.pending == 0 && now.Sub(a.last) > maxBackoff {
+			delete(l.clients, client)
+			continue
+		}
+		if oldestSeen.IsZero() || a.last.Before(oldestSeen) {
+			oldest, oldestSeen = client, a.last
+		}
+	}
+	if len(l.clients) >= maxTracked {
+		delete(l.clients, oldest)
+	}
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// scryptKey derives a key from password and salt as specified in RFC 7914.
+// N must be a power of two greater than 1.
+func scryptKey(password, salt []byte, N, r, p, keyLen int) ([]byte, error) {
+	if N <= 1 || N&(N-1) != 0 {
+		return nil, errors.New("scrypt: N must be a power of two greater than 1")
+	}
+	if r <= 0 || p <= 0 || uint64(r)*uint64(p) >= 1<<30 || r > (1<<30)/(128*N) {
+		return nil, errors.New("scrypt: parameters are too large")
+	}
+
+	blockLen := 128 * r
+	b, err := pbkdf2.Key(sha256.New, string(password), salt, 1, p*blockLen)
+	if err != nil {
+		return nil, err
+	}
+
+	words := 32 * r
+	v := make([]uint32, N*words)
+	x := make([]uint32, words)
+	y := make([]uint32, words)
+	for i := range p {
+		roMix(b[i*blockLen:(i+1)*blockLen], r, N, v, x, y)
+	}
+
+	return pbkdf2.Key(sha256.New, string(password), b, 1, keyLen)
+}
+
+// roMix is the sequential memory-hard mixing function scryptROMix.
+func roMix(b []byte, r, N int, v, x, y []uint32) {
+	words := 32 * r
+	for i := range words {
+		x[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+
+	for i := range N {
+		copy(v[i*words:], x)
+		blockMix(x, y, r)
+		x, y = y, x
+	}
+
+	last := (2*r - 1) * 16
+	for range N {
+		j := int((uint64(x[last]) | uint64(x[last+1])<<32) & uint64(N-1))
+		for k, w := range v[j*words : (j+1)*words] {
+			x[k] ^= w
+		}
+		blockMix(x, y, r)
+		x, y = y, x
+	}
+
+	for i := range words {
+		binary.LittleEndian.PutUint32(b[i*4:], x[i])
+	}
+}
+
+// blockMix is scryptBlockMix: it runs Salsa20/8 over the 2r 64 byte blocks
+// of in and writes the even results followed by the odd ones to out.
+func blockMix(in, out []uint32, r int) {
+	var x [16]uint32
+	copy(x[:], in[(2*r-1)*16:])
+
+	for i := range 2 * r {
+		for j := range x {
+			x[j] ^= in[i*16+j]
+		}
+		salsa208(&x)
+
+		dst := (i / 2) * 16
+		if i%2 == 1 {
+			dst += r * 16
+		}
+		copy(out[dst:], x[:])
+	}
+}
+
+// salsa208 applies the Salsa20/8 core to b in place.
+func salsa208(b *[16]uint32) {
+	x := *b
+	rot := bits.RotateLeft32
+
+	for i := 0; i < 8; i += 2 {
+		x[4] ^= rot(x[0]+x[12], 7)
+		x[8] ^= rot(x[4]+x[0], 9)
+		x[12] ^= rot(x[8]+x[4], 13)
+		x[0] ^= rot(x[12]+x[8], 18)
+
+		x[9] ^= rot(x[5]+x[1], 7)
+		x[13] ^= rot(x[9]+x[5], 9)
+		x[1] ^= rot(x[13]+x[9], 13)
+		x[5] ^= rot(x[1]+x[13], 18)
+
+		x[14] ^= rot(x[10]+x[6], 7)
+		x[2] ^= rot(x[14]+x[10], 9)
+		x[6] ^= rot(x[2]+x[14], 13)
+		x[10] ^= rot(x[6]+x[2], 18)
+
+		x[3] ^= rot(x[15]+x[11], 7)
+		x[7] ^= rot(x[3]+x[15], 9)
+		x[11] ^= rot(x[7]+x[3], 13)
+		x[15] ^= rot(x[11]+x[7], 18)
+
+		x[1] ^= rot(x[0]+x[3], 7)
+		x[2] ^= rot(x[1]+x[0], 9)
+		x[3] ^= rot(x[2]+x[1], 13)
+		x[0] ^= rot(x[3]+x[2], 18)
+
+		x[6] ^= rot(x[5]+x[4], 7)
+		x[7] ^= rot(x[6]+x[5], 9)
+		x[4] ^= rot(x[7]+x[6], 13)
+		x[5] ^= rot(x[4]+x[7], 18)
+
+		x[11] ^= rot(x[10]+x[9], 7)
+		x[8] ^= rot(x[11]+x[10], 9)
+		x[9] ^= rot(x[8]+x[11], 13)
+		x[10] ^= rot(x[9]+x[8], 18)
+
+		x[12] ^= rot(x[15]+x[14], 7)
+		x[13] ^= rot(x[12]+x[15], 9)
+		x[14] ^= rot(x[13]+x[12], 13)
+		x[15] ^= rot(x[14]+x[13], 18)
+	}
+
+	for i := range b {
+		b[i] += x[i]
+	}
+}
@@ -1,33 +1,58 @@
 package config
 
-import "flag"
+import (
+	"flag"
+)
 
+// CLIGetter reads options from command-line flags named like the options,
+// e.g. -port 9000 or -max_clients=100.
 type CLIGetter struct {
+	fs   *flag.FlagSet
 	args map[string]any
 }
 
 func NewCLIGetter() *CLIGetter {
-	return &CLIGetter{
-		args: make(map[string]any),
+	return &CLIGetter{}
+}
+
+// Register defines a flag for every configuration option on fs. Values are
+// read from the flags that were set once fs has been parsed.
+func (c *CLIGetter) Register(fs *flag.FlagSet) {
+	c.fs = fs
+	for _, key := range Options() {
+		fs.String(key, "", "configuration option "+key)
 	}
 }
 
-// Run parses command-line flags for "host" and "port", and stores their values
-// in the CLIGetter's args map. It uses the standard flag package to define and
-// parse the flags, then iterates over the set flags to populate the args map
-// with their names and values.
+// Run registers the flags on the program's command line and parses it.
 func (c *CLIGetter) Run() {
-	flag.String("host", "", "server host")
-	flag.Int("port", 0, "server port")
-
+	c.Register(flag.CommandLine)
 	flag.Parse()
-
-	flag.Visit(func(f *flag.Flag) {
-		c.args[f.Name] = f.Value.String()
-	})
 }
 
 func (c *CLIGetter) Get(key string) any {
-	val := c.args[key]
-	return val
+	if c.args == nil {
+		c.args = make(map[string]any)
+		if c.fs != nil {
+			c.fs.Visit(func(f *flag.Flag) {
+				c.args[f.Name] = f.Value.String()
+			})
+		}
+	}
+	return c.args[key]
+}
+
+// Location returns the name of key's flag.
+func (c *CLIGetter) Location(key string) string {
+	return "flag -" + key
+}
+
+// Options returns the names of all configuration options, in the order of
+// the fields of Config.
+func Options() []string {
+	var keys []string
+	for _, f := range fields() {
+		keys = append(keys, f.opt.key)
+	}
+	return keys
 }
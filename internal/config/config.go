@@ -1,18 +1,110 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"maps"
 	"reflect"
-	"slices"
-	"strconv"
 	"strings"
 )
 
 type Config struct {
 	Host string `cfg:"host,default:localhost"`
-	Port int    `cfg:"port,default:19201"`
+	Port int    `cfg:"port,default:19201,min:0,max:65535"`
+	// Listeners, if set, replace Host and Port. Every item is a TCP address
+	// or a Unix socket, see ParseEndpoint.
+	Listeners []string `cfg:"listeners"`
+
+	Store  string `cfg:"store,default:sharded,enum:sharded|hashmap"`
+	Shards int    `cfg:"shards,default:16,min:0,max:16"`
+
+	Script ScriptConfig `cfg:"script"`
+
+	ShutdownTimeoutMs int `cfg:"shutdown_timeout_ms,default:10000,min:0,mutable"`
+
+	SlowLog SlowLogConfig `cfg:"slowlog"`
+
+	TLS TLSConfig `cfg:"tls"`
+
+	IOMode     string `cfg:"io_mode,default:goroutine,enum:goroutine|epoll"`
+	EventLoops int    `cfg:"event_loops,default:0,min:0"`
+
+	MaxClients     int      `cfg:"max_clients,default:10000,min:0,mutable"`
+	MaxFrameSize   ByteSize `cfg:"max_frame_size,default:16mb,min:0,mutable"`
+	IdleTimeoutMs  int      `cfg:"idle_timeout_ms,default:0,min:0,mutable"`
+	ReadTimeoutMs  int      `cfg:"read_timeout_ms,default:10000,min:0,mutable"`
+	WriteTimeoutMs int      `cfg:"write_timeout_ms,default:10000,min:0,mutable"`
+
+	// Users is a comma separated list of name:hash pairs. When it is set,
+	// connections must authenticate before running commands.
+	Users string `cfg:"users"`
+	// ACL is a semicolon separated list of users and their permissions, see
+	// package acl. Users without an entry are not restricted.
+	ACL string `cfg:"acl"`
+
+	Log LogConfig `cfg:"log"`
+
+	// MetricsAddr is the address of the HTTP listener serving /metrics in
+	// the Prometheus text format. The endpoint is disabled if it is empty.
+	MetricsAddr string `cfg:"metrics_addr"`
+
+	// HTTPAddr is the address of the HTTP listener serving the key-value
+	// commands as a REST API, see package gateway. It is disabled if empty.
+	HTTPAddr string `cfg:"http_addr"`
+	// WebSocket configures the WebSocket endpoint of the HTTP listener.
+	WebSocket WebSocketConfig `cfg:"websocket"`
 
 	ConfigPath string
+
+	// sources maps the options set by a SourceGetter to their source.
+	sources map[string]string
+}
+
+// ScriptConfig bounds the steps, the run time and the memory of a single
+// script, and the size of the script cache.
+type ScriptConfig struct {
+	MaxSteps      int      `cfg:"max_steps,default:100000,min:1,mutable"`
+	TimeoutMs     int      `cfg:"timeout_ms,default:50,min:1,mutable"`
+	MaxStringSize ByteSize `cfg:"max_string_size,default:16mb,min:0,mutable"`
+	MaxMemory     ByteSize `cfg:"max_memory,default:64mb,min:0,mutable"`
+	CacheSize     ByteSize `cfg:"cache_size,default:32mb,min:0"`
+}
+
+// SlowLogConfig configures the slow log. Commands taking at least
+// ThresholdUs microseconds are kept, up to MaxLen of them. A negative
+// threshold disables the slow log.
+type SlowLogConfig struct {
+	ThresholdUs int `cfg:"threshold_us,default:10000,mutable"`
+	MaxLen      int `cfg:"max_len,default:128,min:0,mutable"`
+}
+
+// TLSConfig enables TLS when CertFile is set.
+type TLSConfig struct {
+	CertFile   string `cfg:"cert_file"`
+	KeyFile    string `cfg:"key_file"`
+	CAFile     string `cfg:"ca_file"`
+	ClientAuth string `cfg:"client_auth,default:none,enum:none|optional|require"`
+}
+
+// LogConfig configures logging. Logs go to standard error unless File is
+// set; the file is rotated when it would grow past MaxSize, keeping
+// MaxBackups rotated files.
+type LogConfig struct {
+	Level      string   `cfg:"level,default:info,enum:debug|info|warn|error,mutable"`
+	Format     string   `cfg:"format,default:text,enum:text|json"`
+	File       string   `cfg:"file"`
+	MaxSize    ByteSize `cfg:"max_size,default:100mb,min:0"`
+	MaxBackups int      `cfg:"max_backups,default:5,min:0"`
+}
+
+// WebSocketConfig configures WebSocket connections. Browsers may connect
+// from pages on the host of the listener and from Origins. Connections are
+// pinged every PingIntervalMs and closed after two intervals of silence;
+// messages larger than MaxMessageSize close them.
+type WebSocketConfig struct {
+	Origins        []string `cfg:"origins"`
+	PingIntervalMs int      `cfg:"ping_interval_ms,default:30000,min:0,mutable"`
+	MaxMessageSize ByteSize `cfg:"max_message_size,default:16mb,min:0,mutable"`
 }
 
 type Arg func(cfg *Config)
@@ -23,23 +115,68 @@ func WithConfigPath(path string) Arg {
 	}
 }
 
-func LoadConfig(from string, args ...Arg) *Config {
+// LoadConfig merges, in increasing order of precedence, the defaults, the
+// file at the path given by WithConfigPath, in JSON if its name ends in
+// .json and in key = value lines otherwise, GOSTASH_* environment variables
+// and the flags of cli. cli may be nil, and its flags must have been parsed.
+//
+// It returns every problem found, each a *FieldError, joined into one error.
+func LoadConfig(cli *CLIGetter, args ...Arg) (*Config, error) {
 	var cfg Config
 	for _, arg := range args {
 		arg(&cfg)
 	}
 
-	switch from {
-	case "config":
-		getter := NewFileGetter()
-		getter.Load(cfg.ConfigPath)
-		load(&cfg, getter)
-	case "cli":
-		getter := NewCLIGetter()
-		getter.Run()
-		load(&cfg, getter)
+	var errs []error
+	var layers []Layer
+	if cfg.ConfigPath != "" {
+		file, err := newFileGetter(cfg.ConfigPath)
+		if err != nil {
+			return &cfg, err
+		}
+		if err := file.Load(cfg.ConfigPath); err != nil {
+			errs = append(errs, err)
+		}
+		layers = append(layers, Layer{Source: SourceFile, Getter: file})
+	}
+	layers = append(layers, Layer{Source: SourceEnv, Getter: NewEnvGetter()})
+	if cli != nil {
+		layers = append(layers, Layer{Source: SourceCLI, Getter: cli})
+	}
+
+	getter := NewLayeredGetter(layers...)
+	cfg.sources = make(map[string]string)
+	if err := load(&cfg, getter, cfg.sources); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := cfg.Endpoints(); err != nil {
+		errs = append(errs, &FieldError{Location: getter.Location("listeners"), Option: "listeners", Err: err})
+	}
+	return &cfg, errors.Join(errs...)
+}
+
+// Source returns where the value of an option came from: SourceFile,
+// SourceEnv, SourceCLI, or SourceDefault for options that were not set.
+func (c *Config) Source(key string) string {
+	if source, ok := c.sources[key]; ok {
+		return source
 	}
+	return SourceDefault
+}
+
+// Sources returns the options that were set by a source other than the
+// defaults, with their source.
+func (c *Config) Sources() map[string]string {
+	return maps.Clone(c.sources)
+}
 
+// Default returns a Config with every field set to its default.
+func Default() *Config {
+	var cfg Config
+	if err := load(&cfg, noValues{}, nil); err != nil {
+		// The defaults are part of the program; this is a bug.
+		panic(err)
+	}
 	return &cfg
 }
 
@@ -47,83 +184,139 @@ type Getter interface {
 	Get(string) any
 }
 
-// load populates the fields of the provided Config struct pointer (cfg) using values
-// obtained from the given Getter interface. It uses reflection to iterate over the struct
-// fields, reading the "cfg" struct tag to determine the configuration key, and optional
-// modifiers such as "required" and "default:<value>".
+// Locator is implemented by Getters that can tell where a value was read
+// from, for error messages.
+type Locator interface {
+	Location(key string) string
+}
+
+// noValues is a Getter without any values.
+type noValues struct{}
+
+func (noValues) Get(string) any { return nil }
+
+// FieldError is a problem with the value of one option, or with a line of
+// a configuration file.
+type FieldError struct {
+	// Location is where the value came from, such as "stash.conf:12" or
+	// "GOSTASH_PORT". It is empty for defaults.
+	Location string
+	// Option is empty for lines of a file that are not options.
+	Option string
+	Err    error
+}
+
+func (e *FieldError) Error() string {
+	var b strings.Builder
+	if e.Location != "" {
+		b.WriteString(e.Location + ": ")
+	}
+	if e.Option != "" {
+		b.WriteString(e.Option + ": ")
+	}
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// load populates the fields of the struct dst points to with values
+// obtained from getter. The "cfg" tag of a field names its option and may
+// add modifiers after commas:
 //
-// For each field with a "cfg" tag:
-//   - If the tag contains "required" and the value is missing, it panics.
-//   - If the value is missing but a "default" is specified, it uses the default value.
-//   - Supports string and int field types, converting values as needed.
-//   - Panics if a required value is missing, or if a value cannot be converted to the
-//     appropriate type.
+//   - required: the option must be set.
+//   - default:<value>: the value used when the option is not set. Items of
+//     list defaults are separated by "|".
+//   - min:<value>, max:<value>: bounds for numbers, durations and sizes.
+//   - enum:<a>|<b>|...: the values a string option may take.
+//   - mutable: the option may be changed while the server runs, see Runtime.
 //
-// Example tag: `cfg:"my_key,required,default:42"`
+// Fields may be strings, ints, bools, time.Durations, ByteSizes and string
+// lists, given as comma separated items. A struct field tagged with just a
+// name is a section: its fields are options named after the section and
+// their own tag, joined by "_", so the option max_len of section slowlog is
+// slowlog_max_len.
 //
-// Panics on missing required fields, invalid default values, or unsupported field types.
-func load(cfg *Config, getter Getter) {
-	typ := reflect.TypeOf(*cfg)
-	val := reflect.ValueOf(cfg).Elem()
-
-	for i := 0; i < typ.NumField(); i++ {
-		field := typ.Field(i)
-		tag := field.Tag.Get("cfg")
-		if tag == "" {
-			continue
-		}
-		f := val.FieldByName(field.Name)
-		if !f.CanSet() {
+// Example tag: `cfg:"my_key,required,default:42,min:1"`
+//
+// If sources is not nil and getter is a SourceGetter, the source of every
+// option set is recorded in it. All problems are returned together, each as
+// a *FieldError.
+func load(dst any, getter Getter, sources map[string]string) error {
+	val := reflect.ValueOf(dst).Elem()
+
+	var errs []error
+	for _, field := range fieldsOf(val.Type()) {
+		opt := field.opt
+		if field.err != nil {
+			errs = append(errs, &FieldError{Option: opt.key, Err: field.err})
 			continue
 		}
+		f := val.FieldByIndex(field.index)
 
-		parts := strings.Split(tag, ",")
-		tag = parts[0]
-		val := getter.Get(tag)
-		isZeroValue := val == nil || reflect.ValueOf(val).IsZero()
-
-		if slices.Contains(parts, "required") && isZeroValue {
-			panic(fmt.Sprintf("missing required configuration field: %s", tag))
-		} else if isZeroValue {
-			for _, part := range parts[1:] {
-				if after, ok := strings.CutPrefix(part, "default:"); ok {
-					switch f.Kind() {
-					case reflect.String:
-						val = after
-					case reflect.Int:
-						intVal, err := strconv.Atoi(after)
-						if err != nil {
-							panic(fmt.Sprintf("invalid default int value for %s: %s", tag, after))
-						}
-						val = intVal
-					default:
-						panic("unsupported field type for default value")
-					}
-					break
-				}
+		raw := getter.Get(opt.key)
+		var location string
+		if raw == nil || raw == "" {
+			switch {
+			case opt.required:
+				errs = append(errs, &FieldError{Option: opt.key, Err: errors.New("missing required option")})
+				continue
+			case opt.def == nil:
+				// Options without a value or a default keep their zero
+				// value.
+				continue
+			}
+			raw = *opt.def
+		} else {
+			if sg, ok := getter.(SourceGetter); ok && sources != nil {
+				sources[opt.key] = sg.Source(opt.key)
 			}
+			if l, ok := getter.(Locator); ok {
+				location = l.Location(opt.key)
+			}
+		}
+
+		if err := opt.set(f, fmt.Sprint(raw)); err != nil {
+			errs = append(errs, &FieldError{Location: location, Option: opt.key, Err: err})
 		}
+	}
+	return errors.Join(errs...)
+}
+
+// field is an option of a struct loaded by load.
+type field struct {
+	// index is the index sequence of the field for reflect.Value.FieldByIndex.
+	index []int
+	// path holds the names of the enclosing sections and of the option.
+	path []string
+	opt  option
+	// err is set if the tag of the field is invalid.
+	err error
+}
 
-		switch f.Kind() {
-		case reflect.String:
-			f.SetString(fmt.Sprint(val))
-		case reflect.Int:
-			var intVal int64
-			var err error
-			switch v := val.(type) {
-			case int:
-				intVal = int64(v)
-			case string:
-				intVal, err = strconv.ParseInt(v, 10, 64)
-				if err != nil {
-					panic(fmt.Sprintf("could not parse int for %s: %v", tag, val))
-				}
-			default:
-				panic(fmt.Sprintf("unsupported type %T for int field %s", val, tag))
+// fieldsOf returns the options of the struct type typ, in field order, with
+// the fields of sections in place of the section.
+func fieldsOf(typ reflect.Type) []field {
+	var fields []field
+	for i := range typ.NumField() {
+		sf := typ.Field(i)
+		tag := sf.Tag.Get("cfg")
+		if tag == "" || !sf.IsExported() {
+			continue
+		}
+		if sf.Type.Kind() == reflect.Struct && !strings.Contains(tag, ",") {
+			for _, sub := range fieldsOf(sf.Type) {
+				sub.index = append([]int{i}, sub.index...)
+				sub.path = append([]string{tag}, sub.path...)
+				sub.opt.key = tag + "_" + sub.opt.key
+				fields = append(fields, sub)
 			}
-			f.SetInt(intVal)
-		default:
-			panic("unsupported field type")
+			continue
 		}
+		opt, err := parseTag(tag)
+		fields = append(fields, field{index: []int{i}, path: []string{opt.key}, opt: opt, err: err})
 	}
+	return fields
 }
@@ -0,0 +1,424 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigLayers(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "stash.conf"), []byte("host = filehost\nport = 1000\nmax_clients = 10\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+	t.Setenv("GOSTASH_PORT", "2000")
+	t.Setenv("GOSTASH_IO_MODE", "epoll")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cli := NewCLIGetter()
+	cli.Register(fs)
+	if err := fs.Parse([]string{"-io_mode", "goroutine", "-shards=4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(cli, WithConfigPath("stash.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		key, source string
+		got, want   any
+	}{
+		{"host", SourceFile, cfg.Host, "filehost"},
+		{"max_clients", SourceFile, cfg.MaxClients, 10},
+		{"port", SourceEnv, cfg.Port, 2000},
+		{"io_mode", SourceCLI, cfg.IOMode, "goroutine"},
+		{"shards", SourceCLI, cfg.Shards, 4},
+		{"store", SourceDefault, cfg.Store, "sharded"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s = %v, want %v", tc.key, tc.got, tc.want)
+		}
+		if got := cfg.Source(tc.key); got != tc.source {
+			t.Errorf("source of %s = %q, want %q", tc.key, got, tc.source)
+		}
+	}
+	if len(cfg.Sources()) != 5 {
+		t.Errorf("Sources = %v", cfg.Sources())
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := LoadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Options without a default stay empty rather than turning on the
+	// features they configure.
+	if cfg.TLS.CertFile != "" || cfg.Users != "" || cfg.HTTPAddr != "" || cfg.Listeners != nil {
+		t.Fatalf("options without a default set: tls_cert_file=%q users=%q http_addr=%q listeners=%q",
+			cfg.TLS.CertFile, cfg.Users, cfg.HTTPAddr, cfg.Listeners)
+	}
+	if cfg.Port != 19201 || cfg.Store != "sharded" {
+		t.Fatalf("port = %d, store = %q", cfg.Port, cfg.Store)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stash.conf")
+	conf := strings.Join([]string{
+		"# comment",
+		"port = 70000",
+		"store = btree",
+		"no equals sign",
+		"colour = blue",
+		"max_frame_size = 1zb",
+		"shards = 4",
+	}, "\n")
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOSTASH_EVENT_LOOPS", "-1")
+
+	// An absolute path is used as is.
+	cfg, err := LoadConfig(nil, WithConfigPath(path))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	want := []string{
+		path + ":2: port: 70000 is above the maximum of 65535",
+		path + ":3: store: \"btree\" is not one of sharded, hashmap",
+		path + ":4: expected key = value, got \"no equals sign\"",
+		path + ":5: colour: unknown option",
+		path + ":6: max_frame_size: invalid size \"1zb\"",
+		"GOSTASH_EVENT_LOOPS: event_loops: -1 is below the minimum of 0",
+	}
+	for _, line := range want {
+		if !strings.Contains(err.Error(), line) {
+			t.Errorf("error does not contain %q:\n%v", line, err)
+		}
+	}
+	var fe *FieldError
+	if !errors.As(err, &fe) {
+		t.Errorf("error %v is not a *FieldError", err)
+	}
+	// Valid options are still applied.
+	if cfg.Shards != 4 {
+		t.Errorf("shards = %d, want 4", cfg.Shards)
+	}
+
+	if _, err := LoadConfig(nil, WithConfigPath(filepath.Join(t.TempDir(), "missing.conf"))); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: got %v", err)
+	}
+}
+
+func TestFieldTypes(t *testing.T) {
+	type fields struct {
+		Enabled bool          `cfg:"enabled,default:true"`
+		Timeout time.Duration `cfg:"timeout,default:1s,min:10ms,max:1m"`
+		Size    ByteSize      `cfg:"size,default:64mb,max:1gb"`
+		Modes   []string      `cfg:"modes,default:a|b,enum:a|b|c"`
+		Name    string        `cfg:"name,required"`
+	}
+
+	var got fields
+	if err := load(&got, mapGetter{"name": "x"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := fields{Enabled: true, Timeout: time.Second, Size: 64 << 20, Modes: []string{"a", "b"}, Name: "x"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("defaults = %+v, want %+v", got, want)
+	}
+
+	got = fields{}
+	err := load(&got, mapGetter{"enabled": "false", "timeout": "250ms", "size": "512k", "modes": "c, a"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "name: missing required option") {
+		t.Errorf("expected missing name, got %v", err)
+	}
+	want = fields{Timeout: 250 * time.Millisecond, Size: 512 << 10, Modes: []string{"c", "a"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for key, val := range map[string]string{
+		"enabled": "maybe",
+		"timeout": "1ms",
+		"size":    "2gb",
+		"modes":   "a,d",
+	} {
+		if err := load(&fields{}, mapGetter{"name": "x", key: val}, nil); err == nil {
+			t.Errorf("%s = %s: expected an error", key, val)
+		}
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	for in, want := range map[string]ByteSize{
+		"0":    0,
+		"100":  100,
+		"100b": 100,
+		"16kb": 16 << 10,
+		"16K":  16 << 10,
+		"64mb": 64 << 20,
+		"2 GB": 2 << 30,
+		"-1":   -1,
+	} {
+		got, err := ParseByteSize(in)
+		if err != nil || got != want {
+			t.Errorf("ParseByteSize(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "mb", "1.5mb", "1tb", "9999999999gb"} {
+		if _, err := ParseByteSize(in); err == nil {
+			t.Errorf("ParseByteSize(%q): expected an error", in)
+		}
+	}
+	if s := ByteSize(16 << 20).String(); s != "16mb" {
+		t.Errorf("String = %q", s)
+	}
+}
+
+type mapGetter map[string]string
+
+func (m mapGetter) Get(key string) any {
+	if val, ok := m[key]; ok {
+		return val
+	}
+	return nil
+}
+
+func TestParseEndpoint(t *testing.T) {
+	for in, want := range map[string]Endpoint{
+		"127.0.0.1:19201":          {Network: "tcp", Address: "127.0.0.1:19201"},
+		"[::1]:0":                  {Network: "tcp", Address: "[::1]:0"},
+		"unix:/run/stash.sock":     {Network: "unix", Address: "/run/stash.sock"},
+		"unix:stash.sock?mode=660": {Network: "unix", Address: "stash.sock", Mode: 0o660},
+	} {
+		got, err := ParseEndpoint(in)
+		if err != nil || got != want {
+			t.Errorf("ParseEndpoint(%q) = %+v, %v, want %+v", in, got, err, want)
+		}
+		if s := got.String(); s != in {
+			t.Errorf("String = %q, want %q", s, in)
+		}
+	}
+	for _, in := range []string{"localhost", "unix:", "unix:s.sock?mode=999", "unix:s.sock?mode=rw"} {
+		if _, err := ParseEndpoint(in); err == nil {
+			t.Errorf("ParseEndpoint(%q): expected an error", in)
+		}
+	}
+
+	cfg := &Config{Host: "localhost", Port: 19201}
+	if got, err := cfg.Endpoints(); err != nil || len(got) != 1 || got[0].Address != "localhost:19201" {
+		t.Errorf("Endpoints = %+v, %v", got, err)
+	}
+	path := filepath.Join(t.TempDir(), "stash.conf")
+	if err := os.WriteFile(path, []byte("listeners = :19201, unix:\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadConfig(nil, WithConfigPath(path))
+	if err == nil || !strings.Contains(err.Error(), path+":1: listeners: invalid listener \"unix:\"") {
+		t.Errorf("LoadConfig: %v", err)
+	}
+}
+
+func TestRuntimeHooks(t *testing.T) {
+	rt := NewRuntime(Default())
+	var applied []int
+	rt.OnChange("max_clients", func(cfg *Config) error {
+		applied = append(applied, cfg.MaxClients)
+		return nil
+	})
+	rt.OnChange("max_clients", func(cfg *Config) error {
+		if cfg.MaxClients == 13 {
+			return errors.New("unlucky")
+		}
+		return nil
+	})
+
+	if err := rt.Set("max_clients", "5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Set("max_clients", "13"); err == nil {
+		t.Fatal("expected the hook to reject 13")
+	}
+	// The first hook is undone with the previous configuration.
+	if want := []int{5, 13, 5}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("hooks saw %v, want %v", applied, want)
+	}
+	if got := rt.Config().MaxClients; got != 5 {
+		t.Errorf("max_clients = %d, want 5", got)
+	}
+	if got := rt.Config().Source("max_clients"); got != SourceRuntime {
+		t.Errorf("source = %q", got)
+	}
+	if err := rt.Set("port", "1"); !errors.Is(err, ErrImmutable) {
+		t.Errorf("setting port: %v", err)
+	}
+	if err := rt.Rewrite(); !errors.Is(err, ErrNoConfigFile) {
+		t.Errorf("Rewrite without a file: %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stash.conf")
+	write := func(conf string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("port = 1000\nmax_clients = 10\n")
+	cfg, err := LoadConfig(nil, WithConfigPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := NewRuntime(cfg)
+	var hooked int
+	rt.OnChange("max_clients", func(cfg *Config) error {
+		hooked = cfg.MaxClients
+		return nil
+	})
+	r := NewReloader(rt, nil)
+	r.interval = 10 * time.Millisecond
+
+	// An invalid file changes nothing.
+	write("port = 1000\nmax_clients = many\n")
+	if _, err := r.Reload(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if rt.Config().MaxClients != 10 {
+		t.Fatalf("max_clients = %d after an invalid reload", rt.Config().MaxClients)
+	}
+
+	write("port = 2000\nmax_clients = 20\nslowlog_max_len = 4\n")
+	res, err := r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Applied, []string{"slowlog_max_len", "max_clients"}) || !reflect.DeepEqual(res.Restart, []string{"port"}) {
+		t.Fatalf("Reload = %+v", res)
+	}
+	if got := rt.Config(); got.MaxClients != 20 || got.SlowLog.MaxLen != 4 || got.Port != 1000 || hooked != 20 {
+		t.Fatalf("after reload: max_clients %d, slowlog_max_len %d, port %d, hook %d", got.MaxClients, got.SlowLog.MaxLen, got.Port, hooked)
+	}
+	if got := rt.Config().Source("slowlog_max_len"); got != SourceFile {
+		t.Errorf("source = %q", got)
+	}
+
+	// Watch picks up changes of the file, and options removed from it go
+	// back to their default.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, nil)
+	write("port = 2000\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for rt.Config().MaxClients != 10000 {
+		if time.Now().After(deadline) {
+			t.Fatalf("max_clients = %d, change not picked up", rt.Config().MaxClients)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, ok := rt.Config().Sources()["max_clients"]; ok {
+		t.Errorf("max_clients still has a source: %v", rt.Config().Sources())
+	}
+}
+
+func TestJSONConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "stash.json")
+	conf := `{
+  "port": 1000,
+  "tls_client_auth": "optional",
+  "slowlog": {
+    "threshold_us": 500,
+    "max_len": null
+  },
+  "script": {"max_steps": "many"},
+  "colour": "blue"
+}
+`
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(nil, WithConfigPath(path))
+	for _, line := range []string{
+		path + `:8: script_max_steps: invalid integer "many"`,
+		path + `:9: colour: unknown option`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), line) {
+			t.Errorf("error does not contain %q:\n%v", line, err)
+		}
+	}
+	if cfg.Port != 1000 || cfg.TLS.ClientAuth != "optional" || cfg.SlowLog.ThresholdUs != 500 || cfg.SlowLog.MaxLen != 128 {
+		t.Errorf("cfg = %+v", cfg)
+	}
+	if got := cfg.Source("slowlog_threshold_us"); got != SourceFile {
+		t.Errorf("source = %q", got)
+	}
+
+	if err := os.WriteFile(path, []byte("{\n  \"port\": 1000,\n  \"store\" \"x\"\n}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(nil, WithConfigPath(path)); err == nil || !strings.HasPrefix(err.Error(), path+":3: ") {
+		t.Errorf("syntax error = %v", err)
+	}
+
+	if _, err := LoadConfig(nil, WithConfigPath(filepath.Join(dir, "stash.yaml"))); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("yaml file: %v", err)
+	}
+}
+
+func TestRewriteJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stash.json")
+	if err := os.WriteFile(path, []byte(`{"slowlog": {"max_len": 64}, "port": 1000, "script_max_steps": 7}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(nil, WithConfigPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := NewRuntime(cfg)
+	for option, value := range map[string]string{
+		"slowlog_threshold_us": "250",
+		"script_max_steps":     "9",
+		"max_frame_size":       "1mb",
+	} {
+		if err := rt.Set(option, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rt.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "slowlog": {
+    "max_len": 64,
+    "threshold_us": 250
+  },
+  "port": 1000,
+  "script_max_steps": 9,
+  "max_frame_size": "1mb"
+}
+`
+	if string(data) != want {
+		t.Fatalf("rewritten file:\n%s\nwant:\n%s", data, want)
+	}
+	if reloaded, err := LoadConfig(nil, WithConfigPath(path)); err != nil || reloaded.MaxFrameSize != 1<<20 {
+		t.Fatalf("reloading the rewritten file: %v", err)
+	}
+}
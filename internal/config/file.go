@@ -1,18 +1,26 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 )
 
 type FileGetter struct {
-	data map[string]any
+	path  string
+	data  map[string]any
+	lines map[string]int
 }
 
 func NewFileGetter() *FileGetter {
 	return &FileGetter{
-		data: make(map[string]any),
+		data:  make(map[string]any),
+		lines: make(map[string]int),
 	}
 }
 
@@ -21,27 +29,34 @@ func (f *FileGetter) Get(key string) any {
 	return val
 }
 
-// Load reads a configuration file from the specified filePath, parses its contents,
-// and stores key-value pairs into the FileGetter's data map. The method resolves
-// the absolute path using the current working directory and the provided filePath.
-// It ignores empty lines and lines starting with '#' or '//' (treated as comments).
-// Each non-comment, non-empty line is expected to be in the format "key = value".
-// Lines not matching this format are skipped. If any error occurs while obtaining
-// the working directory or reading the file, the method panics.
-func (f *FileGetter) Load(filePath string) {
-	cwd, err := os.Getwd()
-	if err != nil {
-		panic(err)
+// Location returns the file and line key was read from, such as
+// "stash.conf:12".
+func (f *FileGetter) Location(key string) string {
+	line, ok := f.lines[key]
+	if !ok {
+		return ""
 	}
+	return f.path + ":" + strconv.Itoa(line)
+}
 
-	fullPath := filepath.Join(cwd, filePath)
-	file, err := os.ReadFile(fullPath)
-
+// Load reads the configuration file at filePath, relative to the working
+// directory unless it is absolute, and stores its options.
+//
+// Empty lines and lines starting with '#' or '//' are ignored. Every other
+// line must be in the format "key = value" and name a known option; the
+// lines that are not are reported together, each as a *FieldError holding
+// the line number. The options of valid lines are stored either way.
+func (f *FileGetter) Load(filePath string) error {
+	file, err := os.ReadFile(filePath)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	f.path = filePath
 
-	for line := range strings.SplitSeq(string(file), "\n") {
+	known := Options()
+	var errs []error
+	for i, line := range strings.Split(string(file), "\n") {
+		location := filePath + ":" + strconv.Itoa(i+1)
 		line = strings.TrimSpace(line)
 		if line == "" {
 			continue
@@ -51,13 +66,127 @@ func (f *FileGetter) Load(filePath string) {
 			continue
 		}
 
-		kv := strings.SplitN(line, "=", 2)
-		if len(kv) != 2 {
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			errs = append(errs, &FieldError{Location: location, Err: fmt.Errorf("expected key = value, got %q", line)})
+			continue
+		}
+		key = strings.TrimSpace(key)
+		val = strings.TrimSpace(val)
+		if !slices.Contains(known, key) {
+			errs = append(errs, &FieldError{Location: location, Option: key, Err: errors.New("unknown option")})
 			continue
 		}
-
-		key := strings.TrimSpace(kv[0])
-		val := strings.TrimSpace(kv[1])
 		f.data[key] = val
+		f.lines[key] = i + 1
+	}
+	return errors.Join(errs...)
+}
+
+// fileGetter is a Getter reading a configuration file.
+type fileGetter interface {
+	Getter
+	Locator
+	Load(filePath string) error
+}
+
+// newFileGetter returns the Getter for the configuration file at filePath,
+// chosen by its extension: .json files are read by a JSONGetter and other
+// files by a FileGetter.
+func newFileGetter(filePath string) (fileGetter, error) {
+	switch ext := strings.ToLower(filepath.Ext(filePath)); ext {
+	case ".json":
+		return NewJSONGetter(), nil
+	case ".toml", ".yaml", ".yml":
+		return nil, fmt.Errorf("%s: %s configuration files are not supported, use JSON or key = value lines", filePath, ext)
+	}
+	return NewFileGetter(), nil
+}
+
+// RewriteFile writes the options of cfg to the configuration file at
+// filePath, in its format. The value of every option already in the file is
+// replaced with its value in cfg, and options missing from the file are
+// added if they differ from their default. Comments, blank lines and the
+// order of lines are kept in key = value files; JSON files keep the order of
+// their members. The file is created if it does not exist, and replaced
+// atomically.
+func RewriteFile(filePath string, cfg *Config) error {
+	if _, err := newFileGetter(filePath); err != nil {
+		return err
+	}
+	mode := os.FileMode(0o644)
+	data, err := os.ReadFile(filePath)
+	if err == nil {
+		if info, err := os.Stat(filePath); err == nil {
+			mode = info.Mode().Perm()
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var out []byte
+	if strings.EqualFold(filepath.Ext(filePath), ".json") {
+		if out, err = rewriteJSON(data, cfg); err != nil {
+			return err
+		}
+	} else {
+		out = rewriteLines(data, cfg)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// rewriteLines returns the key = value configuration file data with the
+// options of cfg.
+func rewriteLines(data []byte, cfg *Config) []byte {
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	val := reflect.ValueOf(cfg).Elem()
+	def := reflect.ValueOf(Default()).Elem()
+	current := make(map[string]string)
+	var missing []string
+	for _, f := range fields() {
+		current[f.opt.key] = formatValue(val.FieldByIndex(f.index))
+		if current[f.opt.key] != formatValue(def.FieldByIndex(f.index)) {
+			missing = append(missing, f.opt.key)
+		}
+	}
+
+	written := make(map[string]bool)
+	for i, line := range lines {
+		key, _, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if trimmed := strings.TrimSpace(line); !ok || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "//") {
+			continue
+		}
+		if value, known := current[key]; known {
+			lines[i] = key + " = " + value
+			written[key] = true
+		}
+	}
+	for _, key := range missing {
+		if !written[key] {
+			lines = append(lines, key+" = "+current[key])
+		}
 	}
+	return []byte(strings.Join(lines, "\n") + "\n")
 }
@@ -0,0 +1,326 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// JSONGetter reads options from a JSON file. Objects are sections, named
+// like the sections of Config:
+//
+//	{"port": 19201, "slowlog": {"threshold_us": 500, "max_len": 64}}
+//
+// sets port, slowlog_threshold_us and slowlog_max_len. Options can also be
+// given by their full name at the top level. Lists are arrays of strings.
+type JSONGetter struct {
+	path  string
+	data  map[string]any
+	lines map[string]int
+}
+
+func NewJSONGetter() *JSONGetter {
+	return &JSONGetter{
+		data:  make(map[string]any),
+		lines: make(map[string]int),
+	}
+}
+
+func (j *JSONGetter) Get(key string) any {
+	return j.data[key]
+}
+
+// Location returns the file and line key was read from.
+func (j *JSONGetter) Location(key string) string {
+	line, ok := j.lines[key]
+	if !ok {
+		return ""
+	}
+	return j.path + ":" + strconv.Itoa(line)
+}
+
+// Load reads the JSON file at filePath and stores its options. Syntax errors
+// stop loading; unknown options and values that are neither scalars nor
+// arrays of scalars are reported together, each as a *FieldError holding the
+// line number.
+func (j *JSONGetter) Load(filePath string) error {
+	src, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	j.path = filePath
+
+	dec := json.NewDecoder(bytes.NewReader(src))
+	dec.UseNumber()
+	w := jsonWalker{j: j, src: src, dec: dec, known: Options()}
+	if err := w.expect('{'); err != nil {
+		return w.syntaxError(err)
+	}
+	if err := w.object(""); err != nil {
+		return w.syntaxError(err)
+	}
+	if _, err := dec.Token(); err == nil {
+		return &FieldError{Location: w.location(), Err: errors.New("unexpected data after the top-level object")}
+	}
+	return errors.Join(w.errs...)
+}
+
+// jsonWalker reads the tokens of a JSON configuration file.
+type jsonWalker struct {
+	j     *JSONGetter
+	src   []byte
+	dec   *json.Decoder
+	known []string
+	errs  []error
+}
+
+// line returns the line of the last token read.
+func (w *jsonWalker) line() int {
+	return bytes.Count(w.src[:w.dec.InputOffset()], []byte("\n")) + 1
+}
+
+func (w *jsonWalker) location() string {
+	return w.j.path + ":" + strconv.Itoa(w.line())
+}
+
+func (w *jsonWalker) syntaxError(err error) error {
+	var se *json.SyntaxError
+	if errors.As(err, &se) {
+		line := bytes.Count(w.src[:min(se.Offset, int64(len(w.src)))], []byte("\n")) + 1
+		return &FieldError{Location: w.j.path + ":" + strconv.Itoa(line), Err: err}
+	}
+	return &FieldError{Location: w.location(), Err: err}
+}
+
+func (w *jsonWalker) expect(delim json.Delim) error {
+	tok, err := w.dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %v, got %v", delim, tok)
+	}
+	return nil
+}
+
+// object reads the members of an object whose opening brace was read, up to
+// and including its closing brace. prefix is the name of the section.
+func (w *jsonWalker) object(prefix string) error {
+	for w.dec.More() {
+		tok, err := w.dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+		line := w.line()
+
+		tok, err = w.dec.Token()
+		if err != nil {
+			return err
+		}
+		var val string
+		switch tok := tok.(type) {
+		case json.Delim:
+			if tok == '{' {
+				if err := w.object(key); err != nil {
+					return err
+				}
+				continue
+			}
+			if val, err = w.array(key); err != nil {
+				return err
+			}
+		case string:
+			val = tok
+		case json.Number:
+			val = tok.String()
+		case bool:
+			val = strconv.FormatBool(tok)
+		case nil:
+			continue
+		}
+
+		location := w.j.path + ":" + strconv.Itoa(line)
+		if !slices.Contains(w.known, key) {
+			w.errs = append(w.errs, &FieldError{Location: location, Option: key, Err: errors.New("unknown option")})
+			continue
+		}
+		w.j.data[key] = val
+		w.j.lines[key] = line
+	}
+	return w.expect('}')
+}
+
+// array reads an array of scalars whose opening bracket was read and returns
+// its items separated by commas.
+func (w *jsonWalker) array(key string) (string, error) {
+	var items []string
+	for w.dec.More() {
+		tok, err := w.dec.Token()
+		if err != nil {
+			return "", err
+		}
+		switch tok := tok.(type) {
+		case json.Delim:
+			return "", &FieldError{Location: w.location(), Option: key, Err: errors.New("lists may only hold strings, numbers and booleans")}
+		case nil:
+		default:
+			items = append(items, fmt.Sprint(tok))
+		}
+	}
+	return strings.Join(items, ","), w.expect(']')
+}
+
+// jsonObject is a JSON object that keeps the order of its members.
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	key string
+	// value is a *jsonObject for objects and a json.RawMessage otherwise.
+	value any
+}
+
+func (o *jsonObject) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		member := jsonMember{key: tok.(string), value: raw}
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+			var sub jsonObject
+			if err := json.Unmarshal(raw, &sub); err != nil {
+				return err
+			}
+			member.value = &sub
+		}
+		*o = append(*o, member)
+	}
+	return nil
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(m.key)
+		b.Write(key)
+		b.WriteByte(':')
+		val, err := json.Marshal(m.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(val)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// lookup returns the member named key, or nil.
+func (o *jsonObject) lookup(key string) *jsonMember {
+	for i := range *o {
+		if (*o)[i].key == key {
+			return &(*o)[i]
+		}
+	}
+	return nil
+}
+
+// set replaces the value at path, returning false if it does not exist.
+func (o *jsonObject) set(path []string, value json.RawMessage) bool {
+	m := o.lookup(path[0])
+	if m == nil {
+		return false
+	}
+	if len(path) == 1 {
+		m.value = value
+		return true
+	}
+	sub, ok := m.value.(*jsonObject)
+	return ok && sub.set(path[1:], value)
+}
+
+// add appends the value at path, creating the sections on the way.
+func (o *jsonObject) add(path []string, value json.RawMessage) {
+	if len(path) == 1 {
+		*o = append(*o, jsonMember{key: path[0], value: value})
+		return
+	}
+	m := o.lookup(path[0])
+	if m == nil {
+		*o = append(*o, jsonMember{key: path[0], value: &jsonObject{}})
+		m = &(*o)[len(*o)-1]
+	}
+	if sub, ok := m.value.(*jsonObject); ok {
+		sub.add(path[1:], value)
+	}
+}
+
+// rewriteJSON returns the JSON configuration file data with the options of
+// cfg, keeping the order of its members. Options are written as numbers
+// and booleans where their type allows, and as strings otherwise.
+func rewriteJSON(data []byte, cfg *Config) ([]byte, error) {
+	var root jsonObject
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &root); err != nil {
+			return nil, err
+		}
+	}
+
+	val := reflect.ValueOf(cfg).Elem()
+	def := reflect.ValueOf(Default()).Elem()
+	for _, f := range fields() {
+		v := val.FieldByIndex(f.index)
+		raw, err := json.Marshal(jsonValue(v))
+		if err != nil {
+			return nil, err
+		}
+		// Full names at the top level and nested names are both updated.
+		found := root.set([]string{f.opt.key}, raw)
+		if len(f.path) > 1 && root.set(f.path, raw) {
+			found = true
+		}
+		if !found && formatValue(v) != formatValue(def.FieldByIndex(f.index)) {
+			root.add(f.path, raw)
+		}
+	}
+
+	out, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// jsonValue returns the value of an option field as it is written to JSON.
+func jsonValue(f reflect.Value) any {
+	switch {
+	case f.Type() == byteSizeType, f.Type() == durationType:
+		return formatValue(f)
+	case f.Kind() == reflect.Int, f.Kind() == reflect.Bool:
+		return f.Interface()
+	case f.Kind() == reflect.Slice:
+		return f.Convert(reflect.TypeFor[[]string]()).Interface()
+	}
+	return formatValue(f)
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// Sources of configuration values, in increasing order of precedence.
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceCLI     = "cli"
+)
+
+// EnvPrefix is prepended to the upper-cased option name to form the name of
+// its environment variable, e.g. GOSTASH_PORT for port.
+const EnvPrefix = "GOSTASH_"
+
+// SourceGetter is a Getter that can tell where a value came from.
+type SourceGetter interface {
+	Getter
+	// Source returns the source of key's value, or "" if it has none.
+	Source(key string) string
+}
+
+// Layer is a Getter together with the name of the source it reads.
+type Layer struct {
+	Source string
+	Getter Getter
+}
+
+// LayeredGetter merges several Getters. A value in a later layer takes
+// precedence over values in earlier layers.
+type LayeredGetter struct {
+	layers []Layer
+}
+
+func NewLayeredGetter(layers ...Layer) *LayeredGetter {
+	return &LayeredGetter{layers: layers}
+}
+
+func (l *LayeredGetter) Get(key string) any {
+	if layer := l.layer(key); layer != nil {
+		return layer.Getter.Get(key)
+	}
+	return nil
+}
+
+func (l *LayeredGetter) Source(key string) string {
+	if layer := l.layer(key); layer != nil {
+		return layer.Source
+	}
+	return ""
+}
+
+// Location returns where the value of key was read from, if the layer
+// holding it is a Locator.
+func (l *LayeredGetter) Location(key string) string {
+	if layer := l.layer(key); layer != nil {
+		if loc, ok := layer.Getter.(Locator); ok {
+			return loc.Location(key)
+		}
+	}
+	return ""
+}
+
+// layer returns the layer of highest precedence that has a value for key.
+func (l *LayeredGetter) layer(key string) *Layer {
+	for i := len(l.layers) - 1; i >= 0; i-- {
+		if val := l.layers[i].Getter.Get(key); val != nil && val != "" {
+			return &l.layers[i]
+		}
+	}
+	return nil
+}
+
+// EnvGetter reads options from GOSTASH_* environment variables.
+type EnvGetter struct {
+	lookup func(string) (string, bool)
+}
+
+func NewEnvGetter() *EnvGetter {
+	return &EnvGetter{lookup: os.LookupEnv}
+}
+
+func (e *EnvGetter) Get(key string) any {
+	if val, ok := e.lookup(EnvPrefix + strings.ToUpper(key)); ok {
+		return val
+	}
+	return nil
+}
+
+// Location returns the name of key's environment variable.
+func (e *EnvGetter) Location(key string) string {
+	return EnvPrefix + strings.ToUpper(key)
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// UnixPrefix starts the listeners that are Unix domain sockets.
+const UnixPrefix = "unix:"
+
+// Endpoint is an address the server listens on.
+type Endpoint struct {
+	// Network is "tcp" or "unix".
+	Network string
+	Address string
+	// Mode is the permission bits set on a Unix socket, or zero to keep
+	// those it was created with.
+	Mode os.FileMode
+}
+
+func (e Endpoint) String() string {
+	if e.Network == "unix" {
+		s := UnixPrefix + e.Address
+		if e.Mode != 0 {
+			s += "?mode=" + strconv.FormatUint(uint64(e.Mode), 8)
+		}
+		return s
+	}
+	return e.Address
+}
+
+// ParseEndpoint parses an item of the listeners option: a TCP address
+// host:port, or unix:<path> optionally followed by ?mode=<octal bits>,
+// e.g. unix:/run/gostash.sock?mode=660.
+func ParseEndpoint(s string) (Endpoint, error) {
+	path, ok := strings.CutPrefix(s, UnixPrefix)
+	if !ok {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			return Endpoint{}, fmt.Errorf("invalid listener %q: %w", s, err)
+		}
+		return Endpoint{Network: "tcp", Address: s}, nil
+	}
+
+	e := Endpoint{Network: "unix"}
+	if p, mode, ok := strings.Cut(path, "?mode="); ok {
+		bits, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || bits > 0o777 {
+			return Endpoint{}, fmt.Errorf("invalid mode %q of listener %q", mode, s)
+		}
+		path, e.Mode = p, os.FileMode(bits)
+	}
+	if path == "" {
+		return Endpoint{}, fmt.Errorf("invalid listener %q: missing socket path", s)
+	}
+	e.Address = path
+	return e, nil
+}
+
+// Endpoints returns the addresses to listen on: those of Listeners, or
+// Host and Port if it is empty.
+func (c *Config) Endpoints() ([]Endpoint, error) {
+	if len(c.Listeners) == 0 {
+		return []Endpoint{{Network: "tcp", Address: net.JoinHostPort(c.Host, strconv.Itoa(c.Port))}}, nil
+	}
+	endpoints := make([]Endpoint, 0, len(c.Listeners))
+	var errs []error
+	for _, s := range c.Listeners {
+		e, err := ParseEndpoint(s)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, errors.Join(errs...)
+}
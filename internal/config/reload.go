@@ -0,0 +1,146 @@
+package config
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// reloadInterval is how often Watch checks the configuration file for
+// changes.
+const reloadInterval = time.Second
+
+// ReloadResult lists the options whose value changed in a reload.
+type ReloadResult struct {
+	// Applied are the mutable options, which now have their new value.
+	Applied []string
+	// Restart are the options that keep their old value until the server
+	// is restarted.
+	Restart []string
+}
+
+// Reloader loads the configuration again, the same way LoadConfig did at
+// startup, and applies the changes of mutable options to a Runtime.
+type Reloader struct {
+	rt       *Runtime
+	cli      *CLIGetter
+	interval time.Duration
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader returns a Reloader for the configuration file of rt. cli is
+// the CLIGetter given to LoadConfig, so flags keep taking precedence over
+// the file; it may be nil.
+func NewReloader(rt *Runtime, cli *CLIGetter) *Reloader {
+	r := &Reloader{rt: rt, cli: cli, interval: reloadInterval}
+	r.modTime, r.size = r.stat()
+	return r
+}
+
+// Reload reads the configuration file and applies the changed mutable
+// options. If the new configuration is invalid, or a hook rejects a change,
+// nothing is applied and the error is returned.
+func (r *Reloader) Reload() (*ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.modTime, r.size = r.stat()
+
+	path := r.rt.Config().ConfigPath
+	if path == "" {
+		return nil, ErrNoConfigFile
+	}
+	next, err := LoadConfig(r.cli, WithConfigPath(path))
+	if err != nil {
+		return nil, err
+	}
+	return r.rt.apply(next)
+}
+
+// Watch reloads the configuration whenever a value is received on signals,
+// such as SIGHUP, and when the configuration file changes, until ctx is
+// done. signals may be nil. Results and errors are logged; the running
+// configuration is kept when the new one is invalid.
+func (r *Reloader) Watch(ctx context.Context, signals <-chan os.Signal) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			r.logReload("signal", sig.String())
+		case <-ticker.C:
+			if r.changed() {
+				r.logReload("file", r.rt.Config().ConfigPath)
+			}
+		}
+	}
+}
+
+func (r *Reloader) logReload(trigger, detail string) {
+	res, err := r.Reload()
+	if err != nil {
+		slog.Error("configuration not reloaded", "trigger", trigger, "detail", detail, "error", err)
+		return
+	}
+	slog.Info("configuration reloaded", "trigger", trigger, "detail", detail, "applied", res.Applied, "restart_required", res.Restart)
+}
+
+// changed reports whether the configuration file was modified since it was
+// last read.
+func (r *Reloader) changed() bool {
+	modTime, size := r.stat()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !modTime.Equal(r.modTime) || size != r.size
+}
+
+func (r *Reloader) stat() (time.Time, int64) {
+	path := r.rt.Config().ConfigPath
+	if path == "" {
+		return time.Time{}, 0
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, -1
+	}
+	return info.ModTime(), info.Size()
+}
+
+// apply makes the mutable options of next current and reports the options
+// whose value differs from the current configuration.
+func (r *Runtime) apply(next *Config) (*ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := &ReloadResult{}
+	updated := r.clone()
+	cur := reflect.ValueOf(updated).Elem()
+	val := reflect.ValueOf(next).Elem()
+	for _, f := range fields() {
+		if formatValue(cur.FieldByIndex(f.index)) == formatValue(val.FieldByIndex(f.index)) {
+			continue
+		}
+		if !f.opt.mutable {
+			res.Restart = append(res.Restart, f.opt.key)
+			continue
+		}
+		cur.FieldByIndex(f.index).Set(val.FieldByIndex(f.index))
+		if source := next.Source(f.opt.key); source == SourceDefault {
+			delete(updated.sources, f.opt.key)
+		} else {
+			updated.sources[f.opt.key] = source
+		}
+		res.Applied = append(res.Applied, f.opt.key)
+	}
+	if err := r.commit(updated, res.Applied); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
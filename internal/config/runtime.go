@@ -0,0 +1,159 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// SourceRuntime is the source of options changed while the server runs.
+const SourceRuntime = "runtime"
+
+var (
+	ErrUnknownOption = errors.New("unknown option")
+	ErrImmutable     = errors.New("option can not be changed at runtime")
+	ErrNoConfigFile  = errors.New("no configuration file")
+)
+
+// Hook is called with the new configuration when an option it was
+// registered for changes. Returning an error rejects the change.
+type Hook func(cfg *Config) error
+
+// Value is an option and its current value, formatted the way it is parsed.
+type Value struct {
+	Option string
+	Value  string
+}
+
+// Runtime holds the configuration of a running server and lets options
+// tagged mutable be changed. Every change produces a new Config, so a
+// Config returned by Config is never modified and may be read without
+// locking. It is safe for concurrent use.
+type Runtime struct {
+	cfg atomic.Pointer[Config]
+
+	mu    sync.Mutex
+	hooks map[string][]Hook
+}
+
+// NewRuntime returns a Runtime starting with cfg. cfg must not be modified
+// afterwards.
+func NewRuntime(cfg *Config) *Runtime {
+	r := &Runtime{hooks: make(map[string][]Hook)}
+	r.cfg.Store(cfg)
+	return r
+}
+
+// Config returns the current configuration. It must not be modified.
+func (r *Runtime) Config() *Config {
+	return r.cfg.Load()
+}
+
+// OnChange registers hook to run whenever option changes. Hooks run in the
+// order they were registered, while changes are serialized, so they must
+// not change the configuration themselves.
+func (r *Runtime) OnChange(option string, hook Hook) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks[option] = append(r.hooks[option], hook)
+}
+
+// Get returns the options matching the glob pattern, such as "slowlog_*",
+// with their current values, in the order of the fields of Config.
+func (r *Runtime) Get(pattern string) ([]Value, error) {
+	cfg := reflect.ValueOf(r.Config()).Elem()
+	var values []Value
+	for _, f := range fields() {
+		ok, err := path.Match(pattern, f.opt.key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			values = append(values, Value{Option: f.opt.key, Value: formatValue(cfg.FieldByIndex(f.index))})
+		}
+	}
+	return values, nil
+}
+
+// Set parses value, checks it against the constraints of the option and
+// applies it. Only options tagged mutable can be set.
+func (r *Runtime) Set(option, value string) error {
+	f, ok := lookupField(option)
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownOption, option)
+	}
+	if !f.opt.mutable {
+		return &FieldError{Option: option, Err: ErrImmutable}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next := r.clone()
+	if err := f.opt.set(reflect.ValueOf(next).Elem().FieldByIndex(f.index), value); err != nil {
+		return &FieldError{Option: option, Err: err}
+	}
+	next.sources[option] = SourceRuntime
+	return r.commit(next, []string{option})
+}
+
+// Rewrite writes the current configuration to the file it was loaded from,
+// see RewriteFile.
+func (r *Runtime) Rewrite() error {
+	cfg := r.Config()
+	if cfg.ConfigPath == "" {
+		return ErrNoConfigFile
+	}
+	return RewriteFile(cfg.ConfigPath, cfg)
+}
+
+// clone returns a copy of the current configuration that can be modified.
+// r.mu must be held.
+func (r *Runtime) clone() *Config {
+	next := *r.Config()
+	next.sources = maps.Clone(next.sources)
+	if next.sources == nil {
+		next.sources = make(map[string]string)
+	}
+	return &next
+}
+
+// commit runs the hooks of the changed options and makes next current. If
+// a hook fails, the hooks that already ran are called again with the
+// current configuration to undo the change. r.mu must be held.
+func (r *Runtime) commit(next *Config, changed []string) error {
+	current := r.Config()
+	var ran []Hook
+	for _, option := range changed {
+		for _, hook := range r.hooks[option] {
+			if err := hook(next); err != nil {
+				for _, undo := range ran {
+					undo(current)
+				}
+				return &FieldError{Option: option, Err: err}
+			}
+			ran = append(ran, hook)
+		}
+	}
+	r.cfg.Store(next)
+	return nil
+}
+
+// fields returns the options of Config. Their tags are known to be valid,
+// since tests load the defaults.
+func fields() []field {
+	return fieldsOf(reflect.TypeFor[Config]())
+}
+
+func lookupField(option string) (field, bool) {
+	for _, f := range fields() {
+		if f.opt.key == option {
+			return f, true
+		}
+	}
+	return field{}, false
+}
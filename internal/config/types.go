@@ -0,0 +1,226 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ByteSize is an option holding a number of bytes. It is written as an
+// integer with an optional unit: b, k or kb, m or mb, g or gb, each 1024
+// times the previous one, e.g. 64mb.
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	// Longer suffixes first, so "mb" is not taken for "b".
+	{"kb", 1 << 10},
+	{"mb", 1 << 20},
+	{"gb", 1 << 30},
+	{"k", 1 << 10},
+	{"m", 1 << 20},
+	{"g", 1 << 30},
+	{"b", 1},
+}
+
+// ParseByteSize parses a size such as 512, 16kb or 1G.
+func ParseByteSize(s string) (ByteSize, error) {
+	num := strings.ToLower(strings.TrimSpace(s))
+	unit := ByteSize(1)
+	for _, u := range byteUnits {
+		if before, ok := strings.CutSuffix(num, u.suffix); ok {
+			num, unit = strings.TrimSpace(before), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > 0 && ByteSize(n) > (1<<63-1)/unit || n < 0 && ByteSize(n) < (-1<<63)/unit {
+		return 0, fmt.Errorf("size %q out of range", s)
+	}
+	return ByteSize(n) * unit, nil
+}
+
+// String formats b with the largest unit that divides it.
+func (b ByteSize) String() string {
+	for _, u := range []struct {
+		suffix string
+		size   ByteSize
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}} {
+		if b != 0 && b%u.size == 0 {
+			return strconv.FormatInt(int64(b/u.size), 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+var (
+	byteSizeType = reflect.TypeFor[ByteSize]()
+	durationType = reflect.TypeFor[time.Duration]()
+)
+
+// option is a parsed "cfg" tag.
+type option struct {
+	key      string
+	required bool
+	mutable  bool
+	def      *string
+	min, max *string
+	enum     []string
+}
+
+func parseTag(tag string) (option, error) {
+	parts := strings.Split(tag, ",")
+	opt := option{key: parts[0]}
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(part, ":")
+		switch name {
+		case "required":
+			opt.required = true
+		case "mutable":
+			opt.mutable = true
+		case "default":
+			opt.def = &value
+		case "min":
+			opt.min = &value
+		case "max":
+			opt.max = &value
+		case "enum":
+			opt.enum = strings.Split(value, "|")
+		default:
+			return opt, fmt.Errorf("unknown tag modifier %q", part)
+		}
+	}
+	return opt, nil
+}
+
+// set parses s into f and checks it against the constraints of o.
+func (o *option) set(f reflect.Value, s string) error {
+	if f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String {
+		return o.setList(f, s)
+	}
+
+	n, err := parseValue(f.Type(), s)
+	if err != nil {
+		return err
+	}
+	switch f.Kind() {
+	case reflect.String:
+		if o.enum != nil && !slices.Contains(o.enum, s) {
+			return fmt.Errorf("%q is not one of %s", s, strings.Join(o.enum, ", "))
+		}
+	case reflect.Int, reflect.Int64:
+		if err := o.checkBounds(f.Type(), n.Int()); err != nil {
+			return err
+		}
+	}
+	f.Set(n)
+	return nil
+}
+
+// setList sets a string list from comma separated items. Items of defaults
+// may also be separated by "|", as commas end the tag modifier.
+func (o *option) setList(f reflect.Value, s string) error {
+	var items []string
+	for item := range strings.FieldsFuncSeq(s, func(r rune) bool { return r == ',' || r == '|' }) {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if o.enum != nil && !slices.Contains(o.enum, item) {
+			return fmt.Errorf("%q is not one of %s", item, strings.Join(o.enum, ", "))
+		}
+		items = append(items, item)
+	}
+	f.Set(reflect.ValueOf(items).Convert(f.Type()))
+	return nil
+}
+
+func (o *option) checkBounds(typ reflect.Type, n int64) error {
+	if o.min != nil {
+		min, err := parseValue(typ, *o.min)
+		if err != nil {
+			return fmt.Errorf("invalid min: %w", err)
+		}
+		if n < min.Int() {
+			return fmt.Errorf("%s is below the minimum of %s", format(typ, n), *o.min)
+		}
+	}
+	if o.max != nil {
+		max, err := parseValue(typ, *o.max)
+		if err != nil {
+			return fmt.Errorf("invalid max: %w", err)
+		}
+		if n > max.Int() {
+			return fmt.Errorf("%s is above the maximum of %s", format(typ, n), *o.max)
+		}
+	}
+	return nil
+}
+
+// parseValue parses s as a value of typ.
+func parseValue(typ reflect.Type, s string) (reflect.Value, error) {
+	v := reflect.New(typ).Elem()
+	switch {
+	case typ == byteSizeType:
+		size, err := ParseByteSize(s)
+		if err != nil {
+			return v, err
+		}
+		v.SetInt(int64(size))
+	case typ == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return v, fmt.Errorf("invalid duration %q", s)
+		}
+		v.SetInt(int64(d))
+	case typ.Kind() == reflect.String:
+		v.SetString(s)
+	case typ.Kind() == reflect.Int:
+		n, err := strconv.ParseInt(s, 10, strconv.IntSize)
+		if err != nil {
+			return v, fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetInt(n)
+	case typ.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return v, fmt.Errorf("invalid boolean %q", s)
+		}
+		v.SetBool(b)
+	default:
+		return v, errors.New("unsupported field type " + typ.String())
+	}
+	return v, nil
+}
+
+// formatValue formats the value of a field the way it is parsed.
+func formatValue(f reflect.Value) string {
+	switch {
+	case f.Type() == byteSizeType:
+		return ByteSize(f.Int()).String()
+	case f.Type() == durationType:
+		return time.Duration(f.Int()).String()
+	case f.Kind() == reflect.Slice:
+		return strings.Join(f.Convert(reflect.TypeFor[[]string]()).Interface().([]string), ", ")
+	}
+	return fmt.Sprint(f.Interface())
+}
+
+// format formats n as a value of typ for error messages.
+func format(typ reflect.Type, n int64) string {
+	switch typ {
+	case byteSizeType:
+		return ByteSize(n).String()
+	case durationType:
+		return time.Duration(n).String()
+	}
+	return strconv.FormatInt(n, 10)
+}
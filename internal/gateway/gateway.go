@@ -0,0 +1,514 @@
+// Package gateway serves the key-value commands over HTTP, for clients that
+// can not speak the binary protocol:
+//
+//	GET    /v1/keys/{key}        the value of key
+//	PUT    /v1/keys/{key}        set key to the request body
+//	DELETE /v1/keys/{key}        delete key
+//	POST   /v1/keys/{key}/incr   increment key and answer the new value
+//	POST   /v1/keys/{key}/decr   decrement key and answer the new value
+//	POST   /v1/batch/get         the values of several keys
+//	POST   /v1/batch/set         set several keys atomically
+//	POST   /v1/batch/delete      delete several keys
+//	GET    /v1/ws                a WebSocket connection, see WithWebSocket
+//
+// Values are sent and answered as JSON, or as the raw body with
+// application/octet-stream. Every request runs as its own client of a
+// handler.Handler, so authentication, ACL rules, metrics, the slow log and
+// MONITOR apply as they do to the binary protocol.
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/acl"
+	"github.com/k1ender/go-stash/internal/auth"
+	"github.com/k1ender/go-stash/internal/handler"
+	"github.com/k1ender/go-stash/internal/store"
+	"github.com/k1ender/go-stash/internal/websocket"
+)
+
+const (
+	contentTypeJSON   = "application/json"
+	contentTypeBinary = "application/octet-stream"
+
+	// credentialTTL is how long verified credentials are trusted, so that
+	// clients sending them with every request do not pay for hashing the
+	// password each time.
+	credentialTTL = 10 * time.Second
+	// maxCredentials bounds the number of credentials trusted at once.
+	maxCredentials = 1024
+)
+
+var (
+	errValueType = errors.New("values must be strings or numbers")
+	errNoKeys    = errors.New("expected at least one key")
+)
+
+// Gateway is an http.Handler running requests through a handler.Handler.
+type Gateway struct {
+	handler *handler.Handler
+	limits  func() handler.Limits
+	mux     *http.ServeMux
+
+	serveWebSocket   func(net.Conn)
+	webSocketOptions func() websocket.Options
+
+	credentials credentials
+}
+
+type Arg func(g *Gateway)
+
+// WithLimits makes every request run with the limits returned by limits.
+// MaxFrameSize also bounds the size of request bodies.
+func WithLimits(limits func() handler.Limits) Arg {
+	return func(g *Gateway) {
+		g.limits = limits
+	}
+}
+
+func New(h *handler.Handler, args ...Arg) *Gateway {
+	g := &Gateway{
+		handler: h,
+		limits:  func() handler.Limits { return handler.Limits{} },
+		mux:     http.NewServeMux(),
+	}
+	g.credentials.key = make([]byte, sha256.Size)
+	rand.Read(g.credentials.key)
+	for _, arg := range args {
+		arg(g)
+	}
+
+	g.mux.HandleFunc("GET /v1/keys/{key}", g.get)
+	g.mux.HandleFunc("PUT /v1/keys/{key}", g.set)
+	g.mux.HandleFunc("DELETE /v1/keys/{key}", g.del)
+	g.mux.HandleFunc("POST /v1/keys/{key}/incr", g.incr(handler.IncrCommand))
+	g.mux.HandleFunc("POST /v1/keys/{key}/decr", g.incr(handler.DecrCommand))
+	g.mux.HandleFunc("POST /v1/batch/get", g.batchGet)
+	g.mux.HandleFunc("POST /v1/batch/set", g.batchSet)
+	g.mux.HandleFunc("POST /v1/batch/delete", g.batchDel)
+	if g.serveWebSocket != nil {
+		g.mux.HandleFunc("GET /v1/ws", g.webSocket)
+	}
+	return g
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mux.ServeHTTP(w, r)
+}
+
+// conn returns the client r runs as, authenticated with the credentials of
+// HTTP basic authentication if r carries any. Credentials verified within
+// credentialTTL are trusted without running AUT again.
+func (g *Gateway) conn(r *http.Request) (*handler.Conn, error) {
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	args := []handler.ConnArg{handler.WithLimits(g.limits())}
+	user, password, ok := r.BasicAuth()
+	verified := ok && g.credentials.verified(user, password)
+	if verified {
+		args = append(args, handler.WithUser(user))
+	}
+
+	conn := handler.NewConn(&requestConn{local: local, remote: remoteAddr(r.RemoteAddr)}, args...)
+	if ok && !verified {
+		if _, err := g.handler.Do(conn, handler.SerializeArgs(handler.AuthCommand, user, password)); err != nil {
+			return conn, err
+		}
+		g.credentials.add(user, password)
+	}
+	return conn, nil
+}
+
+// credentials remembers recently verified credentials by their HMAC under a
+// random key, so that the passwords themselves are not kept.
+type credentials struct {
+	key     []byte
+	mu      sync.Mutex
+	expires map[[sha256.Size]byte]time.Time
+}
+
+func (c *credentials) sum(user, password string) (sum [sha256.Size]byte) {
+	mac := hmac.New(sha256.New, c.key)
+	// The length keeps user "a:b" with password "c" apart from user "a"
+	// with password "b:c".
+	mac.Write(strconv.AppendInt(nil, int64(len(user)), 10))
+	mac.Write([]byte(":" + user + password))
+	mac.Sum(sum[:0])
+	return sum
+}
+
+func (c *credentials) verified(user, password string) bool {
+	sum := c.sum(user, password)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, ok := c.expires[sum]
+	return ok && time.Now().Before(expires)
+}
+
+func (c *credentials) add(user, password string) {
+	sum := c.sum(user, password)
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expires == nil {
+		c.expires = make(map[[sha256.Size]byte]time.Time)
+	}
+	if len(c.expires) >= maxCredentials {
+		for sum, expires := range c.expires {
+			if !now.Before(expires) {
+				delete(c.expires, sum)
+			}
+		}
+		if len(c.expires) >= maxCredentials {
+			return
+		}
+	}
+	c.expires[sum] = now.Add(credentialTTL)
+}
+
+// keyResponse is the JSON reply of the single key routes.
+type keyResponse struct {
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+}
+
+func (g *Gateway) get(w http.ResponseWriter, r *http.Request) {
+	conn, err := g.conn(r)
+	if err != nil {
+		g.fail(w, conn, err)
+		return
+	}
+	key := r.PathValue("key")
+	resp, err := g.handler.Do(conn, handler.SerializeArgs(handler.GetCommand, key))
+	if err != nil {
+		g.fail(w, conn, err)
+		return
+	}
+	value := resp.(*handler.GetResponse).Value
+
+	if acceptsBinary(r) {
+		w.Header().Set("Content-Type", contentTypeBinary)
+		io.WriteString(w, value)
+		return
+	}
+	writeJSON(w, http.StatusOK, keyResponse{Key: key, Value: value})
+}
+
+func (g *Gateway) set(w http.ResponseWriter, r *http.Request) {
+	conn, err := g.conn(r)
+	if err != nil {
+		g.fail(w, conn, err)
+		return
+	}
+	value, err := g.readValue(w, r)
+	if err != nil {
+		g.fail(w, conn, err)
+		return
+	}
+	if _, err := g.handler.Do(conn, handler.SerializeArgs(handler.SetCommand, r.PathValue("key"), value)); err != nil {
+		g.fail(w, conn, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) del(w http.ResponseWriter, r *http.Request) {
+	conn, err := g.conn(r)
+	if err != nil {
+		g.fail(w, conn, err)
+		return
+	}
+	if _, err := g.handler.Do(conn, handler.SerializeArgs(handler.DelCommand, r.PathValue("key"))); err != nil {
+		g.fail(w, conn, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// incr returns the route running INC or DEC.
+func (g *Gateway) incr(cmd handler.Command) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := g.conn(r)
+		if err != nil {
+			g.fail(w, conn, err)
+			return
+		}
+		key := r.PathValue("key")
+		resp, err := g.handler.Do(conn, handler.SerializeArgs(cmd, key))
+		if err != nil {
+			g.fail(w, conn, err)
+			return
+		}
+		var value int
+		switch resp := resp.(type) {
+		case *handler.IncrResponse:
+			value = resp.Value
+		case *handler.DecrResponse:
+			value = resp.Value
+		}
+
+		if acceptsBinary(r) {
+			w.Header().Set("Content-Type", contentTypeBinary)
+			io.WriteString(w, strconv.Itoa(value))
+			return
+		}
+		writeJSON(w, http.StatusOK, keyResponse{Key: key, Value: value})
+	}
+}
+
+// batchGet answers the values of keys, null for those that do not exist:
+//
+//	{"keys": ["a", "b"]}  ->  {"values": {"a": "1", "b": null}}
+func (g *Gateway) batchGet(w http.ResponseWriter, r *http.Request) {
+	conn, err := g.conn(r)
+	if err != nil {
+		g.fail(w, conn, err)
+		return
+	}
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := g.readJSON(w, r, &req); err != nil {
+		g.fail(w, conn, err)
+		return
+	}
+	if len(req.Keys) == 0 {
+		g.fail(w, conn, errNoKeys)
+		return
+	}
+
+	values := make(map[string]*string, len(req.Keys))
+	for _, key := range req.Keys {
+		resp, err := g.handler.Do(conn, handler.SerializeArgs(handler.GetCommand, key))
+		if errors.Is(err, store.ErrNotFound) {
+			values[key] = nil
+			continue
+		}
+		if err != nil {
+			g.fail(w, conn, err)
+			return
+		}
+		values[key] = &resp.(*handler.GetResponse).Value
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"values": values})
+}
+
+// batchSet sets several keys in a transaction, so other clients see either
+// none or all of them:
+//
+//	{"values": {"a": "1", "b": 2}}
+func (g *Gateway) batchSet(w http.ResponseWriter, r *http.Request) {
+	conn, err := g.conn(r)
+	if err != nil {
+		g.fail(w, conn, err)
+		return
+	}
+	var req struct {
+		Values map[string]any `json:"values"`
+	}
+	if err := g.readJSON(w, r, &req); err != nil {
+		g.fail(w, conn, err)
+		return
+	}
+	if len(req.Values) == 0 {
+		g.fail(w, conn, errNoKeys)
+		return
+	}
+
+	frames := make([][]byte, 0, len(req.Values)+2)
+	frames = append(frames, handler.SerializeArgs(handler.MultiCommand))
+	for key, v := range req.Values {
+		value, err := scalar(v)
+		if err != nil {
+			g.fail(w, conn, err)
+			return
+		}
+		frames = append(frames, handler.SerializeArgs(handler.SetCommand, key, value))
+	}
+	frames = append(frames, handler.SerializeArgs(handler.ExecCommand))
+
+	for _, frame := range frames {
+		if _, err := g.handler.Do(conn, frame); err != nil {
+			g.handler.Do(conn, handler.SerializeArgs(handler.DiscardCommand))
+			g.fail(w, conn, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// batchDel deletes keys and answers how many existed:
+//
+//	{"keys": ["a", "b"]}  ->  {"deleted": 1}
+func (g *Gateway) batchDel(w http.ResponseWriter, r *http.Request) {
+	conn, err := g.conn(r)
+	if err != nil {
+		g.fail(w, conn, err)
+		return
+	}
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := g.readJSON(w, r, &req); err != nil {
+		g.fail(w, conn, err)
+		return
+	}
+	if len(req.Keys) == 0 {
+		g.fail(w, conn, errNoKeys)
+		return
+	}
+
+	deleted := 0
+	for _, key := range req.Keys {
+		_, err := g.handler.Do(conn, handler.SerializeArgs(handler.DelCommand, key))
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			g.fail(w, conn, err)
+			return
+		}
+		deleted++
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"deleted": deleted})
+}
+
+// readValue returns the value sent in the body of r: {"value": ...} for
+// JSON, and the body itself for every other content type.
+func (g *Gateway) readValue(w http.ResponseWriter, r *http.Request) (string, error) {
+	if mediaType(r.Header.Get("Content-Type")) != contentTypeJSON {
+		body, err := io.ReadAll(g.body(w, r))
+		return string(body), err
+	}
+	var req struct {
+		Value any `json:"value"`
+	}
+	if err := g.readJSON(w, r, &req); err != nil {
+		return "", err
+	}
+	return scalar(req.Value)
+}
+
+func (g *Gateway) readJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(g.body(w, r))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return &requestError{err}
+	}
+	return nil
+}
+
+// body returns the body of r, limited to the maximum frame size.
+func (g *Gateway) body(w http.ResponseWriter, r *http.Request) io.Reader {
+	if max := g.limits().MaxFrameSize; max > 0 {
+		return http.MaxBytesReader(w, r.Body, int64(max))
+	}
+	return r.Body
+}
+
+// scalar returns a JSON string or number as the string stored for it.
+func scalar(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	}
+	return "", errValueType
+}
+
+// requestError is a body that could not be decoded.
+type requestError struct {
+	err error
+}
+
+func (e *requestError) Error() string { return "invalid request body: " + e.err.Error() }
+func (e *requestError) Unwrap() error { return e.err }
+
+// statusCode maps the error of a request to the status it is answered with.
+func statusCode(err error) int {
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, store.ErrNotInteger):
+		return http.StatusConflict
+	case errors.Is(err, errValueType):
+		return http.StatusUnprocessableEntity
+	case errors.As(err, &maxBytes):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, handler.ErrNoAuth), errors.Is(err, auth.ErrInvalidCredentials):
+		return http.StatusUnauthorized
+	case errors.Is(err, auth.ErrTooManyAttempts):
+		return http.StatusTooManyRequests
+	case errors.Is(err, acl.ErrCommandDenied), errors.Is(err, acl.ErrKeyDenied):
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// fail answers err as {"error": "<message>"}. Errors of the client are
+// only logged at debug level.
+func (g *Gateway) fail(w http.ResponseWriter, conn *handler.Conn, err error) {
+	code := statusCode(err)
+	if code < http.StatusInternalServerError {
+		conn.Logger().Debug("error handling HTTP request", "error", err)
+	} else {
+		conn.Logger().Error("error handling HTTP request", "error", err)
+	}
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gostash"`)
+	}
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// acceptsBinary reports whether r asks for the raw value rather than JSON.
+func acceptsBinary(r *http.Request) bool {
+	return mediaType(r.Header.Get("Accept")) == contentTypeBinary
+}
+
+func mediaType(header string) string {
+	typ, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+	return typ
+}
+
+// requestConn is the connection of the handler.Conn a request runs as.
+// Replies are returned by Handler.Do, so it is never read or written.
+type requestConn struct {
+	local, remote net.Addr
+}
+
+func (c *requestConn) Read([]byte) (int, error)         { return 0, io.EOF }
+func (c *requestConn) Write([]byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *requestConn) Close() error                     { return nil }
+func (c *requestConn) LocalAddr() net.Addr              { return c.local }
+func (c *requestConn) RemoteAddr() net.Addr             { return c.remote }
+func (c *requestConn) SetDeadline(time.Time) error      { return nil }
+func (c *requestConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *requestConn) SetWriteDeadline(time.Time) error { return nil }
+
+// remoteAddr is the address of an HTTP client, as found in
+// http.Request.RemoteAddr.
+type remoteAddr string
+
+func (a remoteAddr) Network() string { return "tcp" }
+func (a remoteAddr) String() string  { return string(a) }
@@ -0,0 +1,262 @@
+package gateway
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/auth"
+	"github.com/k1ender/go-stash/internal/handler"
+	"github.com/k1ender/go-stash/internal/store"
+	"github.com/k1ender/go-stash/internal/websocket"
+)
+
+// request sends a request to srv and returns the status and body of the
+// reply. Headers are given as alternating names and values.
+func request(t *testing.T, srv *httptest.Server, method, path, body string, headers ...string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, strings.TrimSpace(string(data))
+}
+
+func TestGateway(t *testing.T) {
+	h := handler.NewHandler(store.NewShardedStore(4))
+	srv := httptest.NewServer(New(h, WithLimits(func() handler.Limits {
+		return handler.Limits{MaxFrameSize: 64}
+	})))
+	defer srv.Close()
+
+	const json, binary = "application/json", "application/octet-stream"
+	for _, tc := range []struct {
+		method, path, body string
+		headers            []string
+		code               int
+		reply              string
+	}{
+		{"PUT", "/v1/keys/a", "raw\x00bytes", []string{"Content-Type", binary}, 204, ""},
+		{"GET", "/v1/keys/a", "", []string{"Accept", binary}, 200, "raw\x00bytes"},
+		{"PUT", "/v1/keys/a", `{"value": "hello"}`, []string{"Content-Type", json}, 204, ""},
+		{"GET", "/v1/keys/a", "", nil, 200, `{"key":"a","value":"hello"}`},
+		{"GET", "/v1/keys/missing", "", nil, 404, `{"error":"key not found"}`},
+		{"PUT", "/v1/keys/n", `{"value": 41}`, []string{"Content-Type", json}, 204, ""},
+		{"POST", "/v1/keys/n/incr", "", nil, 200, `{"key":"n","value":42}`},
+		{"POST", "/v1/keys/n/decr", "", []string{"Accept", binary}, 200, "41"},
+		{"POST", "/v1/keys/a/incr", "", nil, 409, `{"error":"value is not an integer"}`},
+		{"PUT", "/v1/keys/a", `{"value": {"nested": 1}}`, []string{"Content-Type", json}, 422, `{"error":"values must be strings or numbers"}`},
+		{"PUT", "/v1/keys/a", `{"value":`, []string{"Content-Type", json}, 400, `{"error":"invalid request body: unexpected EOF"}`},
+		{"PUT", "/v1/keys/a", strings.Repeat("x", 65), nil, 413, `{"error":"http: request body too large"}`},
+		{"DELETE", "/v1/keys/a", "", nil, 204, ""},
+		{"DELETE", "/v1/keys/a", "", nil, 404, `{"error":"key not found"}`},
+
+		{"POST", "/v1/batch/set", `{"values": {"x": "1", "y": 2}}`, nil, 204, ""},
+		{"POST", "/v1/batch/get", `{"keys": ["x", "y", "z"]}`, nil, 200, `{"values":{"x":"1","y":"2","z":null}}`},
+		{"POST", "/v1/batch/set", `{"values": {"x": "3", "y": true}}`, nil, 422, `{"error":"values must be strings or numbers"}`},
+		{"POST", "/v1/batch/get", `{"keys": ["x"]}`, nil, 200, `{"values":{"x":"1"}}`},
+		{"POST", "/v1/batch/delete", `{"keys": ["x", "y", "z"]}`, nil, 200, `{"deleted":2}`},
+		{"POST", "/v1/batch/delete", `{"keys": []}`, nil, 400, `{"error":"expected at least one key"}`},
+	} {
+		code, reply := request(t, srv, tc.method, tc.path, tc.body, tc.headers...)
+		if code != tc.code || reply != tc.reply {
+			t.Errorf("%s %s %q: got %d %q, want %d %q", tc.method, tc.path, tc.body, code, reply, tc.code, tc.reply)
+		}
+	}
+}
+
+func TestGatewayAuth(t *testing.T) {
+	hash, err := auth.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := auth.NewAuthenticator(map[string]string{"app": hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var auths atomic.Int32
+	countAuths := func(next handler.HandlerFunc) handler.HandlerFunc {
+		return func(req *handler.Request) (handler.Response, error) {
+			if req.Command == handler.AuthCommand {
+				auths.Add(1)
+			}
+			return next(req)
+		}
+	}
+	h := handler.NewHandler(store.NewShardedStore(4), handler.WithAuthenticator(a), handler.WithMiddleware(countAuths))
+	srv := httptest.NewServer(New(h))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/v1/keys/a", nil)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("without credentials: got %d, WWW-Authenticate %q", resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+	}
+
+	req.SetBasicAuth("app", "wrong")
+	if resp, err = srv.Client().Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Fatalf("wrong password: got %d", resp.StatusCode)
+	}
+
+	req.SetBasicAuth("app", "secret")
+	if resp, err = srv.Client().Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Fatalf("right password: got %d, want 404 for the missing key", resp.StatusCode)
+	}
+
+	// Verified credentials are trusted for a while, wrong ones never.
+	for _, password := range []string{"secret", "wrong"} {
+		req.SetBasicAuth("app", password)
+		if resp, err = srv.Client().Do(req); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if resp.StatusCode != 401 {
+		t.Fatalf("wrong password after a right one: got %d", resp.StatusCode)
+	}
+	if n := auths.Load(); n != 3 {
+		t.Fatalf("ran AUT %d times, want 3", n)
+	}
+}
+
+// wsClient is the client side of a WebSocket connection to the gateway.
+type wsClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, srv *httptest.Server) *wsClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, _ := http.NewRequest("GET", srv.URL+"/v1/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	c := &wsClient{conn: conn, r: bufio.NewReader(conn)}
+	resp, err := http.ReadResponse(c.r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade: got %d", resp.StatusCode)
+	}
+	return c
+}
+
+// send writes a message in a single masked frame with an all-zero mask.
+func (c *wsClient) send(t *testing.T, typ websocket.MessageType, msg string) {
+	t.Helper()
+	frame := []byte{0x80 | byte(typ), 0x80 | byte(len(msg)), 0, 0, 0, 0}
+	if _, err := c.conn.Write(append(frame, msg...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive reads a short message.
+func (c *wsClient) receive(t *testing.T) (websocket.MessageType, string) {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, head[1])
+	if _, err := io.ReadFull(c.r, msg); err != nil {
+		t.Fatal(err)
+	}
+	return websocket.MessageType(head[0] & 0x0f), string(msg)
+}
+
+func TestWebSocket(t *testing.T) {
+	h := handler.NewHandler(store.NewShardedStore(4))
+	serve := func(nc net.Conn) {
+		conn := handler.NewConn(nc)
+		go func() {
+			defer conn.Close()
+			for {
+				if closed, _ := h.Handle(conn); closed {
+					return
+				}
+			}
+		}()
+	}
+	srv := httptest.NewServer(New(h, WithWebSocket(serve, func() websocket.Options { return websocket.Options{} })))
+	defer srv.Close()
+
+	c := dialWebSocket(t, srv)
+	// Binary messages may hold several frames, and frames may span
+	// messages.
+	set := string(handler.SerializeArgs(handler.SetCommand, "k", "v"))
+	get := string(handler.SerializeArgs(handler.GetCommand, "k"))
+	c.send(t, websocket.BinaryMessage, set+get[:5])
+	c.send(t, websocket.BinaryMessage, get[5:])
+	for _, want := range []string{"OK\r\n", "v\r\n"} {
+		if typ, msg := c.receive(t); typ != websocket.BinaryMessage || msg != want {
+			t.Fatalf("got %d %q, want binary %q", typ, msg, want)
+		}
+	}
+
+	for _, tc := range []struct{ request, reply string }{
+		{`{"id": 1, "command": "get", "args": ["k"]}`, `{"id":1,"reply":"v"}`},
+		{`{"id": "a", "command": "GET", "args": ["missing"]}`, `{"id":"a","error":"ERR"}`},
+		{`{"command": "INF", "args": ["stats"]}`, `{"reply":["# Stats","total_commands_processed:5","pubsub_channels:0"]}`},
+		{`{"id": 2, "command": "GETX"}`, `{"id":2,"error":"invalid command envelope: the command must have 3 letters"}`},
+	} {
+		c.send(t, websocket.TextMessage, tc.request)
+		if typ, msg := c.receive(t); typ != websocket.TextMessage || msg != tc.reply {
+			t.Errorf("%s: got %d %s, want %s", tc.request, typ, msg, tc.reply)
+		}
+	}
+
+	sub := dialWebSocket(t, srv)
+	sub.send(t, websocket.TextMessage, `{"id": 1, "command": "SUB", "args": ["news"]}`)
+	if _, msg := sub.receive(t); msg != `{"id":1,"reply":"OK"}` {
+		t.Fatalf("SUB: got %s", msg)
+	}
+	c.send(t, websocket.TextMessage, `{"command": "PUB", "args": ["news", "hello"]}`)
+	if _, msg := c.receive(t); msg != `{"reply":"1"}` {
+		t.Fatalf("PUB: got %s", msg)
+	}
+	if _, msg := sub.receive(t); msg != `{"event":"message","channel":"news","message":"hello"}` {
+		t.Fatalf("message: got %s", msg)
+	}
+}
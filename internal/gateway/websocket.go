@@ -0,0 +1,282 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/constants"
+	"github.com/k1ender/go-stash/internal/handler"
+	"github.com/k1ender/go-stash/internal/websocket"
+)
+
+// GET /v1/ws upgrades to a WebSocket connection that runs like a client of
+// the binary protocol, with its own authentication, transaction, MONITOR
+// and SUBSCRIBE state. It accepts two kinds of messages:
+//
+// Binary messages carry frames of the binary protocol. A message may hold
+// several frames, and a frame may be split over several messages. Every
+// reply is sent as a binary message of its own.
+//
+// Text messages carry a JSON envelope holding a single command:
+//
+//	{"id": 1, "command": "SET", "args": ["key", "value"]}
+//
+// answered with the same id and the reply as a string, or as an array for
+// commands answering a list:
+//
+//	{"id": 1, "reply": "OK"}
+//	{"id": 2, "error": "ERR"}
+//
+// Like the binary protocol, failed commands are answered with ERR only.
+// After MON or SUB sent as JSON, pushed lines and messages arrive as events:
+//
+//	{"event": "monitor", "line": "1760871600.123456 [0 ...] \"GET\" \"key\""}
+//	{"event": "message", "channel": "news", "message": "hello"}
+
+var errEnvelope = errors.New("the command must have 3 letters")
+
+// listCommands answer a list, sent as a JSON array to text clients.
+var listCommands = map[handler.Command]bool{
+	handler.ExecCommand:    true,
+	handler.ACLCommand:     true,
+	handler.CommandCommand: true,
+	handler.InfoCommand:    true,
+	handler.SlowLogCommand: true,
+	handler.ClientCommand:  true,
+	handler.ConfigCommand:  true,
+}
+
+// WithWebSocket serves WebSocket connections on /v1/ws. serve is handed
+// every upgraded connection as a net.Conn carrying frames of the binary
+// protocol, to run it like any other client. options is called for every
+// connection.
+func WithWebSocket(serve func(net.Conn), options func() websocket.Options) Arg {
+	return func(g *Gateway) {
+		g.serveWebSocket = serve
+		g.webSocketOptions = options
+	}
+}
+
+func (g *Gateway) webSocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocket.Upgrade(w, r, g.webSocketOptions())
+	if err != nil {
+		return
+	}
+	g.serveWebSocket(&wsConn{ws: ws})
+}
+
+// envelope is a command sent in a text message.
+type envelope struct {
+	ID      json.RawMessage `json:"id,omitempty"`
+	Command string          `json:"command"`
+	Args    []string        `json:"args"`
+}
+
+// wsReply is the JSON answer to an envelope, or an event pushed to a text
+// client.
+type wsReply struct {
+	ID      json.RawMessage `json:"id,omitempty"`
+	Reply   any             `json:"reply,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Event   string          `json:"event,omitempty"`
+	Line    string          `json:"line,omitempty"`
+	Channel string          `json:"channel,omitempty"`
+	Message *string         `json:"message,omitempty"`
+}
+
+// pendingReply is a frame handed to the handler that has not been answered
+// yet, in the order they were read.
+type pendingReply struct {
+	json    bool
+	id      json.RawMessage
+	command handler.Command
+}
+
+// wsConn turns messages into the byte stream of the binary protocol and
+// wraps every write of the handler, which is a single reply or push, into a
+// message.
+type wsConn struct {
+	ws *websocket.Conn
+
+	// in holds the frames of the current message not read yet, scan the
+	// binary input not yet split into frames.
+	in, scan []byte
+
+	mu      sync.Mutex
+	pending []pendingReply
+	// jsonPush is whether pushes, written when no reply is pending, are
+	// sent as JSON events. It follows the last command answered, which is
+	// the MON or SUB that started them.
+	jsonPush bool
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.in) == 0 {
+		typ, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+
+		switch typ {
+		case websocket.BinaryMessage:
+			c.queueFrames(msg)
+			c.in = msg
+		case websocket.TextMessage:
+			var env envelope
+			if err := json.Unmarshal(msg, &env); err != nil || len(env.Command) != constants.CommandKeyLen {
+				if err == nil {
+					err = errEnvelope
+				}
+				c.writeJSON(wsReply{ID: env.ID, Error: "invalid command envelope: " + err.Error()})
+				continue
+			}
+			cmd := handler.Command([]byte(strings.ToUpper(env.Command)))
+			c.mu.Lock()
+			c.pending = append(c.pending, pendingReply{json: true, id: env.ID, command: cmd})
+			c.mu.Unlock()
+			c.in = handler.SerializeArgs(cmd, env.Args...)
+		}
+	}
+
+	n := copy(p, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+// queueFrames records a pending binary reply for every frame completed by
+// msg. Malformed input is left for the handler to reject.
+func (c *wsConn) queueFrames(msg []byte) {
+	c.scan = append(c.scan, msg...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		n, err := handler.ScanFrame(c.scan, 0)
+		if n == 0 || err != nil {
+			return
+		}
+		c.pending = append(c.pending, pendingReply{command: handler.Command(c.scan[:constants.CommandKeyLen])})
+		c.scan = c.scan[n:]
+	}
+}
+
+// Write sends p, a reply or a push, as one message.
+func (c *wsConn) Write(p []byte) (int, error) {
+	// Commands writing their reply themselves write nothing.
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	c.mu.Lock()
+	reply, isReply := pendingReply{json: c.jsonPush}, len(c.pending) > 0
+	if isReply {
+		reply = c.pending[0]
+		c.pending = c.pending[1:]
+		c.jsonPush = reply.json
+	}
+	c.mu.Unlock()
+
+	var err error
+	switch {
+	case !reply.json:
+		err = c.ws.WriteMessage(websocket.BinaryMessage, p)
+	case isReply:
+		err = c.writeJSON(jsonReply(reply, p))
+	default:
+		err = c.writeEvents(p)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// jsonReply converts the reply p of the binary protocol to JSON.
+func jsonReply(reply pendingReply, p []byte) wsReply {
+	if bytes.Equal(p, handler.ErrResponse) {
+		return wsReply{ID: reply.id, Error: string(handler.ErrResponse)}
+	}
+	if listCommands[reply.command] {
+		if lines, ok := parseList(p); ok {
+			return wsReply{ID: reply.id, Reply: lines}
+		}
+	}
+	return wsReply{ID: reply.id, Reply: strings.TrimSuffix(string(p), "\r\n")}
+}
+
+// parseList splits a reply holding a count line followed by that many
+// lines.
+func parseList(p []byte) ([]string, bool) {
+	lines := strings.Split(strings.TrimSuffix(string(p), "\r\n"), "\r\n")
+	n, err := strconv.Atoi(lines[0])
+	if err != nil {
+		return nil, false
+	}
+	lines = lines[1:]
+	if n == 0 && len(lines) == 0 {
+		return []string{}, true
+	}
+	if len(lines) != n {
+		return nil, false
+	}
+	return lines, true
+}
+
+// writeEvents sends a push as JSON events: the frames of MSG, or the lines
+// of a monitor.
+func (c *wsConn) writeEvents(p []byte) error {
+	if bytes.HasPrefix(p, handler.MessageCommand[:]) {
+		for len(p) > 0 {
+			n, err := handler.ScanFrame(p, 0)
+			if n == 0 || err != nil {
+				return nil
+			}
+			args, err := handler.DeserializeArgs(p[:n])
+			if err == nil && len(args) == 2 {
+				if err := c.writeJSON(wsReply{Event: "message", Channel: args[0], Message: &args[1]}); err != nil {
+					return err
+				}
+			}
+			p = p[n:]
+		}
+		return nil
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\r\n"), "\r\n") {
+		if err := c.writeJSON(wsReply{Event: "monitor", Line: line}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *wsConn) writeJSON(v wsReply) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *wsConn) Close() error         { return c.ws.Close() }
+func (c *wsConn) LocalAddr() net.Addr  { return c.ws.NetConn().LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr { return c.ws.NetConn().RemoteAddr() }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	c.ws.SetReadDeadline(t)
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
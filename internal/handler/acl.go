@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/k1ender/go-stash/internal/acl"
+	"github.com/k1ender/go-stash/internal/auth"
+)
+
+// Access control
+//
+//	ACL\0<len>\0LIST\r\n
+//	ACL\0<len>\0SETUSER\0<len>\0<user>(\0<len>\0<rule>)*\r\n
+//
+// Every command except AUT and PIN is checked against the rules of the
+// connection's user before it runs, including commands queued in a
+// transaction. Connections that have not authenticated, because no users are
+// configured, are checked as the default user. See package acl for the
+// rules. LIST answers with the number of users on its own line followed by
+// one line per user.
+
+var (
+	errACLSubcmd = errors.New("unknown ACL subcommand")
+	errACLArgs   = errors.New("wrong number of arguments for ACL")
+)
+
+// WithACL restricts users to the commands and keys allowed by list.
+func WithACL(list *acl.List) Arg {
+	return func(h *Handler) {
+		h.acl = list
+	}
+}
+
+// enforceACL checks that the user of the connection may run the command and
+// access its keys. A denied command inside a transaction fails the
+// transaction.
+func (h *Handler) enforceACL(next HandlerFunc) HandlerFunc {
+	return func(req *Request) (Response, error) {
+		if err := h.authorize(req); err != nil {
+			if req.Conn.tx != nil {
+				req.Conn.tx.failed = true
+			}
+			return nil, err
+		}
+		return next(req)
+	}
+}
+
+func (h *Handler) authorize(req *Request) error {
+	if req.spec != nil && req.spec.Flags&FlagNoAuth != 0 {
+		return nil
+	}
+
+	user := req.Conn.User()
+	if user == "" {
+		user = auth.DefaultUser
+	}
+	rules, ok := h.acl.Lookup(user)
+	if !ok {
+		return nil
+	}
+
+	keys, err := req.keys()
+	if err == nil {
+		err = rules.Check(req.Command.String(), keys)
+	}
+	if err != nil {
+		req.Conn.Logger().Warn("command denied by ACL",
+			"user", user,
+			"command", req.Command.String(),
+			"error", err)
+		return err
+	}
+	return nil
+}
+
+func (h *Handler) aclCommand(req *Request) (Response, error) {
+	args, err := DeserializeArgs(req.Frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errACLArgs
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "LIST":
+		if len(args) != 1 {
+			return nil, errACLArgs
+		}
+		return &ListResponse{Lines: h.acl.Describe()}, nil
+	case "SETUSER":
+		if len(args) < 2 {
+			return nil, errACLArgs
+		}
+		if err := h.acl.SetUser(args[1], args[2:]); err != nil {
+			return nil, err
+		}
+		req.Conn.Logger().Info("ACL rules changed", "user", args[1], "rules", strings.Join(args[2:], " "))
+		return &StatusResponse{Value: "OK"}, nil
+	}
+
+	return nil, errACLSubcmd
+}
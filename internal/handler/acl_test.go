@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/k1ender/go-stash/internal/acl"
+)
+
+func TestACL(t *testing.T) {
+	list, err := acl.Parse("default +GET +SET +MUL +EXE ~metrics:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, stop := startTestServer(t, WithACL(list))
+	defer stop()
+
+	c := dialTestServer(t, addr)
+
+	if got := c.do(SetCommand, "metrics:cpu", "42"); got != "OK" {
+		t.Fatalf("SET metrics:cpu = %q", got)
+	}
+	if got := c.do(GetCommand, "metrics:cpu"); got != "42" {
+		t.Fatalf("GET metrics:cpu = %q", got)
+	}
+	c.fail(GetCommand, "users:1")
+	c.fail(DelCommand, "metrics:cpu")
+	c.fail(ACLCommand, "LIST")
+
+	// A denied command inside a transaction fails the transaction.
+	if got := c.do(MultiCommand); got != "OK" {
+		t.Fatalf("MUL = %q", got)
+	}
+	c.fail(SetCommand, "users:1", "x")
+	c.fail(ExecCommand)
+
+	if err := list.SetUser("default", []string{"+ACL"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.do(ACLCommand, "SETUSER", "default", "+DEL"); got != "OK" {
+		t.Fatalf("ACL SETUSER = %q", got)
+	}
+	if got := c.do(DelCommand, "metrics:cpu"); got != "OK" {
+		t.Fatalf("DEL after SETUSER = %q", got)
+	}
+	if got := c.do(ACLCommand, "LIST"); got != "1" {
+		t.Fatalf("ACL LIST = %q", got)
+	}
+	if got := c.line(); got != "user default -@all +ACL +DEL +EXE +GET +MUL +SET ~metrics:*" {
+		t.Fatalf("ACL LIST line = %q", got)
+	}
+}
+
+func TestACLChannels(t *testing.T) {
+	list, err := acl.Parse("default +PUB +SUB ~user:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, stop := startTestServer(t, WithACL(list))
+	defer stop()
+
+	c := dialTestServer(t, addr)
+	// Keyspace channels are checked as the key they report on, other
+	// channels as their name.
+	c.fail(SubscribeCommand, KeyspacePrefix+"*")
+	c.fail(SubscribeCommand, KeyspacePrefix+"user:1", KeyspacePrefix+"session:1")
+	c.fail(PublishCommand, "news", "hello")
+	c.fail(PublishCommand, KeyspacePrefix+"session:1", "del")
+	if got := c.do(PublishCommand, "user:1:inbox", "hello"); got != "0" {
+		t.Fatalf("PUB user:1:inbox = %q", got)
+	}
+	if got := c.do(SubscribeCommand, KeyspacePrefix+"user:1", "user:1:inbox"); got != "OK" {
+		t.Fatalf("SUB = %q", got)
+	}
+}
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+
+	"github.com/k1ender/go-stash/internal/constants"
+)
+
+// DeserializeArgs splits a frame into its arguments, for commands that take a
+// variable number of them.
+//
+//	<command>(\0<len>\0<data>)*\r\n
+func DeserializeArgs(data []byte) ([]string, error) {
+	var args []string
+
+	i := constants.CommandKeyLen
+	for i < len(data) && data[i] == 0 {
+		end := bytes.IndexByte(data[i+1:], 0)
+		if end == -1 {
+			return nil, errors.New("invalid format: missing length delimiter")
+		}
+		end += i + 1
+
+		n, err := strconv.Atoi(string(data[i+1 : end]))
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || end+1+n > len(data) {
+			return nil, errors.New("argument length mismatch")
+		}
+
+		args = append(args, string(data[end+1:end+1+n]))
+		i = end + 1 + n
+	}
+
+	return args, nil
+}
+
+// SerializeArgs is the inverse of DeserializeArgs.
+func SerializeArgs(command Command, args ...string) []byte {
+	var buf bytes.Buffer
+	buf.Write(command[:])
+	for _, arg := range args {
+		buf.WriteByte(0)
+		buf.WriteString(strconv.Itoa(len(arg)))
+		buf.WriteByte(0)
+		buf.WriteString(arg)
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
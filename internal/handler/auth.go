@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/k1ender/go-stash/internal/auth"
+)
+
+// Authentication
+//
+//	AUT\0<len>\0<password>\r\n                    authenticate as the default user
+//	AUT\0<len>\0<user>\0<len>\0<password>\r\n
+//	PIN(\0<len>\0<message>)?\r\n                  answers PONG or echoes message
+//
+// When the handler has an authenticator, a connection may only run AUT and
+// PIN until it authenticates. AUT answers OK, or ERR for bad credentials and
+// while the client is backed off after repeated failures.
+
+var (
+	ErrNoAuth   = errors.New("authentication required")
+	errAuthArgs = errors.New("expected a password or a user and a password")
+	errNoUsers  = errors.New("AUTH called without any users configured")
+	errPingArgs = errors.New("wrong number of arguments for PING")
+)
+
+type StatusResponse struct {
+	Value string
+}
+
+func (r *StatusResponse) Serialize() ([]byte, error) {
+	return []byte(r.Value + "\r\n"), nil
+}
+
+// WithAuthenticator requires connections to authenticate against a before
+// running any command other than AUT and PIN.
+func WithAuthenticator(a *auth.Authenticator) Arg {
+	return func(h *Handler) {
+		h.authenticator = a
+	}
+}
+
+// requireAuth answers ERR to every command but AUT and PIN until the
+// connection authenticates.
+func (h *Handler) requireAuth(next HandlerFunc) HandlerFunc {
+	return func(req *Request) (Response, error) {
+		if req.Conn.User() == "" && (req.spec == nil || req.spec.Flags&FlagNoAuth == 0) {
+			return nil, ErrNoAuth
+		}
+		return next(req)
+	}
+}
+
+func (h *Handler) authenticate(req *Request) (Response, error) {
+	client := req.Conn
+	args, err := DeserializeArgs(req.Frame)
+	if err != nil {
+		return nil, err
+	}
+
+	var user, password string
+	switch len(args) {
+	case 1:
+		user, password = auth.DefaultUser, args[0]
+	case 2:
+		user, password = args[0], args[1]
+	default:
+		return nil, errAuthArgs
+	}
+
+	if h.authenticator == nil {
+		return nil, errNoUsers
+	}
+
+	remote := client.RemoteAddr().String()
+	if err := h.authenticator.Authenticate(remote, user, password); err != nil {
+		client.Logger().Warn("authentication failed", "user", user, "error", err)
+		return nil, err
+	}
+	client.user.Store(user)
+	return &StatusResponse{Value: "OK"}, nil
+}
+
+func (h *Handler) ping(req *Request) (Response, error) {
+	args, err := DeserializeArgs(req.Frame)
+	if err != nil {
+		return nil, err
+	}
+	switch len(args) {
+	case 0:
+		return &StatusResponse{Value: "PONG"}, nil
+	case 1:
+		return &StatusResponse{Value: args[0]}, nil
+	default:
+		return nil, errPingArgs
+	}
+}
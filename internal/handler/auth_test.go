@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"io"
+	"testing"
+
+	"github.com/k1ender/go-stash/internal/auth"
+)
+
+// fail sends a command and fails the test unless it is answered with ERR.
+func (c *testClient) fail(command Command, args ...string) {
+	c.tb.Helper()
+	if _, err := c.conn.Write(SerializeArgs(command, args...)); err != nil {
+		c.tb.Fatalf("write: %v", err)
+	}
+	reply := make([]byte, len(ErrResponse))
+	if _, err := io.ReadFull(c.r, reply); err != nil {
+		c.tb.Fatalf("read: %v", err)
+	}
+	if string(reply) != string(ErrResponse) {
+		c.tb.Fatalf("reply starts with %q, want ERR", reply)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	hash, err := auth.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := auth.NewAuthenticator(map[string]string{auth.DefaultUser: hash, "alice": hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, stop := startTestServer(t, WithAuthenticator(a))
+	defer stop()
+
+	c := dialTestServer(t, addr)
+
+	if got := c.do(PingCommand); got != "PONG" {
+		t.Fatalf("PIN = %q", got)
+	}
+	c.fail(SetCommand, "key", "value")
+	c.fail(AuthCommand, "alice", "wrong")
+
+	if got := c.do(AuthCommand, "alice", "secret"); got != "OK" {
+		t.Fatalf("AUT = %q", got)
+	}
+	if got := c.do(SetCommand, "key", "value"); got != "OK" {
+		t.Fatalf("SET after AUT = %q", got)
+	}
+
+	other := dialTestServer(t, addr)
+	if got := other.do(AuthCommand, "secret"); got != "OK" {
+		t.Fatalf("AUT as default user = %q", got)
+	}
+	if got := other.do(GetCommand, "key"); got != "value" {
+		t.Fatalf("GET = %q", got)
+	}
+}
@@ -0,0 +1,193 @@
+package handler
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CLI LIST answers with a line per connected client, ordered by id:
+//
+//	id=3 addr=127.0.0.1:53412 name=worker age=12 idle=0 db=0 cmd=GET user=default qbuf=0 obuf=0
+//
+// age and idle are in seconds, cmd is the last command run and qbuf and obuf
+// are the bytes of requests read but not yet run and of replies not yet
+// sent. CLI INFO answers with the line of the calling connection.
+//
+// CLI SETNAME <name> names the connection; an empty name removes it. Names
+// may not contain spaces or control characters.
+//
+// CLI KILL ID <id>, CLI KILL ADDR <ip:port> and CLI KILL IDLE <seconds>
+// disconnect the matching clients and answer with their number.
+
+var (
+	errClientArgs   = errors.New("expected CLIENT LIST, INFO, SETNAME <name> or KILL ID|ADDR|IDLE <value>")
+	errClientSubcmd = errors.New("unknown CLIENT subcommand")
+	errClientName   = errors.New("client names may not contain spaces or control characters")
+)
+
+// Clients is the set of connections a server serves. It assigns every
+// connection an id when it is added.
+type Clients struct {
+	mu     sync.Mutex
+	nextID uint64
+	conns  map[*Conn]struct{}
+}
+
+func NewClients() *Clients {
+	return &Clients{conns: make(map[*Conn]struct{})}
+}
+
+// Add registers c and assigns its id. It must be called before c runs any
+// command.
+func (cs *Clients) Add(c *Conn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.nextID++
+	c.id = cs.nextID
+	cs.conns[c] = struct{}{}
+}
+
+func (cs *Clients) Remove(c *Conn) {
+	cs.mu.Lock()
+	delete(cs.conns, c)
+	cs.mu.Unlock()
+}
+
+func (cs *Clients) Len() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return len(cs.conns)
+}
+
+// All returns the registered connections ordered by id.
+func (cs *Clients) All() []*Conn {
+	cs.mu.Lock()
+	conns := make([]*Conn, 0, len(cs.conns))
+	for c := range cs.conns {
+		conns = append(conns, c)
+	}
+	cs.mu.Unlock()
+
+	slices.SortFunc(conns, func(a, b *Conn) int {
+		return cmp.Compare(a.id, b.id)
+	})
+	return conns
+}
+
+// WithClients makes CLI LIST and CLI KILL act on the connections in cs.
+// Without it they only see an empty set.
+func WithClients(cs *Clients) Arg {
+	return func(h *Handler) {
+		h.clients = cs
+	}
+}
+
+// describe returns the CLI LIST line of c.
+func (c *Conn) describe(now time.Time) string {
+	name, _ := c.name.Load().(string)
+	cmd := "NULL"
+	if last := c.lastCommand.Load(); last != 0 {
+		cmd = string([]byte{byte(last >> 16), byte(last >> 8), byte(last)})
+	}
+	user := c.User()
+	if user == "" {
+		user = "default"
+	}
+	qbuf, obuf := c.Buffered()
+
+	return strings.Join([]string{
+		"id=" + strconv.FormatUint(c.id, 10),
+		"addr=" + c.RemoteAddr().String(),
+		"name=" + name,
+		"age=" + strconv.Itoa(int(now.Sub(c.created).Seconds())),
+		"idle=" + strconv.Itoa(int(now.Sub(c.LastActive()).Seconds())),
+		"db=0",
+		"cmd=" + cmd,
+		"user=" + user,
+		"qbuf=" + strconv.Itoa(qbuf),
+		"obuf=" + strconv.Itoa(obuf),
+	}, " ")
+}
+
+func (h *Handler) clientCommand(req *Request) (Response, error) {
+	args, err := DeserializeArgs(req.Frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errClientArgs
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "LIST":
+		if len(args) != 1 {
+			return nil, errClientArgs
+		}
+		now := time.Now()
+		var lines []string
+		for _, c := range h.clients.All() {
+			lines = append(lines, c.describe(now))
+		}
+		return &ListResponse{Lines: lines}, nil
+	case "INFO":
+		if len(args) != 1 {
+			return nil, errClientArgs
+		}
+		return &StatusResponse{Value: req.Conn.describe(time.Now())}, nil
+	case "SETNAME":
+		if len(args) != 2 {
+			return nil, errClientArgs
+		}
+		if strings.ContainsFunc(args[1], func(r rune) bool { return r <= ' ' || r == 0x7f }) {
+			return nil, errClientName
+		}
+		req.Conn.name.Store(args[1])
+		return &StatusResponse{Value: "OK"}, nil
+	case "KILL":
+		if len(args) != 3 {
+			return nil, errClientArgs
+		}
+		match, err := clientFilter(args[1], args[2])
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		killed := 0
+		for _, c := range h.clients.All() {
+			if match(c, now) {
+				c.Kill()
+				killed++
+			}
+		}
+		return &StatusResponse{Value: strconv.Itoa(killed)}, nil
+	}
+
+	return nil, errClientSubcmd
+}
+
+// clientFilter returns the predicate of a CLI KILL filter.
+func clientFilter(kind, value string) (func(c *Conn, now time.Time) bool, error) {
+	switch strings.ToUpper(kind) {
+	case "ID":
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, errClientArgs
+		}
+		return func(c *Conn, _ time.Time) bool { return c.id == id }, nil
+	case "ADDR":
+		return func(c *Conn, _ time.Time) bool { return c.RemoteAddr().String() == value }, nil
+	case "IDLE":
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return nil, errClientArgs
+		}
+		idle := time.Duration(seconds) * time.Second
+		return func(c *Conn, now time.Time) bool { return now.Sub(c.LastActive()) >= idle }, nil
+	}
+	return nil, errClientArgs
+}
@@ -1,12 +1,200 @@
 package handler
 
+import (
+	"errors"
+	"strings"
+
+	"github.com/k1ender/go-stash/internal/store"
+)
+
 // Command always in uppercase string with len 3
 type Command [3]byte
 
+func (c Command) String() string {
+	return string(c[:])
+}
+
 var (
 	GetCommand  Command = Command{'G', 'E', 'T'}
 	SetCommand  Command = Command{'S', 'E', 'T'}
 	IncrCommand Command = Command{'I', 'N', 'C'}
 	DecrCommand Command = Command{'D', 'E', 'C'}
 	DelCommand  Command = Command{'D', 'E', 'L'}
+
+	MultiCommand   Command = Command{'M', 'U', 'L'}
+	ExecCommand    Command = Command{'E', 'X', 'E'}
+	DiscardCommand Command = Command{'D', 'I', 'S'}
+	WatchCommand   Command = Command{'W', 'A', 'T'}
+	UnwatchCommand Command = Command{'U', 'N', 'W'}
+
+	EvalCommand    Command = Command{'E', 'V', 'A'}
+	EvalSHACommand Command = Command{'E', 'V', 'S'}
+	ScriptCommand  Command = Command{'S', 'C', 'R'}
+
+	AuthCommand Command = Command{'A', 'U', 'T'}
+	PingCommand Command = Command{'P', 'I', 'N'}
+	ACLCommand  Command = Command{'A', 'C', 'L'}
+
+	CommandCommand Command = Command{'C', 'M', 'D'}
+	InfoCommand    Command = Command{'I', 'N', 'F'}
+	SlowLogCommand Command = Command{'S', 'L', 'O'}
+	MonitorCommand Command = Command{'M', 'O', 'N'}
+	ClientCommand  Command = Command{'C', 'L', 'I'}
+	ConfigCommand  Command = Command{'C', 'F', 'G'}
+
+	PublishCommand   Command = Command{'P', 'U', 'B'}
+	SubscribeCommand Command = Command{'S', 'U', 'B'}
+	// MessageCommand starts the frames pushed to subscribers.
+	MessageCommand Command = Command{'M', 'S', 'G'}
+)
+
+// CommandFlag describes properties of a command, as listed by CMD.
+type CommandFlag uint16
+
+const (
+	// FlagReadOnly marks commands that only read the store.
+	FlagReadOnly CommandFlag = 1 << iota
+	// FlagWrite marks commands that may modify the store.
+	FlagWrite
+	// FlagAdmin marks commands meant for operators rather than
+	// applications.
+	FlagAdmin
+	// FlagNoAuth marks commands that may run before the connection
+	// authenticates and are never denied by ACL rules.
+	FlagNoAuth
+	// FlagTx marks the commands that control transactions. They run
+	// immediately while a transaction is open instead of being queued.
+	FlagTx
+	// FlagSlow marks commands that may take long to run, such as AUT,
+	// which hashes a password on purpose, and scripts.
+	FlagSlow
 )
+
+var flagNames = []string{"readonly", "write", "admin", "noauth", "transaction", "slow"}
+
+// String returns the names of the flags separated by commas.
+func (f CommandFlag) String() string {
+	var names []string
+	for i, name := range flagNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// CommandInfo describes a command for introspection.
+type CommandInfo struct {
+	Command Command
+	// Arity is the number of parts of a valid frame, counting the command
+	// itself like Redis does. A negative arity -N means at least N.
+	Arity int
+	Flags CommandFlag
+}
+
+// builtinCommands describes the commands every handler supports. Custom
+// commands can not reuse their codes.
+var builtinCommands = map[Command]CommandInfo{
+	GetCommand:  {Arity: 2, Flags: FlagReadOnly},
+	SetCommand:  {Arity: 3, Flags: FlagWrite},
+	IncrCommand: {Arity: 2, Flags: FlagWrite},
+	DecrCommand: {Arity: 2, Flags: FlagWrite},
+	DelCommand:  {Arity: 2, Flags: FlagWrite},
+
+	MultiCommand:   {Arity: 1, Flags: FlagTx},
+	ExecCommand:    {Arity: 1, Flags: FlagTx | FlagSlow},
+	DiscardCommand: {Arity: 1, Flags: FlagTx},
+	WatchCommand:   {Arity: -2, Flags: FlagTx | FlagReadOnly},
+	UnwatchCommand: {Arity: 1, Flags: FlagTx},
+
+	EvalCommand:    {Arity: -3, Flags: FlagWrite | FlagSlow},
+	EvalSHACommand: {Arity: -3, Flags: FlagWrite | FlagSlow},
+	ScriptCommand:  {Arity: -2, Flags: FlagAdmin},
+
+	AuthCommand:    {Arity: -2, Flags: FlagNoAuth | FlagSlow},
+	PingCommand:    {Arity: -1, Flags: FlagNoAuth},
+	ACLCommand:     {Arity: -2, Flags: FlagAdmin},
+	CommandCommand: {Arity: 1},
+	InfoCommand:    {Arity: -1, Flags: FlagAdmin},
+	SlowLogCommand: {Arity: -2, Flags: FlagAdmin},
+	MonitorCommand: {Arity: 1, Flags: FlagAdmin},
+	ClientCommand:  {Arity: -2, Flags: FlagAdmin},
+	ConfigCommand:  {Arity: -2, Flags: FlagAdmin},
+
+	PublishCommand:   {Arity: 3},
+	SubscribeCommand: {Arity: -2},
+}
+
+// commandSpec describes how to run a registered command.
+type commandSpec struct {
+	CommandInfo
+
+	handle HandlerFunc
+	// bind returns the command bound to another view of the store. It is
+	// set for the commands that can be queued in a transaction.
+	bind func(st store.Store) HandlerFunc
+	// keys returns the keys the command accesses, given its arguments. It
+	// is nil for commands without keys.
+	keys func(args []string) ([]string, error)
+	// decode and decodedKeys replace keys for custom commands, whose
+	// arguments are decoded once into Request.Decoded.
+	decode      func(args []string) (any, error)
+	decodedKeys func(decoded any) []string
+}
+
+func (h *Handler) register(command Command, spec commandSpec) {
+	if info, ok := builtinCommands[command]; ok {
+		spec.CommandInfo = info
+	}
+	spec.Command = command
+	if spec.handle == nil {
+		spec.handle = spec.bind(h.store)
+	}
+	h.handlers[command] = &spec
+}
+
+// registerBuiltins registers the commands every handler supports.
+func (h *Handler) registerBuiltins() {
+	for command, newHandler := range storeCommands {
+		h.register(command, commandSpec{
+			bind: func(st store.Store) HandlerFunc {
+				handler := newHandler(st)
+				return func(req *Request) (Response, error) { return handler.Handle(req.Frame) }
+			},
+			keys: firstKey,
+		})
+	}
+
+	h.register(MultiCommand, commandSpec{handle: h.multi})
+	h.register(ExecCommand, commandSpec{handle: h.exec})
+	h.register(DiscardCommand, commandSpec{handle: h.discard})
+	h.register(WatchCommand, commandSpec{handle: h.watch, keys: allKeys})
+	h.register(UnwatchCommand, commandSpec{handle: h.unwatch})
+
+	h.register(EvalCommand, commandSpec{handle: h.eval, keys: evalKeys})
+	h.register(EvalSHACommand, commandSpec{handle: h.evalSHA, keys: evalKeys})
+	h.register(ScriptCommand, commandSpec{handle: h.script})
+
+	h.register(AuthCommand, commandSpec{handle: h.authenticate})
+	h.register(PingCommand, commandSpec{handle: h.ping})
+	h.register(ACLCommand, commandSpec{handle: h.aclCommand})
+	h.register(CommandCommand, commandSpec{handle: h.listCommands})
+	h.register(InfoCommand, commandSpec{handle: h.infoCommand})
+	h.register(SlowLogCommand, commandSpec{handle: h.slowLogCommand})
+	h.register(MonitorCommand, commandSpec{handle: h.monitor})
+	h.register(ClientCommand, commandSpec{handle: h.clientCommand})
+	h.register(ConfigCommand, commandSpec{handle: h.configCommand})
+	h.register(PublishCommand, commandSpec{handle: h.publish, keys: publishKeys})
+	h.register(SubscribeCommand, commandSpec{handle: h.subscribe, keys: subscribeKeys})
+}
+
+func firstKey(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, errors.New("missing key")
+	}
+	return args[:1], nil
+}
+
+func allKeys(args []string) ([]string, error) {
+	return args, nil
+}
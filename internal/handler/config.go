@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/k1ender/go-stash/internal/config"
+)
+
+// CFG GET <pattern> answers with the options matching the glob pattern and
+// their values, as alternating lines of option and value.
+//
+// CFG SET <option> <value> changes an option tagged mutable. The value is
+// validated like in the configuration file, and subsystems registered with
+// config.Runtime.OnChange apply it right away.
+//
+// CFG REWRITE writes the current configuration back to the configuration
+// file, keeping its comments and the order of its lines.
+
+var (
+	errConfigArgs    = errors.New("expected CONFIG GET <pattern>, SET <option> <value> or REWRITE")
+	errConfigSubcmd  = errors.New("unknown CONFIG subcommand")
+	errConfigMissing = errors.New("CONFIG is not available")
+)
+
+// WithConfig makes CFG read and change rt.
+func WithConfig(rt *config.Runtime) Arg {
+	return func(h *Handler) {
+		h.config = rt
+	}
+}
+
+func (h *Handler) configCommand(req *Request) (Response, error) {
+	args, err := DeserializeArgs(req.Frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errConfigArgs
+	}
+	if h.config == nil {
+		return nil, errConfigMissing
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if len(args) != 2 {
+			return nil, errConfigArgs
+		}
+		values, err := h.config.Get(args[1])
+		if err != nil {
+			return nil, err
+		}
+		lines := make([]string, 0, 2*len(values))
+		for _, v := range values {
+			lines = append(lines, v.Option, v.Value)
+		}
+		return &ListResponse{Lines: lines}, nil
+	case "SET":
+		if len(args) != 3 {
+			return nil, errConfigArgs
+		}
+		if err := h.config.Set(args[1], args[2]); err != nil {
+			return nil, err
+		}
+		return &StatusResponse{Value: "OK"}, nil
+	case "REWRITE":
+		if len(args) != 1 {
+			return nil, errConfigArgs
+		}
+		if err := h.config.Rewrite(); err != nil {
+			return nil, err
+		}
+		return &StatusResponse{Value: "OK"}, nil
+	}
+
+	return nil, errConfigSubcmd
+}
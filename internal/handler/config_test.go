@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/config"
+	"github.com/k1ender/go-stash/internal/slowlog"
+)
+
+func TestConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stash.conf")
+	if err := os.WriteFile(path, []byte("# the port\nport = 1000\n\nmax_clients = 10\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(nil, config.WithConfigPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := config.NewRuntime(cfg)
+	log := slowlog.New(time.Second, 8)
+	rt.OnChange("slowlog_threshold_us", func(cfg *config.Config) error {
+		log.SetThreshold(time.Duration(cfg.SlowLog.ThresholdUs) * time.Microsecond)
+		return nil
+	})
+
+	addr, stop := startTestServer(t, WithConfig(rt), WithSlowLog(log))
+	defer stop()
+	c := dialTestServer(t, addr)
+
+	if got := c.list(ConfigCommand, "GET", "slowlog_*"); !slices.Equal(got, []string{"slowlog_threshold_us", "10000", "slowlog_max_len", "128"}) {
+		t.Fatalf("CFG GET slowlog_* = %q", got)
+	}
+	if got := c.do(ConfigCommand, "SET", "slowlog_threshold_us", "250"); got != "OK" {
+		t.Fatalf("CFG SET = %q", got)
+	}
+	if log.Threshold() != 250*time.Microsecond {
+		t.Fatalf("threshold = %v, hook did not run", log.Threshold())
+	}
+	if got := c.list(ConfigCommand, "GET", "slowlog_threshold_us"); !slices.Equal(got, []string{"slowlog_threshold_us", "250"}) {
+		t.Fatalf("CFG GET after SET = %q", got)
+	}
+	if got := c.do(ConfigCommand, "SET", "max_frame_size", "1mb"); got != "OK" {
+		t.Fatalf("CFG SET max_frame_size = %q", got)
+	}
+
+	// Immutable options, unknown options and invalid values are refused.
+	c.fail(ConfigCommand, "SET", "port", "2000")
+	c.fail(ConfigCommand, "SET", "nope", "1")
+	c.fail(ConfigCommand, "SET", "max_clients", "-1")
+
+	// SLO THRESHOLD goes through the option too.
+	if got := c.do(SlowLogCommand, "THRESHOLD", "5"); got != "OK" {
+		t.Fatalf("SLO THRESHOLD = %q", got)
+	}
+	if got := c.list(ConfigCommand, "GET", "slowlog_threshold_us"); !slices.Equal(got, []string{"slowlog_threshold_us", "5"}) {
+		t.Fatalf("CFG GET after SLO THRESHOLD = %q", got)
+	}
+	if log.Threshold() != 5*time.Microsecond {
+		t.Fatalf("threshold = %v after SLO THRESHOLD", log.Threshold())
+	}
+
+	if got := c.do(ConfigCommand, "REWRITE"); got != "OK" {
+		t.Fatalf("CFG REWRITE = %q", got)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# the port\nport = 1000\n\nmax_clients = 10\nslowlog_threshold_us = 5\nmax_frame_size = 1mb\n"
+	if string(data) != want {
+		t.Fatalf("rewritten file:\n%s\nwant:\n%s", data, want)
+	}
+}
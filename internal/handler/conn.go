@@ -0,0 +1,389 @@
+package handler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/constants"
+)
+
+// maxLenDigits bounds the length prefix of a single argument.
+const maxLenDigits = 10
+
+var (
+	ErrMalformedFrame = errors.New("malformed frame")
+	ErrFrameTooLarge  = errors.New("frame exceeds the maximum frame size")
+)
+
+// Limits bounds what a client may do with its connection. Zero values
+// disable the corresponding limit.
+type Limits struct {
+	// MaxFrameSize is the largest request frame accepted, in bytes.
+	MaxFrameSize int
+	// IdleTimeout is how long a client may wait between two commands.
+	IdleTimeout time.Duration
+	// ReadTimeout is how long a client may take to send the rest of a
+	// command once its first byte arrived.
+	ReadTimeout time.Duration
+	// WriteTimeout is how long writing a single reply may take.
+	WriteTimeout time.Duration
+}
+
+// Conn holds the state of a single client connection between commands.
+type Conn struct {
+	net.Conn
+
+	reader *bufio.Reader
+	writer io.Writer
+	frame  []byte
+	limits Limits
+
+	interrupted atomic.Bool
+
+	tx      *transaction
+	watched map[string]uint64
+
+	// user is the name the connection authenticated as, empty until AUT
+	// succeeds.
+	user atomic.Value // string
+
+	// monitor is set once the connection runs MON, subscriber once it runs
+	// SUB.
+	monitor    atomic.Pointer[monitor]
+	subscriber atomic.Pointer[subscriber]
+
+	// The fields below describe the connection for CLI. They are written
+	// by the goroutine serving the connection and read by any.
+	id          uint64
+	created     time.Time
+	name        atomic.Value // string
+	lastCommand atomic.Uint32
+	lastActive  atomic.Int64
+	qbuf, obuf  atomic.Int64
+	kill        func()
+
+	logger atomic.Pointer[slog.Logger]
+}
+
+type ConnArg func(c *Conn)
+
+func WithLimits(limits Limits) ConnArg {
+	return func(c *Conn) {
+		c.limits = limits
+	}
+}
+
+// WithWriter makes the Conn send replies to w instead of the connection,
+// for event loops that write to the socket themselves.
+func WithWriter(w io.Writer) ConnArg {
+	return func(c *Conn) {
+		c.writer = w
+	}
+}
+
+// WithKill makes Kill call kill instead of interrupting reads, for event
+// loops that read the socket themselves. kill must make the connection get
+// closed soon by whoever serves it.
+func WithKill(kill func()) ConnArg {
+	return func(c *Conn) {
+		c.kill = kill
+	}
+}
+
+// WithUser makes the Conn start out authenticated as user, for gateways that
+// verified its credentials before.
+func WithUser(user string) ConnArg {
+	return func(c *Conn) {
+		c.user.Store(user)
+	}
+}
+
+func NewConn(conn net.Conn, args ...ConnArg) *Conn {
+	c := &Conn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		created: time.Now(),
+	}
+	c.lastActive.Store(c.created.UnixNano())
+	for _, arg := range args {
+		arg(c)
+	}
+	return c
+}
+
+// User returns the name of the user the connection authenticated as, or an
+// empty string.
+func (c *Conn) User() string {
+	user, _ := c.user.Load().(string)
+	return user
+}
+
+// ID returns the id assigned by Clients.Add, or 0.
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+// Logger returns the default logger with the id and the remote address of
+// the connection attached to every record. It must not be called before the
+// connection was added to its Clients.
+func (c *Conn) Logger() *slog.Logger {
+	if l := c.logger.Load(); l != nil {
+		return l
+	}
+	l := slog.Default().With("client_id", c.id, "remote", c.RemoteAddr().String())
+	c.logger.Store(l)
+	return l
+}
+
+// LastActive returns when the connection last ran a command, or when it was
+// opened.
+func (c *Conn) LastActive() time.Time {
+	return time.Unix(0, c.lastActive.Load())
+}
+
+// touch records that command is being run.
+func (c *Conn) touch(command Command) {
+	c.lastCommand.Store(uint32(command[0])<<16 | uint32(command[1])<<8 | uint32(command[2]))
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// Buffered returns the number of bytes received but not run yet and of
+// replies not sent yet.
+func (c *Conn) Buffered() (in, out int) {
+	return int(c.qbuf.Load()), int(c.obuf.Load())
+}
+
+// SetBuffered reports the buffer sizes for event loops that buffer input
+// and output themselves.
+func (c *Conn) SetBuffered(in, out int) {
+	c.qbuf.Store(int64(in))
+	c.obuf.Store(int64(out))
+}
+
+// Kill disconnects the client from another goroutine. A command that is
+// running completes and its reply is sent before the connection closes.
+func (c *Conn) Kill() {
+	if c.kill != nil {
+		c.kill()
+		return
+	}
+	c.Interrupt()
+}
+
+// InTransaction reports whether the connection has an open MUL block, whose
+// commands are queued instead of run.
+func (c *Conn) InTransaction() bool {
+	return c.tx != nil
+}
+
+// Close closes the connection and detaches it if it is a monitor or a
+// subscriber.
+func (c *Conn) Close() error {
+	if m := c.monitor.Load(); m != nil {
+		m.close()
+	}
+	if s := c.subscriber.Load(); s != nil {
+		s.close()
+	}
+	return c.Conn.Close()
+}
+
+// Interrupt makes a pending or future ReadCommand fail with
+// os.ErrDeadlineExceeded, without affecting a command that is already
+// being executed.
+func (c *Conn) Interrupt() {
+	c.interrupted.Store(true)
+	c.Conn.SetReadDeadline(time.Now())
+}
+
+// Write writes p to the client within the write timeout.
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.writer != nil {
+		return c.writer.Write(p)
+	}
+	return c.writeDirect(p)
+}
+
+// writeDirect writes p to the socket even if the Conn has a writer set by
+// WithWriter. It is safe to call from another goroutine than the one
+// running commands, as long as that one does not write.
+func (c *Conn) writeDirect(p []byte) (int, error) {
+	if c.limits.WriteTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.limits.WriteTimeout))
+	}
+	return c.Conn.Write(p)
+}
+
+// awaitCommand blocks until the first byte of the next command is available,
+// for at most the idle timeout, and then arms the read timeout for the rest
+// of the frame.
+func (c *Conn) awaitCommand() error {
+	if c.reader.Buffered() == 0 {
+		var deadline time.Time
+		if c.limits.IdleTimeout > 0 {
+			deadline = time.Now().Add(c.limits.IdleTimeout)
+		}
+		c.Conn.SetReadDeadline(deadline)
+
+		// Checked after arming the deadline so an Interrupt racing with
+		// us is never overwritten.
+		if c.interrupted.Load() {
+			return os.ErrDeadlineExceeded
+		}
+
+		if _, err := c.reader.Peek(1); err != nil {
+			return err
+		}
+	}
+
+	if c.limits.ReadTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.limits.ReadTimeout))
+	}
+	if c.interrupted.Load() {
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// ReadCommand reads one request frame from the connection:
+//
+//	<command>(\0<len>\0<data>)*\r\n
+//
+// The returned slice includes the trailing \r\n, so it can be passed to the
+// Deserialize functions unchanged. It is only valid until the next call.
+func (c *Conn) ReadCommand() ([]byte, error) {
+	if err := c.awaitCommand(); err != nil {
+		return nil, err
+	}
+
+	frame := c.frame[:0]
+
+	frame, err := c.readN(frame, constants.CommandKeyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		frame = append(frame, b)
+
+		switch b {
+		case '\r':
+			b, err = c.reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if b != '\n' {
+				return nil, fmt.Errorf("%w: expected \\n after \\r", ErrMalformedFrame)
+			}
+			c.frame = append(frame, b)
+			c.qbuf.Store(int64(c.reader.Buffered()))
+			return c.frame, nil
+		case 0:
+			frame, err = c.readArg(frame)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%w: unexpected byte %q", ErrMalformedFrame, b)
+		}
+	}
+}
+
+// readArg reads the <len>\0<data> part of an argument.
+func (c *Conn) readArg(frame []byte) ([]byte, error) {
+	start := len(frame)
+	for {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		frame = append(frame, b)
+		if b == 0 {
+			break
+		}
+		if b < '0' || b > '9' || len(frame)-start > maxLenDigits {
+			return nil, fmt.Errorf("%w: invalid length", ErrMalformedFrame)
+		}
+	}
+
+	n, err := strconv.Atoi(string(frame[start : len(frame)-1]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid length", ErrMalformedFrame)
+	}
+
+	// Checked before reading, so the length prefix alone can never make us
+	// allocate more than the maximum frame size.
+	if c.limits.MaxFrameSize > 0 && n > c.limits.MaxFrameSize-len(frame) {
+		return nil, ErrFrameTooLarge
+	}
+	return c.readN(frame, n)
+}
+
+func (c *Conn) readN(frame []byte, n int) ([]byte, error) {
+	start := len(frame)
+	frame = slices.Grow(frame, n)[:start+n]
+	if _, err := io.ReadFull(c.reader, frame[start:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// ScanFrame returns the length of the complete frame at the start of buf, or
+// 0 if buf does not hold a whole frame yet. It applies the same rules as
+// ReadCommand, for callers that buffer the connection themselves.
+func ScanFrame(buf []byte, maxFrameSize int) (int, error) {
+	i := constants.CommandKeyLen
+	for {
+		if maxFrameSize > 0 && i > maxFrameSize {
+			return 0, ErrFrameTooLarge
+		}
+		if i >= len(buf) {
+			return 0, nil
+		}
+
+		switch buf[i] {
+		case '\r':
+			if i+1 >= len(buf) {
+				return 0, nil
+			}
+			if buf[i+1] != '\n' {
+				return 0, fmt.Errorf("%w: expected \\n after \\r", ErrMalformedFrame)
+			}
+			return i + 2, nil
+		case 0:
+			end := i + 1
+			for ; end < len(buf) && buf[end] != 0; end++ {
+				if buf[end] < '0' || buf[end] > '9' || end-i > maxLenDigits {
+					return 0, fmt.Errorf("%w: invalid length", ErrMalformedFrame)
+				}
+			}
+			if end == len(buf) {
+				return 0, nil
+			}
+
+			n, err := strconv.Atoi(string(buf[i+1 : end]))
+			if err != nil {
+				return 0, fmt.Errorf("%w: invalid length", ErrMalformedFrame)
+			}
+			if maxFrameSize > 0 && n > maxFrameSize-end-1 {
+				return 0, ErrFrameTooLarge
+			}
+			i = end + 1 + n
+		default:
+			return 0, fmt.Errorf("%w: unexpected byte %q", ErrMalformedFrame, buf[i])
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"testing"
+)
+
+func TestScanFrame(t *testing.T) {
+	set := "SET\x003\x00key\x005\x00value\r\n"
+
+	for i := range len(set) {
+		if n, err := ScanFrame([]byte(set[:i]), 0); n != 0 || err != nil {
+			t.Fatalf("ScanFrame(%q) = %d, %v; want incomplete", set[:i], n, err)
+		}
+	}
+	if n, err := ScanFrame([]byte(set+"GET"), 0); n != len(set) || err != nil {
+		t.Fatalf("ScanFrame = %d, %v; want %d", n, err, len(set))
+	}
+
+	if _, err := ScanFrame([]byte("SET\x003\x00key\x009999999999\x00"), 64); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("oversized length: err = %v", err)
+	}
+	if _, err := ScanFrame([]byte("SET\x00x"), 0); !errors.Is(err, ErrMalformedFrame) {
+		t.Fatalf("bad length: err = %v", err)
+	}
+	if _, err := ScanFrame([]byte("GETX"), 0); !errors.Is(err, ErrMalformedFrame) {
+		t.Fatalf("bad separator: err = %v", err)
+	}
+}
+
+func TestConnLogger(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	clients := NewClients()
+	clients.Add(NewConn(client))
+	c := NewConn(server)
+	clients.Add(c)
+
+	c.Logger().Info("hello")
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["client_id"] != float64(2) || record["remote"] != "pipe" {
+		t.Fatalf("record = %v", record)
+	}
+}
@@ -0,0 +1,250 @@
+package handler
+
+import (
+	"container/list"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/k1ender/go-stash/internal/script"
+	"github.com/k1ender/go-stash/internal/store"
+)
+
+// Scripting
+//
+//	EVA\0<len>\0<script>\0<len>\0<numKeys>(\0<len>\0<key>)*(\0<len>\0<arg>)*\r\n
+//	EVS\0<len>\0<sha>\0<len>\0<numKeys>(\0<len>\0<key>)*(\0<len>\0<arg>)*\r\n
+//	SCR\0<len>\0LOAD\0<len>\0<script>\r\n
+//	SCR\0<len>\0EXISTS\0<len>\0<sha>\r\n
+//	SCR\0<len>\0FLUSH\r\n
+//
+// EVA compiles and caches the script, then runs it atomically with all of its
+// keys locked. EVS runs a previously cached script by its SHA1. See package
+// script for the language.
+
+var (
+	ErrNoScript = errors.New("no script with the given SHA")
+
+	errEvalArgs        = errors.New("expected script, number of keys, keys and arguments")
+	errScriptSubcmd    = errors.New("unknown SCRIPT subcommand")
+	errScriptArgs      = errors.New("wrong number of arguments for SCRIPT")
+	errInvalidKeyCount = errors.New("number of keys is invalid")
+)
+
+type ScriptResponse struct {
+	Value string
+}
+
+func (r *ScriptResponse) Serialize() ([]byte, error) {
+	return []byte(r.Value + "\r\n"), nil
+}
+
+// scriptCache holds compiled scripts by their SHA1. Once their sources add
+// up to more than maxBytes, the least recently used scripts are evicted and
+// have to be loaded again before EVS can run them.
+type scriptCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	bytes    int
+	// lru holds the *cachedScript of every program, most recently used
+	// first.
+	lru      list.List
+	programs map[string]*list.Element
+}
+
+type cachedScript struct {
+	program *script.Program
+	size    int
+}
+
+func (c *scriptCache) get(sha string) (*script.Program, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.programs[strings.ToLower(sha)]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedScript).program, true
+}
+
+func (c *scriptCache) load(src string) (*script.Program, error) {
+	if p, ok := c.get(script.SHA(src)); ok {
+		return p, nil
+	}
+
+	p, err := script.Compile(src)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.programs[p.SHA]; ok {
+		return e.Value.(*cachedScript).program, nil
+	}
+	if c.programs == nil {
+		c.programs = make(map[string]*list.Element)
+	}
+	e := c.lru.PushFront(&cachedScript{program: p, size: len(src)})
+	c.programs[p.SHA] = e
+	c.bytes += len(src)
+	c.evict(e)
+	return p, nil
+}
+
+// evict removes the least recently used scripts until the cache fits
+// maxBytes again, keeping keep even if it is larger on its own.
+func (c *scriptCache) evict(keep *list.Element) {
+	for c.maxBytes > 0 && c.bytes > c.maxBytes {
+		e := c.lru.Back()
+		if e == keep {
+			return
+		}
+		cached := c.lru.Remove(e).(*cachedScript)
+		delete(c.programs, cached.program.SHA)
+		c.bytes -= cached.size
+	}
+}
+
+func (c *scriptCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.programs = nil
+	c.lru.Init()
+	c.bytes = 0
+}
+
+func (h *Handler) eval(req *Request) (Response, error) {
+	return h.runScript(req.Conn, req.Frame, false)
+}
+
+func (h *Handler) evalSHA(req *Request) (Response, error) {
+	return h.runScript(req.Conn, req.Frame, true)
+}
+
+// evalKeys returns the keys declared in the arguments of EVA and EVS.
+func evalKeys(args []string) ([]string, error) {
+	if len(args) < 2 {
+		return nil, errEvalArgs
+	}
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys < 0 || numKeys > len(args)-2 {
+		return nil, errInvalidKeyCount
+	}
+	return args[2 : 2+numKeys], nil
+}
+
+func (h *Handler) runScript(client *Conn, command []byte, bySHA bool) (Response, error) {
+	args, err := DeserializeArgs(command)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := evalKeys(args)
+	if err != nil {
+		return nil, err
+	}
+	argv := args[2+len(keys):]
+
+	var program *script.Program
+	if bySHA {
+		var ok bool
+		if program, ok = h.scripts.get(args[0]); !ok {
+			return nil, ErrNoScript
+		}
+	} else if program, err = h.scripts.load(args[0]); err != nil {
+		return nil, err
+	}
+
+	ts, ok := h.store.(store.Transactional)
+	if !ok {
+		return nil, errNotTransactable
+	}
+
+	var result any
+	err = ts.Atomic(keys, func(tx store.Tx) error {
+		st := &scriptStore{Tx: tx, h: h, client: client}
+		result, err = program.Run(st, keys, argv, *h.scriptLimits.Load())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ScriptResponse{Value: script.Format(result)}, nil
+}
+
+// scriptStore is the view of the store a script runs against. Its writes
+// pass through the handler's slow log, monitor and keyspace notification
+// middleware like the commands they correspond to.
+type scriptStore struct {
+	store.Tx
+	h      *Handler
+	client *Conn
+}
+
+func (s *scriptStore) Set(key, value string) error {
+	return s.write(func() error { return s.Tx.Set(key, value) }, SetCommand, key, value)
+}
+
+func (s *scriptStore) Incr(key string) (n int, err error) {
+	err = s.write(func() error { n, err = s.Tx.Incr(key); return err }, IncrCommand, key)
+	return n, err
+}
+
+func (s *scriptStore) Decr(key string) (n int, err error) {
+	err = s.write(func() error { n, err = s.Tx.Decr(key); return err }, DecrCommand, key)
+	return n, err
+}
+
+func (s *scriptStore) Del(key string) error {
+	return s.write(func() error { return s.Tx.Del(key) }, DelCommand, key)
+}
+
+func (s *scriptStore) write(run func() error, command Command, args ...string) error {
+	_, err := s.h.observe(func(*Request) (Response, error) {
+		return nil, run()
+	})(&Request{
+		Conn:    s.client,
+		Command: command,
+		Frame:   SerializeArgs(command, args...),
+		spec:    s.h.handlers[command],
+	})
+	return err
+}
+
+func (h *Handler) script(req *Request) (Response, error) {
+	args, err := DeserializeArgs(req.Frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errScriptArgs
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "LOAD":
+		if len(args) != 2 {
+			return nil, errScriptArgs
+		}
+		program, err := h.scripts.load(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return &ScriptResponse{Value: program.SHA}, nil
+	case "EXISTS":
+		if len(args) != 2 {
+			return nil, errScriptArgs
+		}
+		if _, ok := h.scripts.get(args[1]); ok {
+			return &ScriptResponse{Value: "1"}, nil
+		}
+		return &ScriptResponse{Value: "0"}, nil
+	case "FLUSH":
+		h.scripts.flush()
+		return &ScriptResponse{Value: "OK"}, nil
+	}
+
+	return nil, errScriptSubcmd
+}
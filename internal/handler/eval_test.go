@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/script"
+)
+
+func TestEvalAndEvalSHA(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+
+	c := dialTestServer(t, addr)
+	src := "set(KEYS[2], get(KEYS[1]) or ARGV[1]) return incr(KEYS[1])"
+
+	c.do(SetCommand, "a", "5")
+	if got := c.do(EvalCommand, src, "2", "a", "b", "fallback"); got != "6" {
+		t.Fatalf("EVA = %q", got)
+	}
+	if got := c.do(GetCommand, "b"); got != "5" {
+		t.Fatalf("GET b = %q", got)
+	}
+
+	sha := script.SHA(src)
+	if got := c.do(ScriptCommand, "EXISTS", sha); got != "1" {
+		t.Fatalf("SCR EXISTS = %q", got)
+	}
+	if got := c.do(EvalSHACommand, sha, "2", "a", "b", "fallback"); got != "7" {
+		t.Fatalf("EVS = %q", got)
+	}
+
+	c.do(ScriptCommand, "FLUSH")
+	if got := c.do(ScriptCommand, "EXISTS", sha); got != "0" {
+		t.Fatalf("SCR EXISTS after FLUSH = %q", got)
+	}
+}
+
+func TestScriptCacheEviction(t *testing.T) {
+	addr, stop := startTestServer(t, WithScriptCacheSize(40))
+	defer stop()
+
+	c := dialTestServer(t, addr)
+	// Three scripts of 16 bytes each, of which two fit.
+	first, second, third := "return 'first1'", "return 'second'", "return 'third3'"
+	for _, src := range []string{first, second} {
+		c.do(ScriptCommand, "LOAD", src)
+	}
+	// Running the first script makes the second the least recently used.
+	c.do(EvalSHACommand, script.SHA(first), "0")
+	c.do(ScriptCommand, "LOAD", third)
+
+	for src, want := range map[string]string{first: "1", second: "0", third: "1"} {
+		if got := c.do(ScriptCommand, "EXISTS", script.SHA(src)); got != want {
+			t.Errorf("SCR EXISTS %q = %q, want %s", src, got, want)
+		}
+	}
+}
+
+func TestScriptMemoryLimit(t *testing.T) {
+	addr, stop := startTestServer(t, WithScriptLimits(script.Limits{MaxStringSize: 1 << 20, MaxMemory: 4 << 20}))
+	defer stop()
+
+	c := dialTestServer(t, addr)
+	double := "local s = 'x' while true do s = s .. s end"
+	start := time.Now()
+	c.fail(EvalCommand, double, "0")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("EVA failed after %v", elapsed)
+	}
+}
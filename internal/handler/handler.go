@@ -3,10 +3,16 @@ package handler
 import (
 	"errors"
 	"fmt"
-	"io"
-	"log/slog"
 	"net"
-
+	"sync/atomic"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/acl"
+	"github.com/k1ender/go-stash/internal/auth"
+	"github.com/k1ender/go-stash/internal/config"
+	"github.com/k1ender/go-stash/internal/constants"
+	"github.com/k1ender/go-stash/internal/script"
+	"github.com/k1ender/go-stash/internal/slowlog"
 	"github.com/k1ender/go-stash/internal/store"
 )
 
@@ -18,33 +24,105 @@ type CommandHandler interface {
 	Handle(cmd []byte) (Response, error)
 }
 
-type Handler struct {
-	handlers map[Command]CommandHandler
+var ErrUnknownCommand = errors.New("unknown command")
+
+const (
+	DefaultScriptMaxSteps      = 100_000
+	DefaultScriptTimeout       = 50 * time.Millisecond
+	DefaultScriptMaxStringSize = 16 << 20
+	DefaultScriptMaxMemory     = 64 << 20
+	DefaultScriptCacheSize     = 32 << 20
+
+	DefaultSlowLogThreshold = 10 * time.Millisecond
+	DefaultSlowLogMaxLen    = 128
+)
+
+// storeCommands maps the commands that operate on a single key of the store
+// to their handler constructors, so transactions can bind them to a locked
+// view of the store.
+var storeCommands = map[Command]func(store.Store) CommandHandler{
+	GetCommand:  func(s store.Store) CommandHandler { return NewGetHandler(s) },
+	SetCommand:  func(s store.Store) CommandHandler { return NewSetHandler(s) },
+	IncrCommand: func(s store.Store) CommandHandler { return NewIncrHandler(s) },
+	DecrCommand: func(s store.Store) CommandHandler { return NewDecrHandler(s) },
+	DelCommand:  func(s store.Store) CommandHandler { return NewDelHandler(s) },
 }
 
-func NewHandler(store store.Store) *Handler {
-	handlers := make(map[Command]CommandHandler)
+type Handler struct {
+	handlers map[Command]*commandSpec
+	store    store.Store
+
+	middleware []Middleware
+	chain      HandlerFunc
+
+	scripts      scriptCache
+	scriptLimits atomic.Pointer[script.Limits]
 
-	getHandler := NewGetHandler(store)
-	handlers[GetCommand] = getHandler
+	authenticator *auth.Authenticator
+	acl           *acl.List
 
-	setHandler := NewSetHandler(store)
-	handlers[SetCommand] = setHandler
+	info      []InfoSection
+	processed atomic.Uint64
 
-	incrHandler := NewIncrHandler(store)
-	handlers[IncrCommand] = incrHandler
+	slowlog     *slowlog.Log
+	monitors    monitors
+	subscribers subscribers
+	clients     *Clients
+	config      *config.Runtime
+}
 
-	decrHandler := NewDecrHandler(store)
-	handlers[DecrCommand] = decrHandler
+type Arg func(h *Handler)
 
-	delHandler := NewDelHandler(store)
-	handlers[DelCommand] = delHandler
+// WithScriptLimits bounds the steps, the wall time and the memory of a
+// single EVA/EVS run.
+func WithScriptLimits(limits script.Limits) Arg {
+	return func(h *Handler) {
+		h.SetScriptLimits(limits)
+	}
+}
+
+// SetScriptLimits changes the limits of WithScriptLimits for scripts started
+// afterwards.
+func (h *Handler) SetScriptLimits(limits script.Limits) {
+	h.scriptLimits.Store(&limits)
+}
 
-	return &Handler{
-		handlers: handlers,
+// WithScriptCacheSize bounds the total size of the sources of cached
+// scripts. Zero disables the limit.
+func WithScriptCacheSize(bytes int) Arg {
+	return func(h *Handler) {
+		h.scripts.maxBytes = bytes
 	}
 }
 
+func NewHandler(store store.Store, args ...Arg) *Handler {
+	h := &Handler{
+		handlers: make(map[Command]*commandSpec),
+		store:    store,
+		acl:      acl.NewList(),
+		slowlog:  slowlog.New(DefaultSlowLogThreshold, DefaultSlowLogMaxLen),
+		clients:  NewClients(),
+	}
+	h.SetScriptLimits(script.Limits{
+		MaxSteps:      DefaultScriptMaxSteps,
+		Timeout:       DefaultScriptTimeout,
+		MaxStringSize: DefaultScriptMaxStringSize,
+		MaxMemory:     DefaultScriptMaxMemory,
+	})
+	h.scripts.maxBytes = DefaultScriptCacheSize
+	h.registerBuiltins()
+	h.registerCustom()
+
+	for _, arg := range args {
+		arg(h)
+	}
+
+	h.info = append(h.info, h.builtinInfo()...)
+	h.chain = chain(h.dispatch, h.builtinMiddleware()...)
+	h.chain = chain(h.chain, h.middleware...)
+	return h
+}
+
 // Handle processes a client connection by reading a command, dispatching it to the appropriate handler,
 // and sending the response back to the client.
 //
@@ -54,61 +132,86 @@ func NewHandler(store store.Store) *Handler {
 // Returns:
 //   - A boolean indicating whether the connection should be closed.
 //   - An error if any occurred during processing.
-func (h *Handler) Handle(client net.Conn) (bool, error) {
-	cmd, err := io.ReadAll(client)
+func (h *Handler) Handle(client *Conn) (bool, error) {
+	cmd, err := client.ReadCommand()
 	if err != nil {
-		h.fail(client)
+		if errors.Is(err, ErrMalformedFrame) || errors.Is(err, ErrFrameTooLarge) {
+			h.fail(client)
+		}
 		return true, fmt.Errorf("failed to read command from client: %w", err)
 	}
 
-	var response Response
+	return h.Execute(client, cmd)
+}
 
-	switch Command(cmd[:3]) {
-	case GetCommand:
-		slog.Debug("Received GET command")
-		handler := h.handlers[GetCommand]
-		response, err = handler.Handle(cmd[:])
-		if err != nil {
-			h.fail(client)
-			return false, fmt.Errorf("failed to handle GET command: %w", err)
-		}
-	case SetCommand:
-		slog.Debug("Received SET command")
-		handler := h.handlers[SetCommand]
-		response, err = handler.Handle(cmd[:])
-		if err != nil {
-			h.fail(client)
-			return false, fmt.Errorf("failed to handle SET command: %w", err)
-		}
-	case IncrCommand:
-		slog.Debug("Received INC command")
-		handler := h.handlers[IncrCommand]
-		response, err = handler.Handle(cmd[:])
-		if err != nil {
-			h.fail(client)
-			return false, fmt.Errorf("failed to handle INC command: %w", err)
-		}
-	case DecrCommand:
-		slog.Debug("Received DEC command")
-		handler := h.handlers[DecrCommand]
-		response, err = handler.Handle(cmd[:])
-		if err != nil {
-			h.fail(client)
-			return false, fmt.Errorf("failed to handle DEC command: %w", err)
-		}
-	case DelCommand:
-		slog.Debug("Received DEL command")
-		handler := h.handlers[DelCommand]
-		response, err = handler.Handle(cmd[:])
-		if err != nil {
-			h.fail(client)
-			return false, fmt.Errorf("failed to handle DEL command: %w", err)
-		}
-	default:
+// Execute runs a single complete frame on behalf of client and writes the
+// reply to it. Handle uses it after reading a frame; event loops that read
+// the socket themselves call it directly.
+//
+// Returns the same values as Handle.
+func (h *Handler) Execute(client *Conn, cmd []byte) (bool, error) {
+	if client.monitor.Load() != nil {
+		return true, errMonitoring
+	}
+	if client.subscriber.Load() != nil {
+		return true, errSubscribed
+	}
+
+	response, err := h.Do(client, cmd)
+	if err != nil {
 		h.fail(client)
-		return false, errors.New("unknown command")
+		return false, fmt.Errorf("failed to handle %s command: %w", cmd[:min(len(cmd), constants.CommandKeyLen)], err)
 	}
 
+	return h.reply(client, response)
+}
+
+// Slow reports whether the command of a complete frame is flagged FlagSlow.
+// Event loops run such commands on another goroutine, so that they do not
+// stall the other connections of the loop.
+func (h *Handler) Slow(cmd []byte) bool {
+	if len(cmd) < constants.CommandKeyLen {
+		return false
+	}
+	spec := h.handlers[Command(cmd[:constants.CommandKeyLen])]
+	return spec != nil && spec.Flags&FlagSlow != 0
+}
+
+// Do runs a single complete frame on behalf of client like Execute, but
+// returns the reply instead of writing it, for gateways that encode replies
+// in their own format.
+func (h *Handler) Do(client *Conn, cmd []byte) (Response, error) {
+	if len(cmd) < constants.CommandKeyLen {
+		return nil, ErrMalformedFrame
+	}
+
+	req := &Request{
+		Conn:    client,
+		Command: Command(cmd[:constants.CommandKeyLen]),
+		Frame:   cmd,
+	}
+	req.spec = h.handlers[req.Command]
+	h.processed.Add(1)
+	client.touch(req.Command)
+
+	return h.chain(req)
+}
+
+// dispatch is the innermost HandlerFunc of the chain: it queues the request
+// if a transaction is open, and otherwise runs its command.
+func (h *Handler) dispatch(req *Request) (Response, error) {
+	req.Conn.Logger().Debug("received command", "command", req.Command.String())
+
+	if req.queued() {
+		return h.queue(req)
+	}
+	if req.spec == nil {
+		return nil, ErrUnknownCommand
+	}
+	return req.spec.handle(req)
+}
+
+func (h *Handler) reply(client *Conn, response Response) (bool, error) {
 	data, err := response.Serialize()
 	if err != nil {
 		h.fail(client)
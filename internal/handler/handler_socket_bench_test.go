@@ -11,7 +11,7 @@ import (
 	"github.com/k1ender/go-stash/internal/store"
 )
 
-func startTestServer(tb testing.TB) (addr string, stop func()) {
+func startTestServer(tb testing.TB, args ...Arg) (addr string, stop func()) {
 	tb.Helper()
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -19,7 +19,7 @@ func startTestServer(tb testing.TB) (addr string, stop func()) {
 	}
 
 	store := store.NewShardedStore(0)
-	h := NewHandler(store)
+	h := NewHandler(store, args...)
 
 	go func() {
 		for {
@@ -27,10 +27,14 @@ func startTestServer(tb testing.TB) (addr string, stop func()) {
 			if err != nil {
 				return
 			}
-			go func(c net.Conn) {
+			go func(c *Conn) {
 				defer c.Close()
-				h.Handle(c)
-			}(conn)
+				for {
+					if isFatal, _ := h.Handle(c); isFatal {
+						return
+					}
+				}
+			}(NewConn(conn))
 		}
 	}()
 	return ln.Addr().String(), func() { ln.Close() }
@@ -49,7 +53,7 @@ func BenchmarkSocketGetHandler(b *testing.B) {
 	defer conn.Close()
 
 	cmd := []byte("GET\x00" + strconv.Itoa(len("foo")) + "\x00foo\r\n")
-	
+
 	for b.Loop() {
 		conn.Write(cmd)
 		buf := make([]byte, 128)
@@ -71,7 +75,6 @@ func BenchmarkSocketSetHandler(b *testing.B) {
 
 	cmd := []byte("SET\x00" + strconv.Itoa(len("foo")) + "\x00foo\x00" + strconv.Itoa(len("bar")) + "\x00bar\r\n")
 
-	
 	for b.Loop() {
 		conn.Write(cmd)
 		buf := make([]byte, 128)
@@ -99,7 +102,6 @@ func BenchmarkSocketIncrHandler(b *testing.B) {
 
 	cmd := []byte("INC\x00" + strconv.Itoa(len("foo")) + "\x00foo\r\n")
 
-	
 	for b.Loop() {
 		conn.Write(cmd)
 		conn.Read(buf)
@@ -126,7 +128,6 @@ func BenchmarkSocketDecrHandler(b *testing.B) {
 
 	cmd := []byte("DEC\x00" + strconv.Itoa(len("foo")) + "\x00foo\r\n")
 
-	
 	for b.Loop() {
 		conn.Write(cmd)
 		conn.Read(buf)
@@ -150,7 +151,6 @@ func BenchmarkSocketDelHandler(b *testing.B) {
 	cmd := []byte("DEL\x00" + strconv.Itoa(len("foo")) + "\x00foo\r\n")
 	buf := make([]byte, 128)
 
-	
 	for b.Loop() {
 		conn.Write(setCmd)
 		conn.Read(buf)
@@ -173,7 +173,6 @@ func BenchmarkSocketRandomKeyInserts(b *testing.B) {
 
 	buf := make([]byte, 128)
 
-	
 	for i := 0; b.Loop(); i++ {
 		key := fmt.Sprintf("key_%d_%d", i, rand.Intn(10000))
 		value := fmt.Sprintf("value_%d", rand.Intn(1000))
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/k1ender/go-stash/internal/store"
+)
+
+// INF [section] answers with a list of lines describing the server. Each
+// section starts with a "# Name" line followed by "field:value" lines, and
+// sections are separated by an empty line. Without an argument, or with
+// "all", every section is returned; otherwise only the named one, matched
+// case-insensitively. An unknown section yields an empty list.
+//
+// The handler itself provides the stats and keyspace sections; the server
+// adds the others with WithInfo.
+
+var errInfoArgs = errors.New("expected at most one section for INFO")
+
+// InfoField is one "name:value" line of INFO.
+type InfoField struct {
+	Name  string
+	Value string
+}
+
+// InfoSection is a named group of INFO fields. Fields is called every time
+// the section is requested.
+type InfoSection struct {
+	Name   string
+	Fields func() []InfoField
+}
+
+// WithInfo adds sections to the output of INF. Sections are listed in the
+// order they are added, before the handler's own. Fields of sections with
+// the same name are merged into one section.
+func WithInfo(sections ...InfoSection) Arg {
+	return func(h *Handler) {
+		h.info = append(h.info, sections...)
+	}
+}
+
+// CommandsProcessed returns the number of frames the handler has executed.
+func (h *Handler) CommandsProcessed() uint64 {
+	return h.processed.Load()
+}
+
+// builtinInfo returns the sections describing the handler and its store.
+func (h *Handler) builtinInfo() []InfoSection {
+	return []InfoSection{
+		{Name: "Stats", Fields: func() []InfoField {
+			return []InfoField{
+				{"total_commands_processed", strconv.FormatUint(h.CommandsProcessed(), 10)},
+				{"pubsub_channels", strconv.Itoa(h.subscribers.count())},
+			}
+		}},
+		{Name: "Keyspace", Fields: h.keyspaceInfo},
+	}
+}
+
+// keyspaceInfo reports the single logical database and, for stores that
+// can tell, how keys are spread over the shards.
+func (h *Handler) keyspaceInfo() []InfoField {
+	st, ok := h.store.(store.StatsReporter)
+	if !ok {
+		return nil
+	}
+
+	stats := st.Stats()
+	var keys, bytes int
+	for _, s := range stats {
+		keys += s.Keys
+		bytes += s.Bytes
+	}
+
+	fields := []InfoField{
+		{"db0", "keys=" + strconv.Itoa(keys) + ",bytes=" + strconv.Itoa(bytes)},
+		{"shards", strconv.Itoa(len(stats))},
+	}
+	for i, s := range stats {
+		fields = append(fields, InfoField{
+			"shard" + strconv.Itoa(i),
+			"keys=" + strconv.Itoa(s.Keys) + ",bytes=" + strconv.Itoa(s.Bytes),
+		})
+	}
+	return fields
+}
+
+func (h *Handler) infoCommand(req *Request) (Response, error) {
+	args, err := DeserializeArgs(req.Frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 1 {
+		return nil, errInfoArgs
+	}
+	want := "all"
+	if len(args) == 1 {
+		want = strings.ToLower(args[0])
+	}
+
+	var names []string
+	fields := make(map[string][]InfoField)
+	for _, section := range h.info {
+		key := strings.ToLower(section.Name)
+		if want != "all" && want != key {
+			continue
+		}
+		if _, ok := fields[key]; !ok {
+			names = append(names, section.Name)
+		}
+		fields[key] = append(fields[key], section.Fields()...)
+	}
+
+	var lines []string
+	for i, name := range names {
+		if i > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "# "+name)
+		for _, f := range fields[strings.ToLower(name)] {
+			lines = append(lines, f.Name+":"+f.Value)
+		}
+	}
+	return &ListResponse{Lines: lines}, nil
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// list sends a command answered with a ListResponse and returns its lines.
+func (c *testClient) list(command Command, args ...string) []string {
+	c.tb.Helper()
+	n, err := strconv.Atoi(c.do(command, args...))
+	if err != nil {
+		c.tb.Fatalf("list length: %v", err)
+	}
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = c.line()
+	}
+	return lines
+}
+
+func TestInfo(t *testing.T) {
+	addr, stop := startTestServer(t, WithInfo(
+		InfoSection{Name: "Server", Fields: func() []InfoField {
+			return []InfoField{{"version", "test"}}
+		}},
+		InfoSection{Name: "Stats", Fields: func() []InfoField {
+			return []InfoField{{"instantaneous_ops_per_sec", "0"}}
+		}},
+	))
+	defer stop()
+
+	c := dialTestServer(t, addr)
+	c.do(SetCommand, "key", "value")
+
+	all := c.list(InfoCommand)
+	for _, want := range []string{"# Server", "version:test", "", "# Stats", "# Keyspace", "db0:keys=1,bytes=48"} {
+		if !slices.Contains(all, want) {
+			t.Errorf("INF lacks %q in %q", want, all)
+		}
+	}
+
+	want := []string{"# Stats", "instantaneous_ops_per_sec:0", "total_commands_processed:3", "pubsub_channels:0"}
+	if got := c.list(InfoCommand, "stats"); !slices.Equal(got, want) {
+		t.Errorf("INF stats = %q, want %q", got, want)
+	}
+	if got := c.list(InfoCommand, "nope"); len(got) != 0 {
+		t.Errorf("INF nope = %q", got)
+	}
+	c.fail(InfoCommand, "server", "stats")
+}
@@ -0,0 +1,119 @@
+package handler
+
+// Request is a single command received from a client.
+type Request struct {
+	Conn    *Conn
+	Command Command
+	// Frame is the complete frame, including the command and the trailing
+	// CRLF. It is only valid until the request returns.
+	Frame []byte
+	// Decoded is the value a custom command's arguments decode to, see
+	// CustomCommand.Decode. It is set before the command runs.
+	Decoded any
+
+	spec    *commandSpec
+	decoded bool
+}
+
+// Known reports whether the request names a registered command. Middleware
+// should not use the command of unknown requests as a label, since clients
+// choose it freely.
+func (r *Request) Known() bool {
+	return r.spec != nil
+}
+
+// queued reports whether the request is queued in an open transaction
+// instead of being run.
+func (r *Request) queued() bool {
+	return r.Conn.tx != nil && (r.spec == nil || r.spec.Flags&FlagTx == 0)
+}
+
+// decode sets Decoded for custom commands, unless it is set already.
+func (r *Request) decode() error {
+	if r.decoded || r.spec == nil || r.spec.decode == nil {
+		return nil
+	}
+	args, err := DeserializeArgs(r.Frame)
+	if err != nil {
+		return err
+	}
+	if r.Decoded, err = r.spec.decode(args); err != nil {
+		return err
+	}
+	r.decoded = true
+	return nil
+}
+
+// keys returns the keys the request accesses, or nil if its command has
+// none.
+func (r *Request) keys() ([]string, error) {
+	switch {
+	case r.spec == nil:
+		return nil, nil
+	case r.spec.decode != nil:
+		if r.spec.decodedKeys == nil {
+			return nil, nil
+		}
+		if err := r.decode(); err != nil {
+			return nil, err
+		}
+		return r.spec.decodedKeys(r.Decoded), nil
+	case r.spec.keys != nil:
+		args, err := DeserializeArgs(r.Frame)
+		if err != nil {
+			return nil, err
+		}
+		return r.spec.keys(args)
+	}
+	return nil, nil
+}
+
+// HandlerFunc runs a request and returns its reply. A returned error is
+// answered with ERR.
+type HandlerFunc func(req *Request) (Response, error)
+
+// Middleware wraps the execution of every command. It may inspect or modify
+// the request, answer it without calling next, or observe the reply and
+// error returned by next.
+//
+// Commands queued in a transaction pass through the middleware when they are
+// queued. EXE runs them, like the writes of scripts, only through the
+// handler's own slow log, monitor and keyspace notification middleware,
+// which skip commands while they are queued.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// WithMiddleware adds middleware around command execution. The first
+// middleware given is the outermost. Middleware added by the handler itself,
+// such as authentication and access control, runs inside of it.
+func WithMiddleware(middleware ...Middleware) Arg {
+	return func(h *Handler) {
+		h.middleware = append(h.middleware, middleware...)
+	}
+}
+
+// chain wraps next in middleware, the first being the outermost.
+func chain(next HandlerFunc, middleware ...Middleware) HandlerFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		next = middleware[i](next)
+	}
+	return next
+}
+
+// builtinMiddleware returns the middleware the handler's own configuration
+// calls for.
+func (h *Handler) builtinMiddleware() []Middleware {
+	// Monitors only see commands that pass authentication and the ACL,
+	// while the slow log times those checks too.
+	middleware := []Middleware{h.recordSlow}
+	if h.authenticator != nil {
+		middleware = append(middleware, h.requireAuth)
+	}
+	return append(middleware, h.enforceACL, h.feedMonitors, h.notifyKeyspace)
+}
+
+// observe wraps next in the middleware that records what ran, for commands
+// that run without passing through the chain: those queued by EXE and the
+// writes of scripts.
+func (h *Handler) observe(next HandlerFunc) HandlerFunc {
+	return chain(next, h.recordSlow, h.feedMonitors, h.notifyKeyspace)
+}
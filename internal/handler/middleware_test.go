@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+	record := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(req *Request) (Response, error) {
+				mu.Lock()
+				calls = append(calls, name+" "+req.Command.String())
+				mu.Unlock()
+				return next(req)
+			}
+		}
+	}
+	denyDel := func(next HandlerFunc) HandlerFunc {
+		return func(req *Request) (Response, error) {
+			if req.Command == DelCommand {
+				return nil, errors.New("denied")
+			}
+			return next(req)
+		}
+	}
+
+	addr, stop := startTestServer(t, WithMiddleware(record("outer"), record("inner"), denyDel))
+	defer stop()
+
+	c := dialTestServer(t, addr)
+	if got := c.do(SetCommand, "key", "value"); got != "OK" {
+		t.Fatalf("SET = %q", got)
+	}
+	c.fail(DelCommand, "key")
+	if got := c.do(GetCommand, "key"); got != "value" {
+		t.Fatalf("GET after denied DEL = %q", got)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"outer SET", "inner SET", "outer DEL", "inner DEL", "outer GET", "inner GET"}
+	if !slices.Equal(calls, want) {
+		t.Fatalf("calls = %q, want %q", calls, want)
+	}
+}
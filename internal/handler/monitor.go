@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MON turns the connection into a monitor: it is answered with OK, followed
+// by a line for every command any client runs from then on:
+//
+//	1760871600.123456 [0 127.0.0.1:53412] "SET" "key" "value"
+//
+// The line holds the time the command was received in seconds, the
+// database and address of the client and the quoted arguments. Arguments of
+// AUT are not shown. When a monitor falls behind by more than
+// monitorBuffer lines, further lines are dropped instead of slowing down
+// other clients, and a "# dropped <n> events" line reports the gap once the
+// monitor catches up.
+//
+// A monitor stays attached until it disconnects. Sending any other command
+// closes the connection.
+
+// monitorBuffer is the number of lines queued for a monitor.
+const monitorBuffer = 1024
+
+var errMonitoring = errors.New("connection is in MONITOR mode")
+
+// monitors is the set of attached monitors. Feeding commands costs a single
+// atomic load while it is empty.
+type monitors struct {
+	n   atomic.Int32
+	mu  sync.RWMutex
+	set map[*monitor]struct{}
+}
+
+type monitor struct {
+	conn    *Conn
+	events  chan []byte
+	done    chan struct{}
+	stop    sync.Once
+	dropped atomic.Uint64
+}
+
+func (ms *monitors) add(m *monitor) {
+	ms.mu.Lock()
+	if ms.set == nil {
+		ms.set = make(map[*monitor]struct{})
+	}
+	ms.set[m] = struct{}{}
+	ms.n.Store(int32(len(ms.set)))
+	ms.mu.Unlock()
+}
+
+func (ms *monitors) remove(m *monitor) {
+	ms.mu.Lock()
+	delete(ms.set, m)
+	ms.n.Store(int32(len(ms.set)))
+	ms.mu.Unlock()
+}
+
+// feed sends line to every monitor except the one of from, dropping it for
+// monitors whose queue is full.
+func (ms *monitors) feed(from *Conn, line []byte) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for m := range ms.set {
+		if m.conn == from {
+			continue
+		}
+		select {
+		case m.events <- line:
+		default:
+			m.dropped.Add(1)
+		}
+	}
+}
+
+// feedMonitors passes every command to the attached monitors before it
+// runs. It comes after requireAuth and enforceACL, so refused commands are
+// not shown.
+func (h *Handler) feedMonitors(next HandlerFunc) HandlerFunc {
+	return func(req *Request) (Response, error) {
+		if h.monitors.n.Load() > 0 && !req.queued() {
+			h.monitors.feed(req.Conn, monitorLine(req))
+		}
+		return next(req)
+	}
+}
+
+func monitorLine(req *Request) []byte {
+	now := time.Now()
+	line := strconv.AppendInt(nil, now.Unix(), 10)
+	line = append(line, '.')
+	micros := strconv.Itoa(now.Nanosecond() / 1000)
+	for range 6 - len(micros) {
+		line = append(line, '0')
+	}
+	line = append(line, micros...)
+	line = append(line, " [0 "...)
+	line = append(line, req.Conn.RemoteAddr().String()...)
+	line = append(line, "] "...)
+	line = strconv.AppendQuote(line, req.Command.String())
+
+	if req.Command == AuthCommand {
+		line = append(line, " (redacted)"...)
+	} else if args, err := DeserializeArgs(req.Frame); err == nil {
+		for _, arg := range args {
+			line = append(line, ' ')
+			line = strconv.AppendQuote(line, arg)
+		}
+	}
+	return append(line, '\r', '\n')
+}
+
+func (h *Handler) monitor(req *Request) (Response, error) {
+	args, err := DeserializeArgs(req.Frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 0 {
+		return nil, errors.New("MONITOR takes no arguments")
+	}
+
+	m := &monitor{
+		conn:   req.Conn,
+		events: make(chan []byte, monitorBuffer),
+		done:   make(chan struct{}),
+	}
+	// The monitor writes to the socket from its own goroutine, so even the
+	// OK goes through it to stay in order with the events.
+	m.events <- []byte("OK\r\n")
+	req.Conn.monitor.Store(m)
+	h.monitors.add(m)
+	go h.runMonitor(m)
+
+	return noReply{}, nil
+}
+
+// runMonitor writes queued lines to the monitor's socket until it is closed
+// or a write fails.
+func (h *Handler) runMonitor(m *monitor) {
+	defer h.monitors.remove(m)
+
+	for {
+		select {
+		case line := <-m.events:
+			if n := m.dropped.Swap(0); n > 0 {
+				line = append([]byte("# dropped "+strconv.FormatUint(n, 10)+" events\r\n"), line...)
+			}
+			if _, err := m.conn.writeDirect(line); err != nil {
+				m.conn.Close()
+				return
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *monitor) close() {
+	m.stop.Do(func() { close(m.done) })
+}
+
+// noReply is returned by commands that write their reply themselves.
+type noReply struct{}
+
+func (noReply) Serialize() ([]byte, error) {
+	return nil, nil
+}
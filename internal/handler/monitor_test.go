@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/auth"
+)
+
+func TestMonitor(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+
+	mon := dialTestServer(t, addr)
+	if got := mon.do(MonitorCommand); got != "OK" {
+		t.Fatalf("MON = %q", got)
+	}
+
+	c := dialTestServer(t, addr)
+	c.do(SetCommand, "key", "tab\there")
+	c.fail(AuthCommand, "user", "secret")
+	// Queued commands show up when EXE runs them, and the writes of scripts
+	// after the script.
+	c.do(MultiCommand)
+	c.do(IncrCommand, "n")
+	c.do(ExecCommand)
+	c.line()
+	c.do(EvalCommand, "set(KEYS[1], ARGV[1]) return 1", "1", "other", "v")
+
+	for _, want := range []string{
+		`^\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] "SET" "key" "tab\\there"$`,
+		`^\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] "AUT" \(redacted\)$`,
+		`^\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] "MUL"$`,
+		`^\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] "EXE"$`,
+		`^\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] "INC" "n"$`,
+		`^\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] "EVA" "set\(KEYS\[1\], ARGV\[1\]\) return 1" "1" "other" "v"$`,
+		`^\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] "SET" "other" "v"$`,
+	} {
+		if got := mon.line(); !regexp.MustCompile(want).MatchString(got) {
+			t.Fatalf("monitor line %q does not match %s", got, want)
+		}
+	}
+
+	// Any command ends the monitor.
+	mon.conn.Write(SerializeArgs(GetCommand, "key"))
+	mon.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := mon.r.ReadByte(); err == nil {
+		t.Fatal("monitor still open after sending a command")
+	}
+
+	// Commands keep working without monitors.
+	if got := c.do(GetCommand, "key"); got != "tab\there" {
+		t.Fatalf("GET = %q", got)
+	}
+}
+
+func TestMonitorAuth(t *testing.T) {
+	hash, err := auth.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := auth.NewAuthenticator(map[string]string{auth.DefaultUser: hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, stop := startTestServer(t, WithAuthenticator(a))
+	defer stop()
+
+	mon := dialTestServer(t, addr)
+	mon.do(AuthCommand, "secret")
+	if got := mon.do(MonitorCommand); got != "OK" {
+		t.Fatalf("MON = %q", got)
+	}
+
+	// Commands refused for lack of authentication are not shown.
+	c := dialTestServer(t, addr)
+	c.fail(SetCommand, "key", "hidden")
+	c.do(AuthCommand, "secret")
+	c.do(SetCommand, "key", "shown")
+
+	for _, want := range []string{
+		`^\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] "AUT" \(redacted\)$`,
+		`^\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] "SET" "key" "shown"$`,
+	} {
+		if got := mon.line(); !regexp.MustCompile(want).MatchString(got) {
+			t.Fatalf("monitor line %q does not match %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strconv"
+
+	"github.com/k1ender/go-stash/internal/store"
+)
+
+// Transactions
+//
+//	MUL\r\n                         start queueing commands
+//	EXE\r\n                         run the queued commands atomically
+//	DIS\r\n                         drop the queued commands
+//	WAT(\0<keyLen>\0<key>)+\r\n     abort the next EXE if any key changes
+//	UNW\r\n                         forget all watched keys
+//
+// While a transaction is open every command other than the above is
+// answered with QUEUED. EXE answers with the number of replies on its own
+// line followed by the reply of each queued command, or with ABORTED if a
+// watched key was modified.
+
+var (
+	errNestedMulti      = errors.New("MULTI calls can not be nested")
+	errExecWithoutTx    = errors.New("EXEC without MULTI")
+	errDiscardWithoutTx = errors.New("DISCARD without MULTI")
+	errWatchInsideTx    = errors.New("WATCH inside MULTI is not allowed")
+	errTxDiscarded      = errors.New("transaction discarded because of previous errors")
+	errNotTransactable  = errors.New("store does not support transactions")
+	errWatchNoKeys      = errors.New("WATCH requires at least one key")
+	errNotQueueable     = errors.New("command can not be used inside MULTI")
+)
+
+type transaction struct {
+	// queued holds copies of the queued requests, with their own frames.
+	queued []*Request
+	failed bool
+}
+
+type TxResponse struct {
+	Value string
+}
+
+func (r *TxResponse) Serialize() ([]byte, error) {
+	return []byte(r.Value + "\r\n"), nil
+}
+
+type ExecResponse struct {
+	Replies [][]byte
+}
+
+func (r *ExecResponse) Serialize() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(strconv.Itoa(len(r.Replies)))
+	buf.WriteString("\r\n")
+	for _, reply := range r.Replies {
+		buf.Write(reply)
+	}
+	return buf.Bytes(), nil
+}
+
+// queue appends a command to the client's open transaction. Unknown commands
+// and commands that can not run in a transaction are rejected immediately
+// and make the following EXEC fail.
+func (h *Handler) queue(req *Request) (Response, error) {
+	tx := req.Conn.tx
+	if req.spec == nil {
+		tx.failed = true
+		return nil, ErrUnknownCommand
+	}
+	if req.spec.bind == nil {
+		tx.failed = true
+		return nil, errNotQueueable
+	}
+
+	// Copied along with the decoded arguments of custom commands, so EXE
+	// does not decode them again.
+	queued := *req
+	queued.Frame = slices.Clone(req.Frame)
+	tx.queued = append(tx.queued, &queued)
+	return &TxResponse{Value: "QUEUED"}, nil
+}
+
+func (h *Handler) multi(req *Request) (Response, error) {
+	client := req.Conn
+	if client.tx != nil {
+		return nil, errNestedMulti
+	}
+	client.tx = &transaction{}
+	return &TxResponse{Value: "OK"}, nil
+}
+
+func (h *Handler) discard(req *Request) (Response, error) {
+	client := req.Conn
+	if client.tx == nil {
+		return nil, errDiscardWithoutTx
+	}
+	client.tx = nil
+	client.watched = nil
+	return &TxResponse{Value: "OK"}, nil
+}
+
+func (h *Handler) watch(req *Request) (Response, error) {
+	client := req.Conn
+	if client.tx != nil {
+		return nil, errWatchInsideTx
+	}
+
+	keys, err := DeserializeArgs(req.Frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errWatchNoKeys
+	}
+
+	ts, ok := h.store.(store.Transactional)
+	if !ok {
+		return nil, errNotTransactable
+	}
+
+	if client.watched == nil {
+		client.watched = make(map[string]uint64, len(keys))
+	}
+	for _, key := range keys {
+		if _, ok := client.watched[key]; !ok {
+			client.watched[key] = ts.Version(key)
+		}
+	}
+	return &TxResponse{Value: "OK"}, nil
+}
+
+func (h *Handler) unwatch(req *Request) (Response, error) {
+	req.Conn.watched = nil
+	return &TxResponse{Value: "OK"}, nil
+}
+
+// exec runs the queued commands while holding the locks of every key they
+// and the watched keys touch. Commands that fail at runtime produce an error
+// reply but do not roll back the ones before them.
+func (h *Handler) exec(req *Request) (Response, error) {
+	client := req.Conn
+	tx, watched := client.tx, client.watched
+	client.tx, client.watched = nil, nil
+
+	if tx == nil {
+		return nil, errExecWithoutTx
+	}
+	if tx.failed {
+		return nil, errTxDiscarded
+	}
+
+	ts, ok := h.store.(store.Transactional)
+	if !ok {
+		return nil, errNotTransactable
+	}
+
+	keys := make([]string, 0, len(tx.queued)+len(watched))
+	for key := range watched {
+		keys = append(keys, key)
+	}
+	for _, q := range tx.queued {
+		if queuedKeys, err := q.keys(); err == nil {
+			keys = append(keys, queuedKeys...)
+		}
+	}
+
+	aborted := false
+	replies := make([][]byte, 0, len(tx.queued))
+	err := ts.Atomic(keys, func(view store.Tx) error {
+		for key, version := range watched {
+			if view.Version(key) != version {
+				aborted = true
+				return nil
+			}
+		}
+
+		for _, q := range tx.queued {
+			replies = append(replies, h.runQueued(view, q))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if aborted {
+		return &TxResponse{Value: "ABORTED"}, nil
+	}
+	return &ExecResponse{Replies: replies}, nil
+}
+
+func (h *Handler) runQueued(view store.Store, q *Request) []byte {
+	failed := append(slices.Clone(ErrResponse), '\r', '\n')
+
+	response, err := h.observe(q.spec.bind(view))(q)
+	if err != nil {
+		return failed
+	}
+
+	data, err := response.Serialize()
+	if err != nil {
+		return failed
+	}
+	return data
+}
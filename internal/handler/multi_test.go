@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+type testClient struct {
+	tb   testing.TB
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTestServer(tb testing.TB, addr string) *testClient {
+	tb.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		tb.Fatalf("dial: %v", err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return &testClient{tb: tb, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends a command and returns the first line of the reply.
+func (c *testClient) do(command Command, args ...string) string {
+	c.tb.Helper()
+	if _, err := c.conn.Write(SerializeArgs(command, args...)); err != nil {
+		c.tb.Fatalf("write: %v", err)
+	}
+	return c.line()
+}
+
+func (c *testClient) line() string {
+	c.tb.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.tb.Fatalf("read: %v", err)
+	}
+	return line[:len(line)-2]
+}
+
+func TestMultiExec(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+
+	c := dialTestServer(t, addr)
+
+	if got := c.do(SetCommand, "counter", "41"); got != "OK" {
+		t.Fatalf("SET = %q", got)
+	}
+	if got := c.do(MultiCommand); got != "OK" {
+		t.Fatalf("MUL = %q", got)
+	}
+	if got := c.do(IncrCommand, "counter"); got != "QUEUED" {
+		t.Fatalf("INC = %q", got)
+	}
+	if got := c.do(SetCommand, "related", "x"); got != "QUEUED" {
+		t.Fatalf("SET = %q", got)
+	}
+	if got := c.do(ExecCommand); got != "2" {
+		t.Fatalf("EXE = %q", got)
+	}
+	if got := c.line(); got != "42" {
+		t.Fatalf("INC reply = %q", got)
+	}
+	if got := c.line(); got != "OK" {
+		t.Fatalf("SET reply = %q", got)
+	}
+	if got := c.do(GetCommand, "related"); got != "x" {
+		t.Fatalf("GET = %q", got)
+	}
+}
+
+func TestWatchAbortsExec(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+
+	c := dialTestServer(t, addr)
+	other := dialTestServer(t, addr)
+
+	c.do(SetCommand, "balance", "10")
+	if got := c.do(WatchCommand, "balance"); got != "OK" {
+		t.Fatalf("WAT = %q", got)
+	}
+	other.do(SetCommand, "balance", "20")
+
+	c.do(MultiCommand)
+	c.do(SetCommand, "balance", "0")
+	if got := c.do(ExecCommand); got != "ABORTED" {
+		t.Fatalf("EXE = %q, want ABORTED", got)
+	}
+	if got := c.do(GetCommand, "balance"); got != "20" {
+		t.Fatalf("GET = %q", got)
+	}
+
+	// The watch is cleared by EXEC, so the retry goes through.
+	c.do(MultiCommand)
+	c.do(SetCommand, "balance", "0")
+	if got := c.do(ExecCommand); got != "1" {
+		t.Fatalf("EXE = %q", got)
+	}
+}
+
+func TestWatchMissingKeyAbortsAfterSetAndDel(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+
+	c := dialTestServer(t, addr)
+	other := dialTestServer(t, addr)
+
+	if got := c.do(WatchCommand, "lock"); got != "OK" {
+		t.Fatalf("WAT = %q", got)
+	}
+	// The key is missing again when EXE runs, but it was written meanwhile.
+	other.do(SetCommand, "lock", "taken")
+	other.do(DelCommand, "lock")
+
+	c.do(MultiCommand)
+	c.do(SetCommand, "lock", "mine")
+	if got := c.do(ExecCommand); got != "ABORTED" {
+		t.Fatalf("EXE = %q, want ABORTED", got)
+	}
+}
@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Publish/subscribe
+//
+//	PUB\0<len>\0<channel>\0<len>\0<message>\r\n
+//	SUB(\0<len>\0<channel>)+\r\n
+//
+// PUB sends message to the clients subscribed to channel and answers the
+// number of clients it was sent to.
+//
+// SUB turns the connection into a subscriber of the channels: it is answered
+// with OK, followed by a frame for every message published to one of them:
+//
+//	MSG\0<len>\0<channel>\0<len>\0<message>\r\n
+//
+// Every SET, INC, DEC and DEL also publishes a keyspace notification, the
+// lowercase name of the command on the channel __keyspace__:<key>, so
+// clients can follow changes of a key. Commands run by EXE publish theirs
+// when EXE runs them, and so do the writes of scripts.
+//
+// When a subscriber falls behind by more than subscriberBuffer messages,
+// further messages are dropped instead of slowing down publishers, and a
+// message on the channel __dropped__ holding their number reports the gap
+// once the subscriber catches up. Like a monitor, a subscriber stays
+// subscribed until it disconnects, and sending any other command closes the
+// connection.
+//
+// ACL rules treat channels as keys: a keyspace channel as the key it reports
+// on and any other channel as its name.
+
+const (
+	// subscriberBuffer is the number of messages queued for a subscriber.
+	subscriberBuffer = 1024
+
+	// KeyspacePrefix starts the channels of keyspace notifications.
+	KeyspacePrefix = "__keyspace__:"
+	// DroppedChannel is the channel reporting messages a subscriber missed.
+	DroppedChannel = "__dropped__"
+)
+
+var (
+	errSubscribed = errors.New("connection is subscribed")
+	errPubArgs    = errors.New("expected PUBLISH <channel> <message>")
+	errSubArgs    = errors.New("expected SUBSCRIBE <channel>...")
+)
+
+// keyspaceEvents names the notification published by each command that
+// changes a key.
+var keyspaceEvents = map[Command]string{
+	SetCommand:  "set",
+	IncrCommand: "incr",
+	DecrCommand: "decr",
+	DelCommand:  "del",
+}
+
+// subscribers holds the subscribers of every channel. Publishing costs a
+// single atomic load while there are none.
+type subscribers struct {
+	n        atomic.Int32
+	mu       sync.RWMutex
+	channels map[string]map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	conn     *Conn
+	channels []string
+	events   chan []byte
+	done     chan struct{}
+	stop     sync.Once
+	dropped  atomic.Uint64
+}
+
+func (ss *subscribers) add(s *subscriber) {
+	ss.mu.Lock()
+	if ss.channels == nil {
+		ss.channels = make(map[string]map[*subscriber]struct{})
+	}
+	for _, channel := range s.channels {
+		if ss.channels[channel] == nil {
+			ss.channels[channel] = make(map[*subscriber]struct{})
+		}
+		ss.channels[channel][s] = struct{}{}
+	}
+	ss.n.Add(1)
+	ss.mu.Unlock()
+}
+
+func (ss *subscribers) remove(s *subscriber) {
+	ss.mu.Lock()
+	for _, channel := range s.channels {
+		delete(ss.channels[channel], s)
+		if len(ss.channels[channel]) == 0 {
+			delete(ss.channels, channel)
+		}
+	}
+	ss.n.Add(-1)
+	ss.mu.Unlock()
+}
+
+// count returns the number of channels with subscribers.
+func (ss *subscribers) count() int {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return len(ss.channels)
+}
+
+// publish queues message for the subscribers of channel, dropping it for
+// those whose queue is full, and returns the number it was queued for.
+func (ss *subscribers) publish(channel, message string) int {
+	if ss.n.Load() == 0 {
+		return 0
+	}
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	subs := ss.channels[channel]
+	if len(subs) == 0 {
+		return 0
+	}
+
+	frame := SerializeArgs(MessageCommand, channel, message)
+	n := 0
+	for s := range subs {
+		select {
+		case s.events <- frame:
+			n++
+		default:
+			s.dropped.Add(1)
+		}
+	}
+	return n
+}
+
+// notifyKeyspace publishes a keyspace notification for every command that
+// changed a key.
+func (h *Handler) notifyKeyspace(next HandlerFunc) HandlerFunc {
+	return func(req *Request) (Response, error) {
+		resp, err := next(req)
+		if err != nil || h.subscribers.n.Load() == 0 || req.queued() {
+			return resp, err
+		}
+		if event, ok := keyspaceEvents[req.Command]; ok {
+			if args, err := DeserializeArgs(req.Frame); err == nil && len(args) > 0 {
+				h.subscribers.publish(KeyspacePrefix+args[0], event)
+			}
+		}
+		return resp, err
+	}
+}
+
+// publishKeys and subscribeKeys return the keys ACL rules check for the
+// channels of PUB and SUB.
+func publishKeys(args []string) ([]string, error) {
+	if len(args) != 2 {
+		return nil, errPubArgs
+	}
+	return channelKeys(args[:1]), nil
+}
+
+func subscribeKeys(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, errSubArgs
+	}
+	return channelKeys(args), nil
+}
+
+func channelKeys(channels []string) []string {
+	keys := make([]string, len(channels))
+	for i, channel := range channels {
+		keys[i] = strings.TrimPrefix(channel, KeyspacePrefix)
+	}
+	return keys
+}
+
+func (h *Handler) publish(req *Request) (Response, error) {
+	args, err := DeserializeArgs(req.Frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 2 {
+		return nil, errPubArgs
+	}
+	n := h.subscribers.publish(args[0], args[1])
+	return &StatusResponse{Value: strconv.Itoa(n)}, nil
+}
+
+func (h *Handler) subscribe(req *Request) (Response, error) {
+	args, err := DeserializeArgs(req.Frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errSubArgs
+	}
+
+	s := &subscriber{
+		conn:     req.Conn,
+		channels: args,
+		events:   make(chan []byte, subscriberBuffer),
+		done:     make(chan struct{}),
+	}
+	// Like for monitors, the OK goes through the subscriber's goroutine to
+	// stay in order with the messages.
+	s.events <- []byte("OK\r\n")
+	req.Conn.subscriber.Store(s)
+	h.subscribers.add(s)
+	go h.runSubscriber(s)
+
+	return noReply{}, nil
+}
+
+// runSubscriber writes queued messages to the subscriber's socket until it
+// is closed or a write fails.
+func (h *Handler) runSubscriber(s *subscriber) {
+	defer h.subscribers.remove(s)
+
+	for {
+		select {
+		case frame := <-s.events:
+			if n := s.dropped.Swap(0); n > 0 {
+				frame = append(SerializeArgs(MessageCommand, DroppedChannel, strconv.FormatUint(n, 10)), frame...)
+			}
+			if _, err := s.conn.writeDirect(frame); err != nil {
+				s.conn.Close()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *subscriber) close() {
+	s.stop.Do(func() { close(s.done) })
+}
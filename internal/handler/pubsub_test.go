@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPubSub(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+
+	sub := dialTestServer(t, addr)
+	if got := sub.do(SubscribeCommand, "news", KeyspacePrefix+"counter"); got != "OK" {
+		t.Fatalf("SUB = %q", got)
+	}
+
+	c := dialTestServer(t, addr)
+	if got := c.do(PublishCommand, "news", "hello"); got != "1" {
+		t.Fatalf("PUB news = %q", got)
+	}
+	if got := c.do(PublishCommand, "sports", "goal"); got != "0" {
+		t.Fatalf("PUB sports = %q", got)
+	}
+	c.do(IncrCommand, "counter")
+	// Commands run by EXE publish when EXE runs them.
+	c.do(MultiCommand)
+	c.do(SetCommand, "counter", "5")
+	c.do(DecrCommand, "counter")
+	c.do(ExecCommand)
+	c.line()
+	c.line()
+	// So do the writes of scripts, but not failed ones.
+	c.do(EvalCommand, "incr(KEYS[1]) del(KEYS[1]) del(KEYS[1]) return 1", "1", "counter")
+	c.do(SetCommand, "counter", "1")
+	c.do(DelCommand, "counter")
+
+	for _, want := range [][]string{
+		{"news", "hello"},
+		{KeyspacePrefix + "counter", "incr"},
+		{KeyspacePrefix + "counter", "set"},
+		{KeyspacePrefix + "counter", "decr"},
+		{KeyspacePrefix + "counter", "incr"},
+		{KeyspacePrefix + "counter", "del"},
+		{KeyspacePrefix + "counter", "set"},
+		{KeyspacePrefix + "counter", "del"},
+	} {
+		if got := sub.line(); got+"\r\n" != string(SerializeArgs(MessageCommand, want...)) {
+			t.Fatalf("got %q, want a message %q", got, want)
+		}
+	}
+
+	if got := c.list(InfoCommand, "stats"); got[len(got)-1] != "pubsub_channels:2" {
+		t.Fatalf("INF stats = %q", got)
+	}
+
+	// Any command ends the subscription.
+	sub.conn.Write(SerializeArgs(GetCommand, "counter"))
+	sub.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := sub.r.ReadByte(); err == nil {
+		t.Fatal("subscriber still open after sending a command")
+	}
+	deadline := time.Now().Add(time.Second)
+	for c.do(PublishCommand, "news", "bye") != "0" {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber not removed after disconnecting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/k1ender/go-stash/internal/store"
+)
+
+// Custom commands
+//
+//	CMD\r\n
+//
+// Programs embedding the server can register their own commands with
+// RegisterCommand. CMD lists every command a handler supports: the number of
+// commands on its own line, followed by a line per command, sorted by name:
+//
+//	<name> <arity> [<flag>,...]
+
+var (
+	ErrCommandExists   = errors.New("command is already registered")
+	ErrBuiltinCommand  = errors.New("command clashes with a built-in command")
+	ErrInvalidCommand  = errors.New("command name must be three uppercase letters")
+	errCustomFlags     = errors.New("custom commands can not control transactions")
+	errCustomBind      = errors.New("custom command has no handler")
+	errCustomDecode    = errors.New("custom command has no decoder")
+	errCommandArgs     = errors.New("wrong number of arguments for CMD")
+	errCustomArityZero = errors.New("arity must not be zero")
+)
+
+// CustomCommand is a command registered with RegisterCommand.
+type CustomCommand struct {
+	CommandInfo
+
+	// Decode turns the arguments of a frame into the value the HandlerFunc
+	// and Keys find in Request.Decoded. It runs once per request.
+	Decode func(args []string) (any, error)
+	// Bind returns a HandlerFunc that runs the command against st. The
+	// handler binds it to its store, and to a locked view of the store when
+	// the command is queued in a transaction.
+	Bind func(st store.Store) HandlerFunc
+	// Keys returns the keys the command accesses, given the decoded request.
+	// They are checked against ACL rules and locked when the command runs in
+	// a transaction. Nil means the command accesses no keys.
+	Keys func(decoded any) []string
+}
+
+var (
+	customMu       sync.RWMutex
+	customCommands = make(map[Command]CustomCommand)
+)
+
+// RegisterCommand adds a command to every handler created afterwards.
+func RegisterCommand(c CustomCommand) error {
+	if !ValidCommand(c.Command) {
+		return fmt.Errorf("%w: %q", ErrInvalidCommand, c.Command)
+	}
+	if _, ok := builtinCommands[c.Command]; ok {
+		return fmt.Errorf("%w: %s", ErrBuiltinCommand, c.Command)
+	}
+	if c.Flags&FlagTx != 0 {
+		return errCustomFlags
+	}
+	if c.Arity == 0 {
+		return errCustomArityZero
+	}
+	if c.Bind == nil {
+		return errCustomBind
+	}
+	if c.Decode == nil {
+		return errCustomDecode
+	}
+
+	customMu.Lock()
+	defer customMu.Unlock()
+	if _, ok := customCommands[c.Command]; ok {
+		return fmt.Errorf("%w: %s", ErrCommandExists, c.Command)
+	}
+	customCommands[c.Command] = c
+	return nil
+}
+
+// ValidCommand reports whether c is three uppercase letters.
+func ValidCommand(c Command) bool {
+	for _, b := range c {
+		if b < 'A' || b > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckArity returns an error unless a frame with the given arguments
+// satisfies arity.
+func CheckArity(arity int, args []string) error {
+	n := len(args) + 1
+	if (arity > 0 && n != arity) || (arity < 0 && n < -arity) {
+		return fmt.Errorf("wrong number of arguments: got %d, arity is %d", len(args), arity)
+	}
+	return nil
+}
+
+func (h *Handler) registerCustom() {
+	customMu.RLock()
+	defer customMu.RUnlock()
+
+	for command, c := range customCommands {
+		spec := &commandSpec{
+			CommandInfo: c.CommandInfo,
+			bind: func(st store.Store) HandlerFunc {
+				return decoded(c.Bind(st))
+			},
+			decode:      c.Decode,
+			decodedKeys: c.Keys,
+		}
+		spec.handle = spec.bind(h.store)
+		h.handlers[command] = spec
+	}
+}
+
+// decoded makes sure Request.Decoded is set before next runs.
+func decoded(next HandlerFunc) HandlerFunc {
+	return func(req *Request) (Response, error) {
+		if err := req.decode(); err != nil {
+			return nil, err
+		}
+		return next(req)
+	}
+}
+
+// Commands describes the commands the handler supports, sorted by name.
+func (h *Handler) Commands() []CommandInfo {
+	commands := slices.SortedFunc(maps.Keys(h.handlers), func(a, b Command) int {
+		return slices.Compare(a[:], b[:])
+	})
+	infos := make([]CommandInfo, len(commands))
+	for i, command := range commands {
+		infos[i] = h.handlers[command].CommandInfo
+	}
+	return infos
+}
+
+func (h *Handler) listCommands(req *Request) (Response, error) {
+	args, err := DeserializeArgs(req.Frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 0 {
+		return nil, errCommandArgs
+	}
+
+	var lines []string
+	for _, info := range h.Commands() {
+		line := info.Command.String() + " " + strconv.Itoa(info.Arity)
+		if info.Flags != 0 {
+			line += " " + info.Flags.String()
+		}
+		lines = append(lines, line)
+	}
+	return &ListResponse{Lines: lines}, nil
+}
@@ -1,7 +1,29 @@
 package handler
 
+import (
+	"bytes"
+	"strconv"
+)
+
 type StatusCode []byte
 
 var (
 	ErrResponse StatusCode = []byte("ERR")
 )
+
+// ListResponse answers with the number of lines on its own line, followed by
+// the lines.
+type ListResponse struct {
+	Lines []string
+}
+
+func (r *ListResponse) Serialize() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(strconv.Itoa(len(r.Lines)))
+	buf.WriteString("\r\n")
+	for _, line := range r.Lines {
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes(), nil
+}
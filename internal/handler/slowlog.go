@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/slowlog"
+)
+
+// SLO GET [n] lists the n most recent slow commands, 10 by default, newest
+// first. Each line is "<id> <unix time> <duration µs> <client> <command>
+// <key>", the key being quoted Go style and empty for commands without keys.
+//
+// SLO LEN answers with the number of entries, SLO RESET clears them and
+// SLO THRESHOLD [µs] answers with the threshold or changes it, through the
+// slowlog_threshold_us option if the handler has WithConfig. A negative
+// threshold disables the log.
+
+const defaultSlowLogEntries = 10
+
+var (
+	errSlowLogArgs   = errors.New("expected SLOWLOG GET [n], LEN, RESET or THRESHOLD [microseconds]")
+	errSlowLogSubcmd = errors.New("unknown SLOWLOG subcommand")
+)
+
+// WithSlowLog records commands slower than the log's threshold in l, instead
+// of a log with DefaultSlowLogThreshold and DefaultSlowLogMaxLen.
+func WithSlowLog(l *slowlog.Log) Arg {
+	return func(h *Handler) {
+		h.slowlog = l
+	}
+}
+
+// recordSlow times every command and adds the slow ones to the slow log.
+func (h *Handler) recordSlow(next HandlerFunc) HandlerFunc {
+	return func(req *Request) (Response, error) {
+		if req.queued() {
+			return next(req)
+		}
+		start := time.Now()
+		resp, err := next(req)
+		elapsed := time.Since(start)
+		if h.slowlog.Slow(elapsed) {
+			h.slowlog.Add(slowlog.Entry{
+				Time:     start,
+				Duration: elapsed,
+				Client:   req.Conn.RemoteAddr().String(),
+				Command:  req.Command.String(),
+				Key:      slowLogKey(req),
+			})
+		}
+		return resp, err
+	}
+}
+
+// slowLogKey returns the first key of a request, or "" if it has none or the
+// frame can not be parsed.
+func slowLogKey(req *Request) string {
+	keys, err := req.keys()
+	if err != nil || len(keys) == 0 {
+		return ""
+	}
+	return keys[0]
+}
+
+func (h *Handler) slowLogCommand(req *Request) (Response, error) {
+	args, err := DeserializeArgs(req.Frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 || len(args) > 2 {
+		return nil, errSlowLogArgs
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		n := defaultSlowLogEntries
+		if len(args) == 2 {
+			if n, err = strconv.Atoi(args[1]); err != nil {
+				return nil, errSlowLogArgs
+			}
+		}
+		var lines []string
+		for _, e := range h.slowlog.Entries(n) {
+			lines = append(lines, strings.Join([]string{
+				strconv.FormatUint(e.ID, 10),
+				strconv.FormatInt(e.Time.Unix(), 10),
+				strconv.FormatInt(e.Duration.Microseconds(), 10),
+				e.Client,
+				e.Command,
+				strconv.Quote(e.Key),
+			}, " "))
+		}
+		return &ListResponse{Lines: lines}, nil
+	case "LEN":
+		if len(args) != 1 {
+			return nil, errSlowLogArgs
+		}
+		return &StatusResponse{Value: strconv.Itoa(h.slowlog.Len())}, nil
+	case "RESET":
+		if len(args) != 1 {
+			return nil, errSlowLogArgs
+		}
+		h.slowlog.Reset()
+		return &StatusResponse{Value: "OK"}, nil
+	case "THRESHOLD":
+		if len(args) == 1 {
+			return &StatusResponse{Value: strconv.FormatInt(h.slowlog.Threshold().Microseconds(), 10)}, nil
+		}
+		us, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, errSlowLogArgs
+		}
+		if h.config != nil {
+			// Like CFG SET, so that CFG GET, CFG REWRITE and reloads see
+			// the new threshold; the option's hook applies it.
+			if err := h.config.Set("slowlog_threshold_us", args[1]); err != nil {
+				return nil, err
+			}
+			return &StatusResponse{Value: "OK"}, nil
+		}
+		h.slowlog.SetThreshold(time.Duration(us) * time.Microsecond)
+		return &StatusResponse{Value: "OK"}, nil
+	}
+
+	return nil, errSlowLogSubcmd
+}
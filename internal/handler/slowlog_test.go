@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/k1ender/go-stash/internal/slowlog"
+)
+
+func TestSlowLog(t *testing.T) {
+	addr, stop := startTestServer(t, WithSlowLog(slowlog.New(0, 2)))
+	defer stop()
+
+	c := dialTestServer(t, addr)
+	c.do(SetCommand, "a\r\nb", "value")
+	c.do(GetCommand, "a\r\nb")
+
+	lines := c.list(SlowLogCommand, "GET")
+	if len(lines) != 2 {
+		t.Fatalf("SLO GET = %q", lines)
+	}
+	fields := strings.Fields(lines[0])
+	if len(fields) != 6 || fields[0] != "1" || fields[4] != "GET" || fields[5] != `"a\r\nb"` {
+		t.Fatalf("newest entry = %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "0 ") || !strings.Contains(lines[1], " SET ") {
+		t.Fatalf("oldest entry = %q", lines[1])
+	}
+
+	// SLO commands are logged too and push out older entries.
+	if got := c.do(SlowLogCommand, "LEN"); got != "2" {
+		t.Fatalf("SLO LEN = %q", got)
+	}
+	if got := c.list(SlowLogCommand, "GET", "1"); len(got) != 1 || !strings.HasPrefix(got[0], "3 ") || !strings.Contains(got[0], " SLO ") {
+		t.Fatalf("SLO GET 1 = %q", got)
+	}
+
+	if got := c.do(SlowLogCommand, "THRESHOLD", "1000000"); got != "OK" {
+		t.Fatalf("SLO THRESHOLD = %q", got)
+	}
+	if got := c.do(SlowLogCommand, "RESET"); got != "OK" {
+		t.Fatalf("SLO RESET = %q", got)
+	}
+	c.do(GetCommand, "a\r\nb")
+	if got := c.do(SlowLogCommand, "LEN"); got != "0" {
+		t.Fatalf("SLO LEN after raising the threshold = %q", got)
+	}
+	if got := c.do(SlowLogCommand, "THRESHOLD"); got != "1000000" {
+		t.Fatalf("SLO THRESHOLD = %q", got)
+	}
+	c.fail(SlowLogCommand, "NOPE")
+}
+
+func TestSlowLogTransactionsAndScripts(t *testing.T) {
+	addr, stop := startTestServer(t, WithSlowLog(slowlog.New(0, 10)))
+	defer stop()
+
+	c := dialTestServer(t, addr)
+	c.do(MultiCommand)
+	c.do(IncrCommand, "n")
+	c.do(ExecCommand)
+	c.line()
+	c.do(EvalCommand, "set(KEYS[1], ARGV[1]) return 1", "1", "k", "v")
+
+	// Queued commands are logged when EXE runs them, and the writes of
+	// scripts on their own, newest first.
+	lines := c.list(SlowLogCommand, "GET")
+	var commands []string
+	for _, line := range lines {
+		commands = append(commands, strings.Fields(line)[4])
+	}
+	if got := strings.Join(commands, " "); got != "EVA SET EXE INC MUL" {
+		t.Fatalf("logged commands = %q", got)
+	}
+}
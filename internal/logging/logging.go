@@ -0,0 +1,182 @@
+// Package logging builds the server's slog logger from its configuration and
+// writes log files with size-based rotation.
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+type Options struct {
+	// Level is the minimum level logged. A *slog.LevelVar allows changing it
+	// later.
+	Level slog.Leveler
+	// Format is FormatText or FormatJSON.
+	Format string
+	// File is the path of the log file, standard error if empty.
+	File string
+	// MaxSize is the size in bytes at which the log file is rotated. Zero
+	// disables rotation.
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept, named File.1 (the
+	// newest) to File.<MaxBackups>.
+	MaxBackups int
+}
+
+// New returns a logger as described by opts, and the io.Closer of its log
+// file, which is nil when logging to standard error.
+func New(opts Options) (*slog.Logger, io.Closer, error) {
+	var w io.Writer = os.Stderr
+	var closer io.Closer
+	if opts.File != "" {
+		f, err := OpenFile(opts.File, opts.MaxSize, opts.MaxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+		w, closer = f, f
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: opts.Level}
+	var h slog.Handler
+	switch opts.Format {
+	case FormatText, "":
+		h = slog.NewTextHandler(w, handlerOpts)
+	case FormatJSON:
+		h = slog.NewJSONHandler(w, handlerOpts)
+	default:
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, nil, fmt.Errorf("unknown log format %q", opts.Format)
+	}
+	return slog.New(h), closer, nil
+}
+
+// File is a log file that is rotated when it grows past a size. It is safe
+// for concurrent use; every Write goes to a single file, so records are
+// never split across files.
+type File struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	// closed is set by Close. f is also nil after a rotation that could
+	// not reopen the file, which the next Write retries.
+	closed bool
+}
+
+// OpenFile opens the log file at path for appending, creating it if needed.
+// It is rotated before a write would make it larger than maxSize bytes,
+// keeping maxBackups rotated files. A maxSize of zero disables rotation.
+func OpenFile(path string, maxSize int64, maxBackups int) (*File, error) {
+	lf := &File{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (lf *File) open() error {
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lf.f = f
+	lf.size = info.Size()
+	return nil
+}
+
+func (lf *File) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.closed {
+		return 0, os.ErrClosed
+	}
+	var rotateErr error
+	if lf.f != nil && lf.maxSize > 0 && lf.size > 0 && lf.size+int64(len(p)) > lf.maxSize {
+		rotateErr = lf.rotate()
+	}
+	if lf.f == nil {
+		// A failed rotation left no file open; try again rather than
+		// dropping every later record.
+		if err := lf.open(); err != nil {
+			return 0, errors.Join(rotateErr, err)
+		}
+	}
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+	if rotateErr != nil {
+		return n, errors.Join(fmt.Errorf("rotate %s: %w", lf.path, rotateErr), err)
+	}
+	return n, err
+}
+
+// rotate shifts the backups by one, moves the current file to path.1 and
+// opens a new one. If a step fails, it still reopens path, appending to the
+// current file if it could not be moved, so that logging goes on. lf.mu must
+// be held.
+func (lf *File) rotate() error {
+	err := lf.f.Close()
+	lf.f = nil
+	if err == nil {
+		err = lf.shift()
+	}
+	if openErr := lf.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+func (lf *File) shift() error {
+	if lf.maxBackups == 0 {
+		os.Remove(lf.path)
+		return nil
+	}
+	os.Remove(lf.backup(lf.maxBackups))
+	for i := lf.maxBackups - 1; i >= 1; i-- {
+		os.Rename(lf.backup(i), lf.backup(i+1))
+	}
+	err := os.Rename(lf.path, lf.backup(1))
+	if errors.Is(err, os.ErrNotExist) {
+		// The file was removed behind our back: there is nothing to keep.
+		return nil
+	}
+	return err
+}
+
+func (lf *File) backup(i int) string {
+	return lf.path + "." + strconv.Itoa(i)
+}
+
+func (lf *File) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.closed {
+		return nil
+	}
+	lf.closed = true
+	if lf.f == nil {
+		return nil
+	}
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
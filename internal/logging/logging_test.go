@@ -0,0 +1,128 @@
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stash.log")
+	f, err := OpenFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, record := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeee\n", "ffffffffffff\n"} {
+		if _, err := f.Write([]byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, want := range map[string]string{
+		// A record larger than the limit still gets a file of its own.
+		path:        "ffffffffffff\n",
+		path + ".1": "eeee\n",
+		path + ".2": "cccc\ndddd\n",
+	} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(name), data, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 backups, stat .3: %v", err)
+	}
+}
+
+func TestRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stash.log")
+	f, err := OpenFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// A file removed behind the logger's back is recreated on rotation.
+	if _, err := f.Write([]byte("aaaa\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("bbbbbbbb\n")); err != nil {
+		t.Fatalf("write after the file was removed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "bbbbbbbb\n" {
+		t.Errorf("log = %q", data)
+	}
+
+	// A backup that cannot be replaced fails the rotation, but the record
+	// is still written to the current file, and so are the next ones.
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("cccc\n")); err == nil {
+		t.Error("expected the rotation error")
+	}
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("eeee\n")); err != nil {
+		t.Fatalf("write after a failed rotation: %v", err)
+	}
+	for name, want := range map[string]string{
+		path:        "eeee\n",
+		path + ".1": "bbbbbbbb\ncccc\n",
+	} {
+		if data, _ := os.ReadFile(name); string(data) != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(name), data, want)
+		}
+	}
+
+	f.Close()
+	if _, err := f.Write([]byte("dddd\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("write after Close: %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stash.log")
+	level := new(slog.LevelVar)
+	logger, closer, err := New(Options{Level: level, Format: FormatJSON, File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("hidden")
+	level.Set(slog.LevelDebug)
+	logger.Debug("shown", "client_id", 7)
+	closer.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("log = %q", data)
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["msg"] != "shown" || record["client_id"] != float64(7) {
+		t.Errorf("record = %v", record)
+	}
+
+	if _, _, err := New(Options{Format: "xml"}); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
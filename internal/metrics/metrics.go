@@ -0,0 +1,347 @@
+// Package metrics implements counters, gauges and histograms and writes them
+// in the Prometheus text exposition format, version 0.0.4.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is the content type of the exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are latency buckets in seconds, from 10µs to 1s.
+var DefBuckets = []float64{
+	0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+}
+
+// Sample is a single value of a gauge with labels, as returned by the
+// function of a GaugeVecFunc.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics in the order they were created.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// WriteTo writes every metric to w.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP writes the metrics in response to a scrape.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// NewCounter creates a counter without labels.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	v := r.NewCounterVec(name, help)
+	return v.With()
+}
+
+// CounterVec is a set of counters with the same name, told apart by their
+// label values.
+type CounterVec struct {
+	family
+	mu       sync.RWMutex
+	children map[string]*counterChild
+}
+
+type counterChild struct {
+	Counter
+	labelValues []string
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{
+		family:   family{name: name, help: help, typ: "counter", labels: labels},
+		children: make(map[string]*counterChild),
+	}
+	r.add(v)
+	return v
+}
+
+// With returns the counter for the given label values, which must match the
+// labels of the vector in number.
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.RLock()
+	c, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return &c.Counter
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.children[key]; !ok {
+		c = &counterChild{labelValues: slices.Clone(labelValues)}
+		v.children[key] = c
+	}
+	return &c.Counter
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.header(w)
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	for _, key := range slices.Sorted(maps.Keys(v.children)) {
+		c := v.children[key]
+		v.sample(w, "", c.labelValues, "", "", float64(c.Value()))
+	}
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	upper  []float64
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	// sum holds the bits of a float64.
+	sum atomic.Uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{upper: buckets, counts: make([]atomic.Uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	if i, _ := slices.BinarySearch(h.upper, v); i < len(h.counts) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// HistogramVec is a set of histograms with the same name and buckets, told
+// apart by their label values.
+type HistogramVec struct {
+	family
+	buckets  []float64
+	mu       sync.RWMutex
+	children map[string]*histogramChild
+}
+
+type histogramChild struct {
+	*Histogram
+	labelValues []string
+}
+
+// NewHistogramVec creates histograms with the given upper bounds, which must
+// be sorted in increasing order.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{
+		family:   family{name: name, help: help, typ: "histogram", labels: labels},
+		buckets:  buckets,
+		children: make(map[string]*histogramChild),
+	}
+	r.add(v)
+	return v
+}
+
+// With returns the histogram for the given label values.
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.RLock()
+	h, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return h.Histogram
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if h, ok = v.children[key]; !ok {
+		h = &histogramChild{Histogram: newHistogram(v.buckets), labelValues: slices.Clone(labelValues)}
+		v.children[key] = h
+	}
+	return h.Histogram
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.header(w)
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	for _, key := range slices.Sorted(maps.Keys(v.children)) {
+		h := v.children[key]
+		var cumulative uint64
+		for i, upper := range h.upper {
+			cumulative += h.counts[i].Load()
+			v.sample(w, "_bucket", h.labelValues, "le", formatFloat(upper), float64(cumulative))
+		}
+		count := h.count.Load()
+		v.sample(w, "_bucket", h.labelValues, "le", "+Inf", float64(count))
+		v.sample(w, "_sum", h.labelValues, "", "", math.Float64frombits(h.sum.Load()))
+		v.sample(w, "_count", h.labelValues, "", "", float64(count))
+	}
+}
+
+// GaugeFunc is a gauge whose value is computed on every scrape.
+type GaugeFunc struct {
+	family
+	fn func() []Sample
+}
+
+// NewGaugeFunc creates a gauge without labels whose value is fn().
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.NewGaugeVecFunc(name, help, func() []Sample {
+		return []Sample{{Value: fn()}}
+	})
+}
+
+// NewGaugeVecFunc creates a gauge whose samples are computed by fn on every
+// scrape.
+func (r *Registry) NewGaugeVecFunc(name, help string, fn func() []Sample, labels ...string) {
+	r.add(&GaugeFunc{family: family{name: name, help: help, typ: "gauge", labels: labels}, fn: fn})
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.header(w)
+	for _, s := range g.fn() {
+		g.sample(w, "", s.LabelValues, "", "", s.Value)
+	}
+}
+
+// family holds what metrics of one name have in common.
+type family struct {
+	name, help, typ string
+	labels          []string
+}
+
+func (f *family) header(w *bufio.Writer) {
+	w.WriteString("# HELP " + f.name + " " + escape(f.help, false) + "\n")
+	w.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+}
+
+// sample writes a line with the given suffix, label values and optionally
+// one extra label.
+func (f *family) sample(w *bufio.Writer, suffix string, labelValues []string, extraLabel, extraValue string, value float64) {
+	w.WriteString(f.name)
+	w.WriteString(suffix)
+	if len(labelValues) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, lv := range labelValues {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(f.labels[i] + `="` + escape(lv, true) + `"`)
+		}
+		if extraLabel != "" {
+			if len(labelValues) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraLabel + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escape escapes backslashes and newlines, and double quotes in label
+// values.
+func escape(s string, quotes bool) string {
+	if !strings.ContainsAny(s, "\\\n\"") {
+		return s
+	}
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c == '\\':
+			b.WriteString(`\\`)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '"' && quotes:
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	calls := r.NewCounterVec("calls_total", "Calls by command.", "command")
+	latency := r.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "command")
+	r.NewGaugeFunc("clients", "Connected clients.", func() float64 { return 3 })
+	r.NewGaugeVecFunc("keys", "Keys per shard.", func() []Sample {
+		return []Sample{{LabelValues: []string{"0"}, Value: 5}, {LabelValues: []string{"1"}, Value: 7}}
+	}, "shard")
+
+	calls.With("SET").Inc()
+	calls.With("GET").Add(2)
+	calls.With(`we"ird`).Inc()
+	latency.With("GET").Observe(0.05)
+	latency.With("GET").Observe(0.5)
+	latency.With("GET").Observe(2)
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP calls_total Calls by command.
+# TYPE calls_total counter
+calls_total{command="GET"} 2
+calls_total{command="SET"} 1
+calls_total{command="we\"ird"} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{command="GET",le="0.1"} 1
+latency_seconds_bucket{command="GET",le="1"} 2
+latency_seconds_bucket{command="GET",le="+Inf"} 3
+latency_seconds_sum{command="GET"} 2.55
+latency_seconds_count{command="GET"} 3
+# HELP clients Connected clients.
+# TYPE clients gauge
+clients 3
+# HELP keys Keys per shard.
+# TYPE keys gauge
+keys{shard="0"} 5
+keys{shard="1"} 7
+`
+	if b.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
@@ -0,0 +1,443 @@
+package script
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/store"
+	"github.com/k1ender/go-stash/internal/utils"
+)
+
+var (
+	ErrStepLimit   = errors.New("script exceeded its instruction limit")
+	ErrTimeout     = errors.New("script exceeded its time limit")
+	ErrStringLimit = errors.New("script built a string larger than its limit")
+	ErrMemoryLimit = errors.New("script exceeded its memory limit")
+)
+
+const (
+	// deadlineCheckInterval is how many steps run between two clock reads.
+	deadlineCheckInterval = 1024
+	// bytesPerStep is how many bytes a string operation may copy for each
+	// step it is charged.
+	bytesPerStep = 1024
+)
+
+// returnSignal unwinds the evaluation of a block when a return statement is
+// reached.
+type returnSignal struct {
+	value any
+}
+
+type interp struct {
+	store    store.Store
+	keys     []string
+	limits   Limits
+	steps    int
+	deadline time.Time
+	// nextCheck is the step count at which the deadline is checked next.
+	nextCheck int
+	// allocated is the number of bytes of the strings built so far.
+	allocated int
+	scopes    []map[string]any
+}
+
+func (in *interp) step() error {
+	return in.charge(1)
+}
+
+// charge counts n steps against the step limit and checks the deadline
+// once at least deadlineCheckInterval steps passed since the last check.
+func (in *interp) charge(n int) error {
+	in.steps += n
+	if in.limits.MaxSteps > 0 && in.steps > in.limits.MaxSteps {
+		return ErrStepLimit
+	}
+	if in.steps >= in.nextCheck {
+		in.nextCheck = in.steps + deadlineCheckInterval
+		return in.checkDeadline()
+	}
+	return nil
+}
+
+func (in *interp) checkDeadline() error {
+	if !in.deadline.IsZero() && time.Now().After(in.deadline) {
+		return ErrTimeout
+	}
+	return nil
+}
+
+// alloc accounts for a new string of n bytes before it is built: it must fit
+// the string and memory limits, and costs a step per bytesPerStep bytes.
+func (in *interp) alloc(n int) error {
+	if in.limits.MaxStringSize > 0 && n > in.limits.MaxStringSize {
+		return ErrStringLimit
+	}
+	in.allocated += n
+	if in.limits.MaxMemory > 0 && in.allocated > in.limits.MaxMemory {
+		return ErrMemoryLimit
+	}
+	return in.charge(n / bytesPerStep)
+}
+
+// concat joins the operands of .., within the limits of the script.
+func (in *interp) concat(left, right any) (string, error) {
+	l, err := toConcat(left)
+	if err != nil {
+		return "", err
+	}
+	r, err := toConcat(right)
+	if err != nil {
+		return "", err
+	}
+	if err := in.alloc(len(l) + len(r)); err != nil {
+		return "", err
+	}
+	return l + r, nil
+}
+
+func (in *interp) lookup(name string) (map[string]any, bool) {
+	for _, scope := range slices.Backward(in.scopes) {
+		if _, ok := scope[name]; ok {
+			return scope, true
+		}
+	}
+	return nil, false
+}
+
+func (in *interp) block(block []stmt) (*returnSignal, error) {
+	in.scopes = append(in.scopes, make(map[string]any))
+	defer func() { in.scopes = in.scopes[:len(in.scopes)-1] }()
+
+	for _, s := range block {
+		ret, err := in.statement(s)
+		if err != nil || ret != nil {
+			return ret, err
+		}
+	}
+	return nil, nil
+}
+
+func (in *interp) statement(s stmt) (*returnSignal, error) {
+	if err := in.step(); err != nil {
+		return nil, err
+	}
+
+	switch s := s.(type) {
+	case *localStmt:
+		value, err := in.eval(s.value)
+		if err != nil {
+			return nil, err
+		}
+		in.scopes[len(in.scopes)-1][s.name] = value
+
+	case *assignStmt:
+		value, err := in.eval(s.value)
+		if err != nil {
+			return nil, err
+		}
+		scope, ok := in.lookup(s.name)
+		if !ok {
+			// Unlike Lua there are no globals: assigning to an undeclared
+			// name declares it in the outermost scope of the script.
+			scope = in.scopes[0]
+		}
+		scope[s.name] = value
+
+	case *ifStmt:
+		for i, cond := range s.conds {
+			value, err := in.eval(cond)
+			if err != nil {
+				return nil, err
+			}
+			if truthy(value) {
+				return in.block(s.blocks[i])
+			}
+		}
+		if s.orElse != nil {
+			return in.block(s.orElse)
+		}
+
+	case *whileStmt:
+		for {
+			value, err := in.eval(s.cond)
+			if err != nil {
+				return nil, err
+			}
+			if !truthy(value) {
+				return nil, nil
+			}
+			ret, err := in.block(s.body)
+			if err != nil || ret != nil {
+				return ret, err
+			}
+		}
+
+	case *returnStmt:
+		value, err := in.eval(s.value)
+		if err != nil {
+			return nil, err
+		}
+		return &returnSignal{value: value}, nil
+
+	case *callStmt:
+		_, err := in.call(s.call)
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (in *interp) eval(e expr) (any, error) {
+	if err := in.step(); err != nil {
+		return nil, err
+	}
+
+	switch e := e.(type) {
+	case *nilLit:
+		return nil, nil
+	case *boolLit:
+		return e.value, nil
+	case *numLit:
+		return e.value, nil
+	case *strLit:
+		return e.value, nil
+
+	case *nameExpr:
+		scope, ok := in.lookup(e.name)
+		if !ok {
+			return nil, nil
+		}
+		return scope[e.name], nil
+
+	case *indexExpr:
+		object, err := in.eval(e.object)
+		if err != nil {
+			return nil, err
+		}
+		index, err := in.eval(e.index)
+		if err != nil {
+			return nil, err
+		}
+		list, ok := object.([]any)
+		if !ok {
+			return nil, fmt.Errorf("attempt to index a %s value", typeName(object))
+		}
+		i, ok := index.(int)
+		if !ok || i < 1 || i > len(list) {
+			return nil, nil
+		}
+		return list[i-1], nil
+
+	case *callExpr:
+		return in.call(e)
+
+	case *unaryExpr:
+		operand, err := in.eval(e.operand)
+		if err != nil {
+			return nil, err
+		}
+		return unary(e.op, operand)
+
+	case *binaryExpr:
+		left, err := in.eval(e.left)
+		if err != nil {
+			return nil, err
+		}
+
+		// and/or short-circuit and yield one of their operands, as in Lua.
+		switch e.op {
+		case "and":
+			if !truthy(left) {
+				return left, nil
+			}
+			return in.eval(e.right)
+		case "or":
+			if truthy(left) {
+				return left, nil
+			}
+			return in.eval(e.right)
+		}
+
+		right, err := in.eval(e.right)
+		if err != nil {
+			return nil, err
+		}
+		var value any
+		if e.op == ".." {
+			value, err = in.concat(left, right)
+		} else {
+			value, err = binary(e.op, left, right)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", e.line, err)
+		}
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("unknown expression %T", e)
+}
+
+func unary(op string, operand any) (any, error) {
+	switch op {
+	case "not":
+		return !truthy(operand), nil
+	case "-":
+		n, err := toInt(operand)
+		if err != nil {
+			return nil, err
+		}
+		return -n, nil
+	case "#":
+		switch v := operand.(type) {
+		case string:
+			return len(v), nil
+		case []any:
+			return len(v), nil
+		}
+		return nil, fmt.Errorf("attempt to get length of a %s value", typeName(operand))
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+func binary(op string, left, right any) (any, error) {
+	switch op {
+	case "==":
+		return equal(left, right), nil
+	case "~=":
+		return !equal(left, right), nil
+	case "<", "<=", ">", ">=":
+		return compare(op, left, right)
+	}
+
+	l, err := toInt(left)
+	if err != nil {
+		return nil, err
+	}
+	r, err := toInt(right)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/", "%":
+		if r == 0 {
+			return nil, errors.New("division by zero")
+		}
+		// Integer division floors like Lua's // operator.
+		q, m := l/r, l%r
+		if m != 0 && (m < 0) != (r < 0) {
+			q--
+			m += r
+		}
+		if op == "/" {
+			return q, nil
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+func compare(op string, left, right any) (bool, error) {
+	var c int
+	switch l := left.(type) {
+	case int:
+		r, ok := right.(int)
+		if !ok {
+			return false, fmt.Errorf("attempt to compare number with %s", typeName(right))
+		}
+		c = cmp.Compare(l, r)
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return false, fmt.Errorf("attempt to compare string with %s", typeName(right))
+		}
+		c = cmp.Compare(l, r)
+	default:
+		return false, fmt.Errorf("attempt to compare two %s values", typeName(left))
+	}
+
+	switch op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+// equal compares scalars by value. Tables are never equal, since scripts
+// cannot create their own and only see KEYS and ARGV.
+func equal(left, right any) bool {
+	_, leftTable := left.([]any)
+	_, rightTable := right.([]any)
+	if leftTable || rightTable {
+		return false
+	}
+	return left == right
+}
+
+func truthy(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	}
+	return true
+}
+
+// toInt converts numbers and numeric strings, so values read from the store
+// can be used in arithmetic directly.
+func toInt(v any) (int, error) {
+	switch v := v.(type) {
+	case int:
+		return v, nil
+	case string:
+		n, err := utils.FastStringToInt(v)
+		if err != nil {
+			return 0, fmt.Errorf("attempt to perform arithmetic on a non-numeric string")
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("attempt to perform arithmetic on a %s value", typeName(v))
+}
+
+func toConcat(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int:
+		return strconv.Itoa(v), nil
+	}
+	return "", fmt.Errorf("attempt to concatenate a %s value", typeName(v))
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case int:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "table"
+	}
+	return "unknown"
+}
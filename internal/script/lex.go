@@ -0,0 +1,148 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokNumber
+	tokString
+	tokKeyword
+	tokSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num  int
+	line int
+}
+
+var keywords = map[string]bool{
+	"and": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "if": true, "local": true, "nil": true, "not": true,
+	"or": true, "return": true, "then": true, "true": true, "while": true,
+}
+
+// symbols is ordered so that longer symbols are matched first.
+var symbols = []string{
+	"..", "==", "~=", "<=", ">=",
+	"+", "-", "*", "/", "%", "<", ">", "=", "(", ")", "[", "]", ",", "#", ";",
+}
+
+// lex splits src into tokens. Comments start with -- and run to the end of the
+// line.
+func lex(src string) ([]token, error) {
+	var tokens []token
+	line := 1
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "--"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case isLetter(c):
+			start := i
+			for i < len(src) && (isLetter(src[i]) || isDigit(src[i])) {
+				i++
+			}
+			word := src[start:i]
+			kind := tokName
+			if keywords[word] {
+				kind = tokKeyword
+			}
+			tokens = append(tokens, token{kind: kind, text: word, line: line})
+		case isDigit(c):
+			start := i
+			for i < len(src) && isDigit(src[i]) {
+				i++
+			}
+			n, err := strconv.Atoi(src[start:i])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid number %s", line, src[start:i])
+			}
+			tokens = append(tokens, token{kind: tokNumber, num: n, text: src[start:i], line: line})
+		case c == '"' || c == '\'':
+			s, n, err := lexString(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			tokens = append(tokens, token{kind: tokString, text: s, line: line})
+			i += n
+		default:
+			matched := false
+			for _, sym := range symbols {
+				if strings.HasPrefix(src[i:], sym) {
+					tokens = append(tokens, token{kind: tokSymbol, text: sym, line: line})
+					i += len(sym)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("line %d: unexpected character %q", line, c)
+			}
+		}
+	}
+
+	return append(tokens, token{kind: tokEOF, line: line}), nil
+}
+
+// lexString reads a quoted string literal and returns its value and the
+// number of bytes consumed.
+func lexString(src string) (string, int, error) {
+	quote := src[0]
+	var b strings.Builder
+	for i := 1; i < len(src); i++ {
+		c := src[i]
+		switch c {
+		case quote:
+			return b.String(), i + 1, nil
+		case '\n':
+			return "", 0, fmt.Errorf("unfinished string")
+		case '\\':
+			i++
+			if i == len(src) {
+				return "", 0, fmt.Errorf("unfinished string")
+			}
+			switch src[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '0':
+				b.WriteByte(0)
+			case '\\', '"', '\'':
+				b.WriteByte(src[i])
+			default:
+				return "", 0, fmt.Errorf("invalid escape sequence \\%c", src[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unfinished string")
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,423 @@
+package script
+
+import "fmt"
+
+// maxDepth bounds the nesting of blocks and expressions so that hostile
+// scripts cannot exhaust the parser's stack.
+const maxDepth = 200
+
+type expr any
+
+type (
+	nilLit  struct{}
+	boolLit struct{ value bool }
+	numLit  struct{ value int }
+	strLit  struct{ value string }
+
+	nameExpr struct {
+		name string
+	}
+	indexExpr struct {
+		object, index expr
+	}
+	callExpr struct {
+		name string
+		args []expr
+		line int
+	}
+	unaryExpr struct {
+		op      string
+		operand expr
+	}
+	binaryExpr struct {
+		op          string
+		left, right expr
+		line        int
+	}
+)
+
+type stmt any
+
+type (
+	localStmt struct {
+		name  string
+		value expr
+	}
+	assignStmt struct {
+		name  string
+		value expr
+	}
+	ifStmt struct {
+		conds  []expr
+		blocks [][]stmt
+		orElse []stmt
+	}
+	whileStmt struct {
+		cond expr
+		body []stmt
+	}
+	returnStmt struct {
+		value expr
+	}
+	callStmt struct {
+		call *callExpr
+	}
+)
+
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int
+}
+
+func parse(src string) ([]stmt, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	block, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "unexpected %q", tok.text)
+	}
+	return block, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) is(text string) bool {
+	tok := p.peek()
+	return (tok.kind == tokKeyword || tok.kind == tokSymbol) && tok.text == text
+}
+
+func (p *parser) accept(text string) bool {
+	if p.is(text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		tok := p.peek()
+		return p.errorf(tok, "expected %q, got %q", text, tok.text)
+	}
+	return nil
+}
+
+func (p *parser) name() (string, error) {
+	tok := p.next()
+	if tok.kind != tokName {
+		return "", p.errorf(tok, "expected name, got %q", tok.text)
+	}
+	return tok.text, nil
+}
+
+func (p *parser) errorf(tok token, format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", tok.line, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > maxDepth {
+		return p.errorf(p.peek(), "script is nested too deeply")
+	}
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+// block parses statements until a keyword that closes the block.
+func (p *parser) block() ([]stmt, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	var block []stmt
+	for {
+		if p.accept(";") {
+			continue
+		}
+		if tok := p.peek(); tok.kind == tokEOF || p.is("end") || p.is("else") || p.is("elseif") {
+			return block, nil
+		}
+
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		block = append(block, s)
+
+		if _, ok := s.(*returnStmt); ok {
+			p.accept(";")
+			return block, nil
+		}
+	}
+}
+
+func (p *parser) statement() (stmt, error) {
+	tok := p.peek()
+
+	switch {
+	case p.accept("local"):
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		var value expr = &nilLit{}
+		if p.accept("=") {
+			if value, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		return &localStmt{name: name, value: value}, nil
+
+	case p.accept("if"):
+		s := &ifStmt{}
+		for {
+			cond, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("then"); err != nil {
+				return nil, err
+			}
+			body, err := p.block()
+			if err != nil {
+				return nil, err
+			}
+			s.conds = append(s.conds, cond)
+			s.blocks = append(s.blocks, body)
+
+			if !p.accept("elseif") {
+				break
+			}
+		}
+		if p.accept("else") {
+			body, err := p.block()
+			if err != nil {
+				return nil, err
+			}
+			s.orElse = body
+		}
+		return s, p.expect("end")
+
+	case p.accept("while"):
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("do"); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &whileStmt{cond: cond, body: body}, p.expect("end")
+
+	case p.accept("return"):
+		if tok := p.peek(); tok.kind == tokEOF || p.is("end") || p.is("else") || p.is("elseif") || p.is(";") {
+			return &returnStmt{value: &nilLit{}}, nil
+		}
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return &returnStmt{value: value}, nil
+
+	case tok.kind == tokName:
+		p.next()
+		if p.accept("=") {
+			value, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return &assignStmt{name: tok.text, value: value}, nil
+		}
+		if p.is("(") {
+			call, err := p.call(tok)
+			if err != nil {
+				return nil, err
+			}
+			return &callStmt{call: call}, nil
+		}
+		return nil, p.errorf(tok, "syntax error near %q", tok.text)
+	}
+
+	return nil, p.errorf(tok, "unexpected %q", tok.text)
+}
+
+func (p *parser) call(fn token) (*callExpr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	call := &callExpr{name: fn.text, line: fn.line}
+	if p.accept(")") {
+		return call, nil
+	}
+	for {
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+		if !p.accept(",") {
+			break
+		}
+	}
+	return call, p.expect(")")
+}
+
+// binaryPrecedence follows Lua: or < and < comparison < .. < +- < */%.
+var binaryPrecedence = map[string]int{
+	"or":  1,
+	"and": 2,
+	"<":   3, ">": 3, "<=": 3, ">=": 3, "~=": 3, "==": 3,
+	"..": 4,
+	"+":  5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+const unaryPrecedence = 7
+
+func (p *parser) expr() (expr, error) {
+	return p.binary(1)
+}
+
+func (p *parser) binary(minPrec int) (expr, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	// Each operator of a left associative chain nests the expression built
+	// so far one level deeper, which the interpreter recurses into like
+	// parentheses, so it counts against maxDepth too.
+	chain := 0
+	defer func() { p.depth -= chain }()
+	for {
+		tok := p.peek()
+		if tok.kind != tokSymbol && tok.kind != tokKeyword {
+			return left, nil
+		}
+		prec, ok := binaryPrecedence[tok.text]
+		if !ok || prec < minPrec {
+			return left, nil
+		}
+		p.next()
+
+		// .. is right associative, everything else is left associative.
+		nextPrec := prec + 1
+		if tok.text == ".." {
+			nextPrec = prec
+		}
+		right, err := p.binary(nextPrec)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: tok.text, left: left, right: right, line: tok.line}
+		chain++
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) unary() (expr, error) {
+	if p.is("not") || p.is("-") || p.is("#") {
+		op := p.next().text
+		operand, err := p.binary(unaryPrecedence)
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: op, operand: operand}, nil
+	}
+	return p.postfix()
+}
+
+func (p *parser) postfix() (expr, error) {
+	e, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	chain := 0
+	defer func() { p.depth -= chain }()
+	for p.accept("[") {
+		chain++
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		index, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		e = &indexExpr{object: e, index: index}
+	}
+	return e, nil
+}
+
+func (p *parser) primary() (expr, error) {
+	tok := p.next()
+
+	switch tok.kind {
+	case tokNumber:
+		return &numLit{value: tok.num}, nil
+	case tokString:
+		return &strLit{value: tok.text}, nil
+	case tokName:
+		if p.is("(") {
+			return p.call(tok)
+		}
+		return &nameExpr{name: tok.text}, nil
+	case tokKeyword:
+		switch tok.text {
+		case "nil":
+			return &nilLit{}, nil
+		case "true":
+			return &boolLit{value: true}, nil
+		case "false":
+			return &boolLit{value: false}, nil
+		}
+	case tokSymbol:
+		if tok.text == "(" {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expect(")")
+		}
+	}
+
+	if tok.kind == tokEOF {
+		return nil, p.errorf(tok, "unexpected end of script")
+	}
+	return nil, p.errorf(tok, "unexpected %q", tok.text)
+}
@@ -0,0 +1,232 @@
+// Package script implements a small, sandboxed, Lua-like language for running
+// multi-key logic atomically on the server.
+//
+// A script sees its keys in KEYS and its arguments in ARGV (both 1-indexed)
+// and can only reach the store through the builtins below, each of which
+// only accepts keys listed in KEYS:
+//
+//	get(key)        value, or nil if the key does not exist
+//	set(key, value) "OK"
+//	incr(key)       the new value
+//	decr(key)       the new value
+//	del(key)        true if the key existed
+//	tonumber(v)     v as a number, or nil
+//	tostring(v)     v as a string
+//	error(msg)      aborts the script with msg
+//
+// Numbers are integers; / and % floor like Lua's // and %. There are no
+// functions, tables or globals beyond the above, so a script cannot touch
+// anything outside of the store.
+package script
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/store"
+)
+
+var ErrUndeclaredKey = errors.New("script accessed a key not declared in KEYS")
+
+// Limits bounds the work a single script run may do. Zero values disable the
+// corresponding limit.
+//
+// MaxStringSize bounds every string a script builds, and MaxMemory the total
+// size of all of them. Building strings also costs a step per 1024 bytes, so
+// MaxSteps bounds the bytes copied as well.
+type Limits struct {
+	MaxSteps      int
+	Timeout       time.Duration
+	MaxStringSize int
+	MaxMemory     int
+}
+
+// Program is a parsed script. It holds no state between runs and is safe to
+// run concurrently.
+type Program struct {
+	SHA   string
+	block []stmt
+}
+
+// SHA returns the hex encoded SHA1 of src, by which programs are cached.
+func SHA(src string) string {
+	sum := sha1.Sum([]byte(src))
+	return hex.EncodeToString(sum[:])
+}
+
+func Compile(src string) (*Program, error) {
+	block, err := parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("compile error: %w", err)
+	}
+	return &Program{SHA: SHA(src), block: block}, nil
+}
+
+// Run executes the program against st, which is expected to already be
+// locked for keys, and returns the value of its return statement.
+func (p *Program) Run(st store.Store, keys, args []string, limits Limits) (any, error) {
+	in := &interp{
+		store:  st,
+		keys:   keys,
+		limits: limits,
+		scopes: []map[string]any{{
+			"KEYS": toList(keys),
+			"ARGV": toList(args),
+		}},
+	}
+	if limits.Timeout > 0 {
+		in.deadline = time.Now().Add(limits.Timeout)
+	}
+
+	ret, err := in.block(p.block)
+	if err != nil {
+		return nil, err
+	}
+	if ret == nil {
+		return nil, nil
+	}
+	return ret.value, nil
+}
+
+// Format renders a script result as a reply line.
+func Format(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case string:
+		return v
+	}
+	return typeName(v)
+}
+
+func toList(values []string) []any {
+	list := make([]any, len(values))
+	for i, v := range values {
+		list[i] = v
+	}
+	return list
+}
+
+func (in *interp) call(c *callExpr) (any, error) {
+	args := make([]any, len(c.args))
+	for i, arg := range c.args {
+		value, err := in.eval(arg)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+
+	value, err := in.builtin(c.name, args)
+	if err == nil {
+		// Builtins may take long on large values, so the deadline is checked
+		// after every call rather than every deadlineCheckInterval steps.
+		err = in.checkDeadline()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %s: %w", c.line, c.name, err)
+	}
+	return value, nil
+}
+
+func (in *interp) builtin(name string, args []any) (any, error) {
+	switch name {
+	case "get":
+		key, err := in.key(args)
+		if err != nil {
+			return nil, err
+		}
+		value, err := in.store.Get(key)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, nil
+		}
+		return value, err
+
+	case "set":
+		key, err := in.key(args)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) != 2 {
+			return nil, errors.New("expected 2 arguments")
+		}
+		value, err := toConcat(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if err := in.store.Set(key, value); err != nil {
+			return nil, err
+		}
+		return "OK", nil
+
+	case "incr", "decr":
+		key, err := in.key(args)
+		if err != nil {
+			return nil, err
+		}
+		if name == "incr" {
+			return in.store.Incr(key)
+		}
+		return in.store.Decr(key)
+
+	case "del":
+		key, err := in.key(args)
+		if err != nil {
+			return nil, err
+		}
+		err = in.store.Del(key)
+		if errors.Is(err, store.ErrNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+
+	case "tonumber":
+		if len(args) != 1 {
+			return nil, errors.New("expected 1 argument")
+		}
+		n, err := toInt(args[0])
+		if err != nil {
+			return nil, nil
+		}
+		return n, nil
+
+	case "tostring":
+		if len(args) != 1 {
+			return nil, errors.New("expected 1 argument")
+		}
+		return Format(args[0]), nil
+
+	case "error":
+		if len(args) != 1 {
+			return nil, errors.New("expected 1 argument")
+		}
+		return nil, errors.New(Format(args[0]))
+	}
+
+	return nil, errors.New("attempt to call an undefined function")
+}
+
+// key returns the first argument of a store builtin after checking that it
+// was declared in KEYS and is therefore locked.
+func (in *interp) key(args []any) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("missing key argument")
+	}
+	key, ok := args[0].(string)
+	if !ok {
+		return "", fmt.Errorf("key must be a string, got %s", typeName(args[0]))
+	}
+	if !slices.Contains(in.keys, key) {
+		return "", ErrUndeclaredKey
+	}
+	return key, nil
+}
@@ -0,0 +1,151 @@
+package script
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/store"
+)
+
+func run(t *testing.T, src string, st store.Store, keys, args []string, limits Limits) (any, error) {
+	t.Helper()
+	p, err := Compile(src)
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	return p.Run(st, keys, args, limits)
+}
+
+func TestExpressions(t *testing.T) {
+	tests := []struct {
+		src  string
+		want any
+	}{
+		{"return 1 + 2 * 3", 7},
+		{"return (1 + 2) * 3", 9},
+		{"return -7 / 2", -4},
+		{"return -7 % 3", 2},
+		{"return 'a' .. 1 .. 'b'", "a1b"},
+		{"return 1 < 2 and 'yes' or 'no'", "yes"},
+		{"return not nil", true},
+		{"return #ARGV", 2},
+		{"return ARGV[2]", "y"},
+		{"return ARGV[3]", nil},
+		{"local n = 0 local i = 1 while i <= 10 do n = n + i i = i + 1 end return n", 55},
+		{"if ARGV[1] == 'x' then return 1 elseif true then return 2 else return 3 end", 1},
+		{"return tonumber('12') + 1", 13},
+		{"return tostring(5) .. ''", "5"},
+	}
+
+	for _, tt := range tests {
+		got, err := run(t, tt.src, store.NewHashMapStore(), nil, []string{"x", "y"}, Limits{})
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	src := `
+		-- allow ARGV[1] calls, then refuse
+		local n = incr(KEYS[1])
+		if n > tonumber(ARGV[1]) then
+			decr(KEYS[1])
+			return 0
+		end
+		return 1
+	`
+	st := store.NewShardedStore(4)
+
+	var allowed int
+	for range 5 {
+		got, err := run(t, src, st, []string{"rate:user"}, []string{"3"}, Limits{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		allowed += got.(int)
+	}
+	if allowed != 3 {
+		t.Fatalf("allowed %d calls, want 3", allowed)
+	}
+	if v, _ := st.Get("rate:user"); v != "3" {
+		t.Fatalf("counter = %q, want 3", v)
+	}
+}
+
+func TestUndeclaredKey(t *testing.T) {
+	_, err := run(t, "return get('other')", store.NewHashMapStore(), []string{"key"}, nil, Limits{})
+	if !errors.Is(err, ErrUndeclaredKey) {
+		t.Fatalf("err = %v, want ErrUndeclaredKey", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	loop := "while true do end"
+
+	_, err := run(t, loop, store.NewHashMapStore(), nil, nil, Limits{MaxSteps: 1000})
+	if !errors.Is(err, ErrStepLimit) {
+		t.Fatalf("err = %v, want ErrStepLimit", err)
+	}
+
+	_, err = run(t, loop, store.NewHashMapStore(), nil, nil, Limits{Timeout: 10 * time.Millisecond})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("err = %v, want ErrTimeout", err)
+	}
+}
+
+func TestMemoryLimits(t *testing.T) {
+	// Doubles a string 60 times, which would need an exabyte.
+	double := "local s = 'x' local i = 0 while i < 60 do s = s .. s i = i + 1 end return #s"
+
+	for _, tc := range []struct {
+		limits Limits
+		err    error
+	}{
+		{Limits{MaxStringSize: 1 << 20}, ErrStringLimit},
+		{Limits{MaxMemory: 1 << 20}, ErrMemoryLimit},
+		// Copying bytes costs steps, so the step limit alone stops it.
+		{Limits{MaxSteps: 10_000}, ErrStepLimit},
+	} {
+		start := time.Now()
+		_, err := run(t, double, store.NewHashMapStore(), nil, nil, tc.limits)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%+v: err = %v, want %v", tc.limits, err, tc.err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%+v: stopped after %v", tc.limits, elapsed)
+		}
+	}
+
+	if got, err := run(t, "return #('ab' .. 'cd')", store.NewHashMapStore(), nil, nil, Limits{MaxStringSize: 4, MaxMemory: 4}); err != nil || got != 4 {
+		t.Fatalf("concatenation within the limits = %v, %v", got, err)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, src := range []string{
+		"return (",
+		"if true then",
+		"x = 'unterminated",
+		"local = 1",
+		"return 1 +",
+		// Nesting deep enough to exhaust the stack of the parser or the
+		// interpreter.
+		"return " + strings.Repeat("(", 10_000) + "1" + strings.Repeat(")", 10_000),
+		"return " + strings.Repeat("not ", 10_000) + "true",
+		"return " + strings.Repeat("1 + ", 10_000) + "1",
+		"return 'a'" + strings.Repeat(" .. 'a'", 10_000),
+		"return ARGV" + strings.Repeat("[1]", 10_000),
+		strings.Repeat("if true then ", 10_000) + strings.Repeat("end ", 10_000),
+	} {
+		if _, err := Compile(src); err == nil {
+			t.Errorf("Compile(%q) succeeded", src)
+		}
+	}
+}
@@ -0,0 +1,625 @@
+//go:build linux
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/handler"
+)
+
+const (
+	// readBufferSize is the size of the read buffer shared by all
+	// connections of one event loop.
+	readBufferSize = 64 << 10
+	// maxRetainedBuffer is the largest per-connection buffer kept after it
+	// has been drained; larger ones are released to bound idle memory.
+	maxRetainedBuffer = 16 << 10
+	// sweepInterval is how often timeouts are checked.
+	sweepInterval = time.Second
+)
+
+// reactor multiplexes connections onto a fixed number of event loops, each
+// driven by its own epoll instance, instead of running a goroutine per
+// connection.
+type reactor struct {
+	srv      *Server
+	handler  *handler.Handler
+	loops    []*eventLoop
+	next     atomic.Uint32
+	stopping atomic.Bool
+	wg       sync.WaitGroup
+}
+
+type eventLoop struct {
+	r     *reactor
+	epfd  int
+	file  *os.File
+	poll  syscall.RawConn
+	wakeR int
+	wakeW int
+	buf   []byte
+	mu    sync.Mutex
+	conns map[int]*pollConn
+	// killed holds connections to close on the next wake-up, see
+	// handler.Conn.Kill.
+	killed []*pollConn
+	// finished holds connections whose slow command completed, to resume
+	// on the next wake-up.
+	finished []*pollConn
+	workers  sync.WaitGroup
+}
+
+// pollConn is the reactor's state for a connection. Only the owning event
+// loop touches it after registration.
+type pollConn struct {
+	fd   int
+	conn *handler.Conn
+
+	in  []byte // incomplete frame carried over to the next read
+	out []byte // reply bytes the socket did not accept yet
+
+	lastActive time.Time
+	inSince    time.Time
+	outSince   time.Time
+	closeAfter bool
+	// events are the epoll events the loop waits for.
+	events uint32
+
+	// busy is set while a slow command runs on a worker. The loop neither
+	// reads from the connection nor touches reply and fatal meanwhile,
+	// which belong to the worker.
+	busy  bool
+	reply []byte
+	fatal bool
+}
+
+// Write collects replies written by the Handler, so that every reply
+// produced by one read is sent with a single write.
+func (pc *pollConn) Write(p []byte) (int, error) {
+	if pc.busy {
+		pc.reply = append(pc.reply, p...)
+	} else {
+		pc.out = append(pc.out, p...)
+	}
+	return len(p), nil
+}
+
+// interest returns the events to wait for: reading pauses while the client
+// does not accept its replies and while a slow command runs.
+func (pc *pollConn) interest() uint32 {
+	switch {
+	case len(pc.out) > 0:
+		return syscall.EPOLLOUT
+	case pc.busy:
+		return 0
+	default:
+		return syscall.EPOLLIN | syscall.EPOLLRDHUP
+	}
+}
+
+func newReactor(srv *Server, h *handler.Handler, loops int) (*reactor, error) {
+	if loops <= 0 {
+		loops = runtime.GOMAXPROCS(0)
+	}
+
+	r := &reactor{srv: srv, handler: h}
+	for range loops {
+		l, err := newEventLoop(r)
+		if err != nil {
+			for _, l := range r.loops {
+				l.shutdown()
+			}
+			return nil, err
+		}
+		r.loops = append(r.loops, l)
+	}
+
+	for _, l := range r.loops {
+		r.wg.Add(1)
+		go l.run()
+	}
+	return r, nil
+}
+
+func newEventLoop(r *reactor) (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("epoll_create1: %w", err)
+	}
+
+	var pipe [2]int
+	if err := syscall.Pipe2(pipe[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, fmt.Errorf("pipe2: %w", err)
+	}
+
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(pipe[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, pipe[0], &ev); err != nil {
+		syscall.Close(epfd)
+		syscall.Close(pipe[0])
+		syscall.Close(pipe[1])
+		return nil, fmt.Errorf("epoll_ctl: %w", err)
+	}
+
+	// The epoll descriptor is itself pollable. Handing it to the runtime's
+	// poller lets the loop goroutine park while waiting instead of blocking
+	// an OS thread in epoll_wait.
+	if err := syscall.SetNonblock(epfd, true); err != nil {
+		syscall.Close(epfd)
+		syscall.Close(pipe[0])
+		syscall.Close(pipe[1])
+		return nil, fmt.Errorf("set nonblock: %w", err)
+	}
+	file := os.NewFile(uintptr(epfd), "epoll")
+	poll, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		syscall.Close(pipe[0])
+		syscall.Close(pipe[1])
+		return nil, err
+	}
+
+	return &eventLoop{
+		r:     r,
+		epfd:  epfd,
+		file:  file,
+		poll:  poll,
+		wakeR: pipe[0],
+		wakeW: pipe[1],
+		buf:   make([]byte, readBufferSize),
+		conns: make(map[int]*pollConn),
+	}, nil
+}
+
+// accept hands a freshly accepted connection to one of the event loops.
+func (r *reactor) accept(client net.Conn) {
+	fd, err := connFD(client)
+	if err != nil {
+		slog.Error("failed to register client with event loop", "error", err)
+		client.Close()
+		return
+	}
+
+	l := r.loops[r.next.Add(1)%uint32(len(r.loops))]
+	pc := &pollConn{fd: fd, lastActive: time.Now(), events: syscall.EPOLLIN | syscall.EPOLLRDHUP}
+	pc.conn = handler.NewConn(client,
+		handler.WithLimits(r.srv.limits()),
+		handler.WithWriter(pc),
+		handler.WithKill(func() { l.kill(pc) }),
+	)
+	if !r.srv.track(pc.conn) {
+		return
+	}
+
+	l.mu.Lock()
+	l.conns[fd] = pc
+	l.mu.Unlock()
+
+	ev := syscall.EpollEvent{Events: pc.events, Fd: int32(fd)}
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		slog.Error("failed to register client with event loop", "error", err)
+		l.mu.Lock()
+		delete(l.conns, fd)
+		l.mu.Unlock()
+		r.srv.untrack(pc.conn)
+	}
+}
+
+// stop makes every event loop flush and close its connections and exit.
+// Commands are executed by the loops or by workers the loops wait for, so a
+// command that is running when stop is called still completes and replies.
+func (r *reactor) stop() {
+	if !r.stopping.CompareAndSwap(false, true) {
+		return
+	}
+	for _, l := range r.loops {
+		l.wake()
+	}
+	r.wg.Wait()
+}
+
+func (l *eventLoop) wake() {
+	syscall.Write(l.wakeW, []byte{0})
+}
+
+// kill makes the loop close pc once it is done with the current batch of
+// events. Replies produced by then have been handed to the socket, unless
+// the client stopped reading them.
+func (l *eventLoop) kill(pc *pollConn) {
+	l.mu.Lock()
+	l.killed = append(l.killed, pc)
+	l.mu.Unlock()
+	l.wake()
+}
+
+func (l *eventLoop) closeKilled() {
+	l.mu.Lock()
+	killed := l.killed
+	l.killed = nil
+	l.mu.Unlock()
+
+	for _, pc := range killed {
+		switch {
+		case !l.current(pc):
+		case pc.busy:
+			// Closed once the reply of the running command is sent.
+			pc.closeAfter = true
+		default:
+			l.close(pc)
+		}
+	}
+}
+
+// current reports whether pc is still registered, rather than closed and
+// maybe replaced by a connection that got the same descriptor.
+func (l *eventLoop) current(pc *pollConn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conns[pc.fd] == pc
+}
+
+// offload runs a slow command on a worker. The connection is resumed by the
+// loop once it completes.
+func (l *eventLoop) offload(pc *pollConn, cmd []byte) {
+	pc.busy = true
+	// cmd points into a buffer the loop reuses.
+	cmd = bytes.Clone(cmd)
+
+	l.workers.Add(1)
+	go func() {
+		defer l.workers.Done()
+		pc.fatal = l.execute(pc, cmd)
+
+		l.mu.Lock()
+		l.finished = append(l.finished, pc)
+		l.mu.Unlock()
+		l.wake()
+	}()
+}
+
+// resume sends the replies of finished slow commands and goes on with the
+// frames their clients sent in the meantime.
+func (l *eventLoop) resume() {
+	l.mu.Lock()
+	finished := l.finished
+	l.finished = nil
+	l.mu.Unlock()
+
+	for _, pc := range finished {
+		l.finish(pc)
+		if l.current(pc) {
+			l.consume(pc, pc.in)
+		}
+	}
+}
+
+// finish hands the connection back to the loop after its slow command
+// completed.
+func (l *eventLoop) finish(pc *pollConn) {
+	pc.busy = false
+	pc.lastActive = time.Now()
+	// Frames that arrived meanwhile were not waiting for the client.
+	pc.inSince = time.Time{}
+	pc.out = append(pc.out, pc.reply...)
+	pc.reply = nil
+	if pc.fatal {
+		pc.closeAfter = true
+	}
+}
+
+func (l *eventLoop) run() {
+	defer l.r.wg.Done()
+	defer l.shutdown()
+
+	events := make([]syscall.EpollEvent, 256)
+	lastSweep := time.Now()
+
+	for !l.r.stopping.Load() {
+		n, err := l.wait(events)
+		if err != nil {
+			slog.Error("epoll_wait failed", "error", err)
+			return
+		}
+
+		for _, ev := range events[:n] {
+			fd := int(ev.Fd)
+			if fd == l.wakeR {
+				syscall.Read(l.wakeR, l.buf)
+				continue
+			}
+
+			l.mu.Lock()
+			pc := l.conns[fd]
+			l.mu.Unlock()
+			if pc == nil {
+				continue
+			}
+
+			if ev.Events&(syscall.EPOLLERR|syscall.EPOLLHUP) != 0 {
+				l.close(pc)
+				continue
+			}
+			if ev.Events&syscall.EPOLLOUT != 0 {
+				l.flush(pc)
+			}
+			if ev.Events&(syscall.EPOLLIN|syscall.EPOLLRDHUP) != 0 && !pc.busy {
+				l.read(pc)
+			}
+		}
+
+		l.resume()
+		l.closeKilled()
+
+		if now := time.Now(); now.Sub(lastSweep) >= sweepInterval {
+			l.sweep(now)
+			lastSweep = now
+		}
+	}
+}
+
+// wait returns the next batch of ready events, or none once sweepInterval
+// passed without any.
+func (l *eventLoop) wait(events []syscall.EpollEvent) (int, error) {
+	l.file.SetReadDeadline(time.Now().Add(sweepInterval))
+
+	var (
+		n       int
+		waitErr error
+	)
+	err := l.poll.Read(func(uintptr) bool {
+		n, waitErr = syscall.EpollWait(l.epfd, events, 0)
+		if errors.Is(waitErr, syscall.EINTR) {
+			n, waitErr = 0, nil
+		}
+		return n > 0 || waitErr != nil
+	})
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, waitErr
+}
+
+func (l *eventLoop) read(pc *pollConn) {
+	n, err := syscall.Read(pc.fd, l.buf)
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+		return
+	}
+	if err != nil || n == 0 {
+		l.close(pc)
+		return
+	}
+	l.r.srv.countIn(n)
+	pc.lastActive = time.Now()
+
+	data := l.buf[:n]
+	if len(pc.in) > 0 {
+		pc.in = append(pc.in, data...)
+		data = pc.in
+	}
+	l.consume(pc, data)
+}
+
+// consume executes the complete frames in data, keeps the rest for the next
+// read and sends the replies.
+func (l *eventLoop) consume(pc *pollConn, data []byte) {
+	data = l.process(pc, data)
+
+	if len(data) == 0 {
+		pc.in = pc.in[:0]
+		if cap(pc.in) > maxRetainedBuffer {
+			pc.in = nil
+		}
+		pc.inSince = time.Time{}
+	} else {
+		if pc.inSince.IsZero() {
+			pc.inSince = time.Now()
+		}
+		// data may alias pc.in, so it is moved to the front instead of
+		// being appended.
+		pc.in = append(pc.in[:0], data...)
+	}
+
+	l.flush(pc)
+}
+
+// process executes every complete frame in data and returns the bytes of the
+// trailing incomplete frame, if any. Processing stops after a slow command,
+// which is handed to a worker, and the frames following it are returned.
+func (l *eventLoop) process(pc *pollConn, data []byte) []byte {
+	limits := l.r.srv.limits()
+	for len(data) > 0 && !pc.closeAfter && !pc.busy {
+		n, err := handler.ScanFrame(data, limits.MaxFrameSize)
+		if err != nil {
+			pc.conn.Logger().Error("error handling client request", "error", err)
+			l.r.srv.protocolError()
+			pc.Write(handler.ErrResponse)
+			pc.closeAfter = true
+			return nil
+		}
+		if n == 0 {
+			return data
+		}
+
+		if l.r.handler.Slow(data[:n]) {
+			l.offload(pc, data[:n])
+		} else if l.execute(pc, data[:n]) {
+			pc.closeAfter = true
+			return nil
+		}
+		data = data[n:]
+	}
+	return data
+}
+
+// execute runs a single frame and reports whether the connection must be
+// closed.
+func (l *eventLoop) execute(pc *pollConn, cmd []byte) (fatal bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			pc.conn.Logger().Error("panic while handling client", "error", r, "stack", string(debug.Stack()))
+			fatal = true
+		}
+	}()
+
+	isFatal, err := l.r.handler.Execute(pc.conn, cmd)
+	if err != nil {
+		pc.conn.Logger().Error("error handling client request", "error", err)
+	}
+	return err != nil && isFatal
+}
+
+// flush writes pending replies. Reading is paused while the client does not
+// accept its replies, so a slow reader cannot make its buffer grow without
+// bound.
+func (l *eventLoop) flush(pc *pollConn) {
+	for len(pc.out) > 0 {
+		n, err := syscall.Write(pc.fd, pc.out)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if errors.Is(err, syscall.EAGAIN) {
+			break
+		}
+		if err != nil {
+			l.close(pc)
+			return
+		}
+		l.r.srv.countOut(n)
+		pc.out = pc.out[n:]
+	}
+	pc.conn.SetBuffered(len(pc.in), len(pc.out))
+
+	if len(pc.out) > 0 {
+		if pc.outSince.IsZero() {
+			pc.outSince = time.Now()
+		}
+		l.watch(pc)
+		return
+	}
+
+	pc.out = pc.out[:0]
+	if cap(pc.out) > maxRetainedBuffer {
+		pc.out = nil
+	}
+	pc.outSince = time.Time{}
+	if pc.closeAfter && !pc.busy {
+		l.close(pc)
+		return
+	}
+	l.watch(pc)
+}
+
+// watch updates the events the loop waits for on pc, see interest.
+func (l *eventLoop) watch(pc *pollConn) {
+	events := pc.interest()
+	if events == pc.events {
+		return
+	}
+	pc.events = events
+	ev := syscall.EpollEvent{Events: events, Fd: int32(pc.fd)}
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_MOD, pc.fd, &ev); err != nil {
+		l.close(pc)
+	}
+}
+
+// sweep closes connections that exceeded their idle, read or write timeout.
+// A connection running a slow command is neither idle nor reading.
+func (l *eventLoop) sweep(now time.Time) {
+	limits := l.r.srv.limits()
+
+	l.mu.Lock()
+	var expired []*pollConn
+	for _, pc := range l.conns {
+		switch {
+		case limits.IdleTimeout > 0 && !pc.busy && pc.inSince.IsZero() && len(pc.out) == 0 &&
+			now.Sub(pc.lastActive) > limits.IdleTimeout:
+		case limits.ReadTimeout > 0 && !pc.busy && !pc.inSince.IsZero() && now.Sub(pc.inSince) > limits.ReadTimeout:
+		case limits.WriteTimeout > 0 && !pc.outSince.IsZero() && now.Sub(pc.outSince) > limits.WriteTimeout:
+		default:
+			continue
+		}
+		expired = append(expired, pc)
+	}
+	l.mu.Unlock()
+
+	for _, pc := range expired {
+		pc.conn.Logger().Debug("closing timed out client")
+		l.close(pc)
+	}
+}
+
+func (l *eventLoop) close(pc *pollConn) {
+	l.mu.Lock()
+	_, ok := l.conns[pc.fd]
+	delete(l.conns, pc.fd)
+	l.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, pc.fd, nil)
+	l.r.srv.untrack(pc.conn)
+}
+
+// shutdown waits for running slow commands, sends what is still buffered,
+// best effort, and closes everything the loop owns.
+func (l *eventLoop) shutdown() {
+	l.workers.Wait()
+
+	l.mu.Lock()
+	for _, pc := range l.finished {
+		l.finish(pc)
+	}
+	l.finished = nil
+	conns := make([]*pollConn, 0, len(l.conns))
+	for _, pc := range l.conns {
+		conns = append(conns, pc)
+	}
+	l.mu.Unlock()
+
+	for _, pc := range conns {
+		if len(pc.out) > 0 {
+			n, _ := syscall.Write(pc.fd, pc.out)
+			l.r.srv.countOut(n)
+		}
+		l.close(pc)
+	}
+
+	l.file.Close()
+	syscall.Close(l.wakeR)
+	syscall.Close(l.wakeW)
+}
+
+// connFD returns the file descriptor of a TCP or Unix connection. The
+// descriptor stays owned by conn; it is already in non-blocking mode.
+func connFD(conn net.Conn) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, fmt.Errorf("%T does not expose a file descriptor", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var fd int
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
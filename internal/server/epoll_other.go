@@ -0,0 +1,21 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+
+	"github.com/k1ender/go-stash/internal/handler"
+)
+
+// reactor is only available on Linux; see epoll_linux.go.
+type reactor struct{}
+
+func newReactor(srv *Server, h *handler.Handler, loops int) (*reactor, error) {
+	return nil, errors.New("io_mode epoll is only supported on Linux")
+}
+
+func (r *reactor) accept(client net.Conn) {}
+
+func (r *reactor) stop() {}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/gateway"
+	"github.com/k1ender/go-stash/internal/handler"
+	"github.com/k1ender/go-stash/internal/websocket"
+)
+
+// serveGateway answers requests on the HTTP gateway until Shutdown. Every
+// request runs through h like a command of a connected client, and
+// WebSocket connections like connected clients.
+func (s *Server) serveGateway(h *handler.Handler) {
+	srv := &http.Server{
+		Handler: gateway.New(h,
+			gateway.WithLimits(s.limits),
+			gateway.WithWebSocket(func(conn net.Conn) { s.acceptWebSocket(h, conn) }, s.webSocketOptions),
+		),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	s.mu.Lock()
+	ln := s.httpListener
+	s.httpServer = srv
+	s.mu.Unlock()
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP gateway stopped", "error", err)
+		}
+	}()
+}
+
+// acceptWebSocket serves an upgraded WebSocket connection like a client
+// accepted on a listener. It always runs on its own goroutine, even with
+// io_mode epoll, since the event loops only handle sockets.
+func (s *Server) acceptWebSocket(h *handler.Handler, conn net.Conn) {
+	s.accepted.Add(1)
+	if s.metrics != nil {
+		s.metrics.accepted.Inc()
+	}
+	s.serveClient(h, conn)
+}
+
+// webSocketOptions returns the options of a new WebSocket connection.
+// Browsers may connect from the host of the gateway and from the configured
+// origins.
+func (s *Server) webSocketOptions() websocket.Options {
+	cfg := s.runtime.Config().WebSocket
+	return websocket.Options{
+		MaxMessageSize: int64(cfg.MaxMessageSize),
+		PingInterval:   time.Duration(cfg.PingIntervalMs) * time.Millisecond,
+		CheckOrigin: func(r *http.Request) bool {
+			return websocket.SameOrigin(r) || slices.Contains(cfg.Origins, r.Header.Get("Origin"))
+		},
+	}
+}
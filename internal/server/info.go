@@ -0,0 +1,149 @@
+package server
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/config"
+	"github.com/k1ender/go-stash/internal/handler"
+	"github.com/k1ender/go-stash/internal/store"
+)
+
+const (
+	// opsSampleInterval is how often the command count is sampled for
+	// instantaneous_ops_per_sec.
+	opsSampleInterval = 100 * time.Millisecond
+	// opsSamples is the number of samples averaged.
+	opsSamples = 16
+)
+
+// opsMeter averages the command rate over the last opsSamples intervals.
+type opsMeter struct {
+	mu        sync.Mutex
+	rates     [opsSamples]float64
+	next      int
+	lastCount uint64
+	lastTime  time.Time
+}
+
+func (m *opsMeter) sample(now time.Time, count uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.lastTime.IsZero() {
+		if elapsed := now.Sub(m.lastTime).Seconds(); elapsed > 0 {
+			m.rates[m.next] = float64(count-m.lastCount) / elapsed
+			m.next = (m.next + 1) % opsSamples
+		}
+	}
+	m.lastCount = count
+	m.lastTime = now
+}
+
+func (m *opsMeter) rate() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sum float64
+	for _, r := range m.rates {
+		sum += r
+	}
+	return int(sum / opsSamples)
+}
+
+// measureOps samples the handler's command count until the server shuts
+// down.
+func (s *Server) measureOps(h *handler.Handler) {
+	ticker := time.NewTicker(opsSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.ops.sample(now, h.CommandsProcessed())
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// infoSections returns the INFO sections describing the server process.
+func (s *Server) infoSections() []handler.InfoSection {
+	return []handler.InfoSection{
+		{Name: "Server", Fields: s.serverInfo},
+		{Name: "Clients", Fields: s.clientsInfo},
+		{Name: "Memory", Fields: s.memoryInfo},
+		{Name: "Stats", Fields: s.statsInfo},
+	}
+}
+
+func (s *Server) serverInfo() []handler.InfoField {
+	uptime := time.Since(s.started)
+	ioMode := s.cfg.IOMode
+	if ioMode == "" {
+		ioMode = IOModeGoroutine
+	}
+	return []handler.InfoField{
+		{Name: "go_version", Value: runtime.Version()},
+		{Name: "os", Value: runtime.GOOS + "/" + runtime.GOARCH},
+		{Name: "process_id", Value: strconv.Itoa(os.Getpid())},
+		{Name: "gomaxprocs", Value: strconv.Itoa(runtime.GOMAXPROCS(0))},
+		{Name: "io_mode", Value: ioMode},
+		{Name: "tcp_addr", Value: s.Addr().String()},
+		{Name: "listeners", Value: s.listenerAddrs()},
+		{Name: "uptime_in_seconds", Value: strconv.Itoa(int(uptime.Seconds()))},
+		{Name: "uptime_in_days", Value: strconv.Itoa(int(uptime.Hours() / 24))},
+	}
+}
+
+// listenerAddrs returns the addresses of all listeners separated by
+// commas, with Unix sockets prefixed like in the listeners option.
+func (s *Server) listenerAddrs() string {
+	var addrs []string
+	for _, addr := range s.Addrs() {
+		if addr.Network() == "unix" {
+			addrs = append(addrs, config.UnixPrefix+addr.String())
+		} else {
+			addrs = append(addrs, addr.String())
+		}
+	}
+	return strings.Join(addrs, ",")
+}
+
+func (s *Server) clientsInfo() []handler.InfoField {
+	connected := s.clients.Len()
+	return []handler.InfoField{
+		{Name: "connected_clients", Value: strconv.Itoa(connected)},
+		{Name: "max_clients", Value: strconv.Itoa(s.runtime.Config().MaxClients)},
+	}
+}
+
+func (s *Server) memoryInfo() []handler.InfoField {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	fields := []handler.InfoField{
+		{Name: "used_memory", Value: strconv.FormatUint(ms.HeapAlloc, 10)},
+		{Name: "used_memory_sys", Value: strconv.FormatUint(ms.Sys, 10)},
+		{Name: "heap_objects", Value: strconv.FormatUint(ms.HeapObjects, 10)},
+		{Name: "gc_cycles", Value: strconv.FormatUint(uint64(ms.NumGC), 10)},
+		{Name: "gc_pause_total_ns", Value: strconv.FormatUint(ms.PauseTotalNs, 10)},
+		{Name: "goroutines", Value: strconv.Itoa(runtime.NumGoroutine())},
+	}
+	if st, ok := s.store.(store.StatsReporter); ok {
+		var bytes int
+		for _, stat := range st.Stats() {
+			bytes += stat.Bytes
+		}
+		fields = append(fields, handler.InfoField{Name: "used_memory_dataset", Value: strconv.Itoa(bytes)})
+	}
+	return fields
+}
+
+func (s *Server) statsInfo() []handler.InfoField {
+	return []handler.InfoField{
+		{Name: "total_connections_received", Value: strconv.FormatUint(s.accepted.Load(), 10)},
+		{Name: "instantaneous_ops_per_sec", Value: strconv.Itoa(s.ops.rate())},
+	}
+}
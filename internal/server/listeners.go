@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/config"
+)
+
+// listen binds e. Unix sockets left behind by a server that did not shut
+// down cleanly are removed first; the listener removes its socket again
+// when it is closed.
+func listen(e config.Endpoint) (net.Listener, error) {
+	if e.Network != "unix" {
+		return net.Listen(e.Network, e.Address)
+	}
+
+	if err := removeStaleSocket(e.Address); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", e.Address)
+	if err != nil {
+		return nil, err
+	}
+	if e.Mode != 0 {
+		if err := os.Chmod(e.Address, e.Mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket file at path unless a process still
+// accepts connections on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/metrics"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/acl"
+	"github.com/k1ender/go-stash/internal/auth"
+	"github.com/k1ender/go-stash/internal/handler"
+	prom "github.com/k1ender/go-stash/internal/metrics"
+	"github.com/k1ender/go-stash/internal/script"
+	"github.com/k1ender/go-stash/internal/store"
+)
+
+// serverMetrics holds what the server exposes on metrics_addr.
+type serverMetrics struct {
+	registry *prom.Registry
+
+	calls    *prom.CounterVec
+	duration *prom.HistogramVec
+	// commands caches the children of calls and duration for each command,
+	// so the hot path does not build label strings.
+	commands sync.Map // handler.Command -> *commandMetrics
+
+	errors   *prom.CounterVec
+	hits     *prom.Counter
+	misses   *prom.Counter
+	bytesIn  *prom.Counter
+	bytesOut *prom.Counter
+	accepted *prom.Counter
+}
+
+type commandMetrics struct {
+	calls    *prom.Counter
+	duration *prom.Histogram
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	r := prom.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		calls:    r.NewCounterVec("gostash_commands_total", "Commands processed, by command.", "command"),
+		duration: r.NewHistogramVec("gostash_command_duration_seconds", "Time spent processing commands, by command.", prom.DefBuckets, "command"),
+		errors:   r.NewCounterVec("gostash_errors_total", "Commands answered with ERR, by cause.", "type"),
+		hits:     r.NewCounter("gostash_keyspace_hits_total", "GET commands that found their key."),
+		misses:   r.NewCounter("gostash_keyspace_misses_total", "GET commands that did not find their key."),
+		bytesIn:  r.NewCounter("gostash_net_input_bytes_total", "Bytes read from clients."),
+		bytesOut: r.NewCounter("gostash_net_output_bytes_total", "Bytes written to clients."),
+		accepted: r.NewCounter("gostash_connections_total", "Client connections accepted."),
+	}
+
+	// Keys never expire and are never evicted yet; the counters are exposed
+	// so dashboards and alerts can be set up ahead of time.
+	r.NewCounter("gostash_expired_keys_total", "Keys removed because their TTL elapsed.")
+	r.NewCounter("gostash_evicted_keys_total", "Keys removed to stay within the memory limit.")
+
+	r.NewGaugeFunc("gostash_connected_clients", "Clients currently connected.", func() float64 {
+		return float64(s.clients.Len())
+	})
+
+	if st, ok := s.store.(store.StatsReporter); ok {
+		shardSamples := func(value func(store.ShardStats) int) func() []prom.Sample {
+			return func() []prom.Sample {
+				stats := st.Stats()
+				samples := make([]prom.Sample, len(stats))
+				for i, stat := range stats {
+					samples[i] = prom.Sample{LabelValues: []string{strconv.Itoa(i)}, Value: float64(value(stat))}
+				}
+				return samples
+			}
+		}
+		r.NewGaugeVecFunc("gostash_keys", "Keys stored, by shard.",
+			shardSamples(func(st store.ShardStats) int { return st.Keys }), "shard")
+		r.NewGaugeVecFunc("gostash_store_bytes", "Estimated memory used by keys and values, by shard.",
+			shardSamples(func(st store.ShardStats) int { return st.Bytes }), "shard")
+	}
+
+	heap := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	var heapMu sync.Mutex
+	r.NewGaugeFunc("gostash_heap_bytes", "Memory occupied by live and not yet freed heap objects.", func() float64 {
+		heapMu.Lock()
+		defer heapMu.Unlock()
+		metrics.Read(heap)
+		return float64(heap[0].Value.Uint64())
+	})
+	return m
+}
+
+// command returns the metrics of a command, using "unknown" for commands
+// that are not registered.
+func (m *serverMetrics) command(req *handler.Request) *commandMetrics {
+	key := req.Command
+	if !req.Known() {
+		key = handler.Command{}
+	}
+	if cm, ok := m.commands.Load(key); ok {
+		return cm.(*commandMetrics)
+	}
+
+	label := "unknown"
+	if req.Known() {
+		label = req.Command.String()
+	}
+	cm, _ := m.commands.LoadOrStore(key, &commandMetrics{
+		calls:    m.calls.With(label),
+		duration: m.duration.With(label),
+	})
+	return cm.(*commandMetrics)
+}
+
+// middleware counts and times every command. Commands run by EXE are
+// counted as part of the EXE.
+func (m *serverMetrics) middleware(next handler.HandlerFunc) handler.HandlerFunc {
+	return func(req *handler.Request) (handler.Response, error) {
+		start := time.Now()
+		resp, err := next(req)
+		elapsed := time.Since(start)
+
+		cm := m.command(req)
+		cm.calls.Inc()
+		cm.duration.Observe(elapsed.Seconds())
+
+		if req.Command == handler.GetCommand && !req.Conn.InTransaction() {
+			switch {
+			case err == nil:
+				m.hits.Inc()
+			case errors.Is(err, store.ErrNotFound):
+				m.misses.Inc()
+			}
+		}
+		if err != nil {
+			m.errors.With(errorType(err)).Inc()
+		}
+		return resp, err
+	}
+}
+
+// errorType classifies command errors for gostash_errors_total.
+func errorType(err error) string {
+	switch {
+	case errors.Is(err, handler.ErrUnknownCommand):
+		return "unknown_command"
+	case errors.Is(err, store.ErrNotFound):
+		return "not_found"
+	case errors.Is(err, handler.ErrNoAuth),
+		errors.Is(err, auth.ErrInvalidCredentials),
+		errors.Is(err, auth.ErrTooManyAttempts):
+		return "auth"
+	case errors.Is(err, acl.ErrCommandDenied), errors.Is(err, acl.ErrKeyDenied):
+		return "acl"
+	case errors.Is(err, script.ErrStepLimit), errors.Is(err, script.ErrTimeout),
+		errors.Is(err, script.ErrStringLimit), errors.Is(err, script.ErrMemoryLimit):
+		return "script_limit"
+	default:
+		return "command"
+	}
+}
+
+// protocolError counts a frame that could not be read.
+func (s *Server) protocolError() {
+	if s.metrics != nil {
+		s.metrics.errors.With("protocol").Inc()
+	}
+}
+
+func (s *Server) countIn(n int) {
+	if s.metrics != nil && n > 0 {
+		s.metrics.bytesIn.Add(uint64(n))
+	}
+}
+
+func (s *Server) countOut(n int) {
+	if s.metrics != nil && n > 0 {
+		s.metrics.bytesOut.Add(uint64(n))
+	}
+}
+
+// countingConn counts the bytes read from and written to a client in
+// goroutine mode.
+type countingConn struct {
+	net.Conn
+	srv *Server
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.srv.countIn(n)
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.srv.countOut(n)
+	return n, err
+}
+
+// serveMetrics answers scrapes on the metrics listener until Shutdown.
+func (s *Server) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", s.metrics.registry)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	s.mu.Lock()
+	ln := s.metricsListener
+	s.metricsServer = srv
+	s.mu.Unlock()
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics endpoint stopped", "error", err)
+		}
+	}()
+}
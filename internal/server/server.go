@@ -1,68 +1,646 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/k1ender/go-stash/internal/acl"
+	"github.com/k1ender/go-stash/internal/auth"
 	"github.com/k1ender/go-stash/internal/config"
 	"github.com/k1ender/go-stash/internal/handler"
+	"github.com/k1ender/go-stash/internal/script"
+	"github.com/k1ender/go-stash/internal/slowlog"
 	"github.com/k1ender/go-stash/internal/store"
+	"github.com/k1ender/go-stash/internal/tlsconfig"
+)
+
+// ErrServerClosed is returned by Start after Shutdown was called.
+var ErrServerClosed = errors.New("server closed")
+
+const (
+	IOModeGoroutine = "goroutine"
+	IOModeEpoll     = "epoll"
+)
+
+// rejectTimeout bounds writing the reply to a client rejected because of
+// max_clients, which for TLS includes the handshake.
+const rejectTimeout = time.Second
+
+const (
+	StoreSharded = "sharded"
+	StoreHashMap = "hashmap"
 )
 
 type Server struct {
-	cfg *config.Config
+	// cfg is the configuration the server started with. Options that can
+	// change at runtime are read from runtime instead.
+	cfg     *config.Config
+	runtime *config.Runtime
+	store   store.Store
+
+	// metrics is nil unless metrics_addr is set.
+	metrics *serverMetrics
+	// clients holds every connection accepted and not closed yet. It is
+	// only changed while holding mu.
+	clients *handler.Clients
+
+	mu              sync.Mutex
+	base            net.Listener
+	listeners       []net.Listener
+	metricsListener net.Listener
+	metricsServer   *http.Server
+	httpListener    net.Listener
+	httpServer      *http.Server
+	reactor         *reactor
+	onShutdown      []func(context.Context) error
+
+	started  time.Time
+	accepted atomic.Uint64
+	ops      opsMeter
+
+	closing atomic.Bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type Arg func(s *Server)
+
+// WithListener makes the server accept connections from ln instead of
+// listening on the configured host and port.
+func WithListener(ln net.Listener) Arg {
+	return func(s *Server) {
+		s.base = ln
+	}
 }
 
-func NewServer(cfg *config.Config) *Server {
-	return &Server{
-		cfg: cfg,
+// WithStore makes the server serve st instead of a store created from the
+// configuration.
+func WithStore(st store.Store) Arg {
+	return func(s *Server) {
+		s.store = st
 	}
 }
 
-func (s *Server) Start() {
-	defer func() {
-		if r := recover(); r != nil {
-			slog.Error("server crashed", "error", r)
+// WithRuntime makes CFG and the server's mutable options use rt, whose
+// configuration must be the one passed to NewServer. It lets the caller
+// change options, e.g. when the configuration file is reloaded.
+func WithRuntime(rt *config.Runtime) Arg {
+	return func(s *Server) {
+		s.runtime = rt
+	}
+}
+
+func NewServer(cfg *config.Config, args ...Arg) *Server {
+	s := &Server{
+		cfg:     cfg,
+		clients: handler.NewClients(),
+		done:    make(chan struct{}),
+	}
+	for _, arg := range args {
+		arg(s)
+	}
+	if s.runtime == nil {
+		s.runtime = config.NewRuntime(cfg)
+	}
+
+	if s.store == nil {
+		switch cfg.Store {
+		case StoreHashMap:
+			s.store = store.NewHashMapStore()
+		default:
+			s.store = store.NewShardedStore(cfg.Shards)
 		}
-	}()
+	}
+	if cfg.MetricsAddr != "" {
+		s.metrics = newServerMetrics(s)
+	}
+	return s
+}
 
-	conn, err := net.Listen(
-		"tcp",
-		net.JoinHostPort(
-			s.cfg.Host,
-			fmt.Sprintf("%d", s.cfg.Port),
-		),
+// Runtime returns the configuration of the server that can change while it
+// runs.
+func (s *Server) Runtime() *config.Runtime {
+	return s.runtime
+}
+
+// Store returns the store the server serves.
+func (s *Server) Store() store.Store {
+	return s.store
+}
+
+// Listen binds the server's addresses, see config.Config.Endpoints. Start
+// calls it if it has not been called yet; calling it first allows reading
+// Addr before serving. With TLS configured, TCP listeners and the HTTP
+// gateway serve TLS while Unix sockets stay plaintext.
+func (s *Server) Listen() error {
+	var lns []net.Listener
+	closeAll := func() {
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}
+
+	if s.base != nil {
+		lns = append(lns, s.base)
+	} else {
+		endpoints, err := s.cfg.Endpoints()
+		if err != nil {
+			return err
+		}
+		for _, e := range endpoints {
+			ln, err := listen(e)
+			if err != nil {
+				closeAll()
+				return fmt.Errorf("failed to listen on %s: %w", e, err)
+			}
+			lns = append(lns, ln)
+		}
+	}
+
+	var tlsCfg *tls.Config
+	if s.cfg.TLS.CertFile != "" {
+		var err error
+		tlsCfg, err = tlsconfig.NewServerConfig(tlsconfig.ServerOptions{
+			CertFile:   s.cfg.TLS.CertFile,
+			KeyFile:    s.cfg.TLS.KeyFile,
+			CAFile:     s.cfg.TLS.CAFile,
+			ClientAuth: s.cfg.TLS.ClientAuth,
+		})
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("failed to configure TLS: %w", err)
+		}
+		for i, ln := range lns {
+			if ln.Addr().Network() == "tcp" {
+				lns[i] = tls.NewListener(ln, tlsCfg)
+			}
+		}
+	}
+
+	var metricsLn net.Listener
+	if s.cfg.MetricsAddr != "" {
+		var err error
+		metricsLn, err = net.Listen("tcp", s.cfg.MetricsAddr)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("failed to listen on metrics_addr: %w", err)
+		}
+	}
+
+	var httpLn net.Listener
+	if s.cfg.HTTPAddr != "" {
+		var err error
+		httpLn, err = net.Listen("tcp", s.cfg.HTTPAddr)
+		if err != nil {
+			closeAll()
+			if metricsLn != nil {
+				metricsLn.Close()
+			}
+			return fmt.Errorf("failed to listen on http_addr: %w", err)
+		}
+		if tlsCfg != nil {
+			httpLn = tls.NewListener(httpLn, tlsCfg)
+		}
+	}
+
+	s.mu.Lock()
+	s.listeners = lns
+	s.metricsListener = metricsLn
+	s.httpListener = httpLn
+	s.mu.Unlock()
+	return nil
+}
+
+// MetricsAddr returns the address of the metrics endpoint, or nil if it is
+// disabled or Listen has not been called.
+func (s *Server) MetricsAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.metricsListener == nil {
+		return nil
+	}
+	return s.metricsListener.Addr()
+}
+
+// HTTPAddr returns the address of the HTTP gateway, or nil if it is
+// disabled or Listen has not been called.
+func (s *Server) HTTPAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.httpListener == nil {
+		return nil
+	}
+	return s.httpListener.Addr()
+}
+
+// Addr returns the first address the server listens on, or nil before
+// Listen.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
+
+// Addrs returns every address the server listens on, in the order of the
+// listeners option.
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, ln := range s.listeners {
+		addrs[i] = ln.Addr()
+	}
+	return addrs
+}
+
+// RegisterOnShutdown registers a function to call once all connections have
+// been drained during Shutdown, e.g. to flush persisted state.
+func (s *Server) RegisterOnShutdown(f func(context.Context) error) {
+	s.mu.Lock()
+	s.onShutdown = append(s.onShutdown, f)
+	s.mu.Unlock()
+}
+
+// Start serves clients until ctx is done or Shutdown is called. When ctx is
+// done the server shuts down within the configured shutdown timeout and
+// Start returns the result of that shutdown. After an explicit Shutdown,
+// Start returns ErrServerClosed.
+func (s *Server) Start(ctx context.Context) error {
+	if s.Addr() == nil {
+		if err := s.Listen(); err != nil {
+			return err
+		}
+	}
+
+	switch s.cfg.Store {
+	case StoreSharded, StoreHashMap, "":
+	default:
+		s.closeListeners()
+		return fmt.Errorf("unknown store %q", s.cfg.Store)
+	}
+
+	cfg := s.runtime.Config()
+	slowLog := slowlog.New(
+		time.Duration(cfg.SlowLog.ThresholdUs)*time.Microsecond,
+		cfg.SlowLog.MaxLen,
 	)
-	if err != nil {
-		// FIXME: proper logging
-		panic(err)
+	handlerArgs := []handler.Arg{
+		handler.WithScriptLimits(scriptLimits(cfg)),
+		handler.WithScriptCacheSize(int(cfg.Script.CacheSize)),
+		handler.WithInfo(s.infoSections()...),
+		handler.WithClients(s.clients),
+		handler.WithSlowLog(slowLog),
+		handler.WithConfig(s.runtime),
+	}
+	if s.cfg.Users != "" {
+		users, err := auth.ParseUsers(s.cfg.Users)
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("invalid users: %w", err)
+		}
+		authenticator, err := auth.NewAuthenticator(users)
+		if err != nil {
+			s.closeListeners()
+			return err
+		}
+		handlerArgs = append(handlerArgs, handler.WithAuthenticator(authenticator))
+	}
+
+	if s.cfg.ACL != "" {
+		list, err := acl.Parse(s.cfg.ACL)
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("invalid acl: %w", err)
+		}
+		handlerArgs = append(handlerArgs, handler.WithACL(list))
+	}
+
+	if s.metrics != nil {
+		handlerArgs = append(handlerArgs, handler.WithMiddleware(s.metrics.middleware))
+	}
+
+	newHandler := handler.NewHandler(s.store, handlerArgs...)
+	s.registerHooks(newHandler, slowLog)
+
+	switch s.cfg.IOMode {
+	case IOModeGoroutine, "":
+	case IOModeEpoll:
+		if s.cfg.TLS.CertFile != "" {
+			s.closeListeners()
+			return errors.New("io_mode epoll does not support TLS")
+		}
+		r, err := newReactor(s, newHandler, s.cfg.EventLoops)
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("failed to start event loops: %w", err)
+		}
+		s.mu.Lock()
+		s.reactor = r
+		s.mu.Unlock()
+	default:
+		s.closeListeners()
+		return fmt.Errorf("unknown io_mode %q", s.cfg.IOMode)
+	}
+
+	if s.metrics != nil {
+		s.serveMetrics()
 	}
-	defer conn.Close()
+	if s.httpListener != nil {
+		s.serveGateway(newHandler)
+	}
+	s.started = time.Now()
+	go s.measureOps(newHandler)
 
-	shardedStore := store.NewShardedStore(32)
+	stopped := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			timeout := time.Duration(s.runtime.Config().ShutdownTimeoutMs) * time.Millisecond
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			stopped <- s.Shutdown(shutdownCtx)
+		case <-s.done:
+			stopped <- ErrServerClosed
+		}
+	}()
 
-	newHandler := handler.NewHandler(shardedStore)
+	slog.Info("server started", "listeners", s.listenerAddrs(), "io_mode", s.cfg.IOMode)
 
-	fmt.Printf("Server started on %s:%d\n", s.cfg.Host, s.cfg.Port)
+	// Every listener feeds the same handler.
+	var acceptors sync.WaitGroup
+	for _, ln := range s.listeners {
+		acceptors.Add(1)
+		go func() {
+			defer acceptors.Done()
+			s.accept(ln, newHandler)
+		}()
+	}
+	acceptors.Wait()
+	return <-stopped
+}
 
+// accept serves the clients of ln until the server shuts down.
+func (s *Server) accept(ln net.Listener, newHandler *handler.Handler) {
+	var delay time.Duration
 	for {
-		client, err := conn.Accept()
+		client, err := ln.Accept()
 		if err != nil {
+			if s.closing.Load() {
+				return
+			}
+			// Errors like running out of file descriptors last a while, so
+			// back off like net/http instead of spinning.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay = min(2*delay, time.Second)
+			}
+			slog.Error("failed to accept client", "listener", ln.Addr(), "error", err, "retry_in", delay)
+			select {
+			case <-time.After(delay):
+			case <-s.done:
+				return
+			}
 			continue
 		}
+		delay = 0
 
-		go func(client net.Conn) {
-			defer client.Close()
-			for {
-				isFatal, err := newHandler.Handle(client)
-				if err != nil {
-					slog.Error("error handling client request", "error", err)
-					if isFatal {
-						return
-					}
-				}
+		s.accepted.Add(1)
+		if s.metrics != nil {
+			s.metrics.accepted.Inc()
+		}
+		if s.reactor != nil {
+			s.reactor.accept(client)
+			continue
+		}
+
+		s.serveClient(newHandler, client)
+	}
+}
+
+// serveClient starts serving client on its own goroutine, unless the server
+// is shutting down or full.
+func (s *Server) serveClient(h *handler.Handler, client net.Conn) {
+	if s.metrics != nil {
+		client = &countingConn{Conn: client, srv: s}
+	}
+	conn := handler.NewConn(client, handler.WithLimits(s.limits()))
+	if !s.track(conn) {
+		return
+	}
+	go s.serve(h, conn)
+}
+
+// Shutdown stops accepting new clients, closes idle connections and waits
+// for in-flight commands and HTTP requests to finish. If ctx is done first,
+// the remaining connections are closed forcibly and ctx's error is
+// returned. Shutdown hooks run in both cases.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.closing.CompareAndSwap(false, true) {
+		close(s.done)
+
+		s.mu.Lock()
+		for _, ln := range s.listeners {
+			ln.Close()
+		}
+		if s.metricsServer == nil && s.metricsListener != nil {
+			s.metricsListener.Close()
+		}
+		if s.httpServer == nil && s.httpListener != nil {
+			s.httpListener.Close()
+		}
+		// Connections waiting for their next command are unblocked right
+		// away; busy ones notice closing after writing their reply.
+		for _, conn := range s.clients.All() {
+			conn.Interrupt()
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	r := s.reactor
+	var httpServers []*http.Server
+	for _, srv := range []*http.Server{s.metricsServer, s.httpServer} {
+		if srv != nil {
+			httpServers = append(httpServers, srv)
+		}
+	}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, srv := range httpServers {
+			wg.Go(func() { srv.Shutdown(ctx) })
+		}
+		if r != nil {
+			r.stop()
+		}
+		s.wg.Wait()
+		wg.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		s.mu.Lock()
+		for _, conn := range s.clients.All() {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		for _, srv := range httpServers {
+			srv.Close()
+		}
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	hooks := s.onShutdown
+	s.mu.Unlock()
+	for _, hook := range hooks {
+		err = errors.Join(err, hook(ctx))
+	}
+	return err
+}
+
+// closeListeners closes the listeners bound by Listen when Start fails.
+func (s *Server) closeListeners() {
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	if s.metricsListener != nil {
+		s.metricsListener.Close()
+	}
+	if s.httpListener != nil {
+		s.httpListener.Close()
+	}
+}
+
+// limits returns the limits of new connections. Connections keep the limits
+// they were accepted with.
+func (s *Server) limits() handler.Limits {
+	cfg := s.runtime.Config()
+	return handler.Limits{
+		MaxFrameSize: int(cfg.MaxFrameSize),
+		IdleTimeout:  time.Duration(cfg.IdleTimeoutMs) * time.Millisecond,
+		ReadTimeout:  time.Duration(cfg.ReadTimeoutMs) * time.Millisecond,
+		WriteTimeout: time.Duration(cfg.WriteTimeoutMs) * time.Millisecond,
+	}
+}
+
+// registerHooks applies changes of mutable options to the subsystems that
+// copied them at startup. The other mutable options are read from the
+// runtime configuration whenever they are used.
+func (s *Server) registerHooks(h *handler.Handler, slowLog *slowlog.Log) {
+	s.runtime.OnChange("slowlog_threshold_us", func(cfg *config.Config) error {
+		slowLog.SetThreshold(time.Duration(cfg.SlowLog.ThresholdUs) * time.Microsecond)
+		return nil
+	})
+	s.runtime.OnChange("slowlog_max_len", func(cfg *config.Config) error {
+		slowLog.SetMaxLen(cfg.SlowLog.MaxLen)
+		return nil
+	})
+	setScriptLimits := func(cfg *config.Config) error {
+		h.SetScriptLimits(scriptLimits(cfg))
+		return nil
+	}
+	for _, option := range []string{"script_max_steps", "script_timeout_ms", "script_max_string_size", "script_max_memory"} {
+		s.runtime.OnChange(option, setScriptLimits)
+	}
+}
+
+func scriptLimits(cfg *config.Config) script.Limits {
+	return script.Limits{
+		MaxSteps:      cfg.Script.MaxSteps,
+		Timeout:       time.Duration(cfg.Script.TimeoutMs) * time.Millisecond,
+		MaxStringSize: int(cfg.Script.MaxStringSize),
+		MaxMemory:     int(cfg.Script.MaxMemory),
+	}
+}
+
+// track registers a new connection. It refuses the connection while the
+// server shuts down or when max_clients connections are already open, and
+// then closes it.
+func (s *Server) track(conn *handler.Conn) bool {
+	s.mu.Lock()
+	if s.closing.Load() {
+		s.mu.Unlock()
+		conn.Conn.Close()
+		return false
+	}
+	if maxClients := s.runtime.Config().MaxClients; maxClients > 0 && s.clients.Len() >= maxClients {
+		s.mu.Unlock()
+		slog.Warn("rejecting client, max_clients reached", "remote", conn.RemoteAddr(), "max_clients", maxClients)
+		go reject(conn.Conn)
+		return false
+	}
+	s.clients.Add(conn)
+	s.wg.Add(1)
+	s.mu.Unlock()
+	return true
+}
+
+// reject replies ERR to a client and closes it. The reply is written to the
+// socket directly, since the Conn may buffer replies for an event loop that
+// never sees this connection, and with a deadline, since a client that never
+// reads or finishes its TLS handshake would block it forever.
+func reject(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	conn.Write(handler.ErrResponse)
+	conn.Close()
+}
+
+func (s *Server) untrack(conn *handler.Conn) {
+	s.mu.Lock()
+	s.clients.Remove(conn)
+	s.mu.Unlock()
+	conn.Close()
+	s.wg.Done()
+}
+
+func (s *Server) serve(h *handler.Handler, client *handler.Conn) {
+	defer s.untrack(client)
+	defer func() {
+		if r := recover(); r != nil {
+			client.Logger().Error("panic while handling client", "error", r, "stack", string(debug.Stack()))
+		}
+	}()
+
+	for !s.closing.Load() {
+		isFatal, err := h.Handle(client)
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if !s.closing.Load() {
+				client.Logger().Debug("closing timed out client")
 			}
-		}(client)
+			return
+		}
+		if err != nil {
+			if errors.Is(err, handler.ErrMalformedFrame) || errors.Is(err, handler.ErrFrameTooLarge) {
+				s.protocolError()
+			}
+			client.Logger().Error("error handling client request", "error", err)
+			if isFatal {
+				return
+			}
+		}
 	}
 }
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/k1ender/go-stash/internal/handler"
+)
+
+func benchmarkModes(b *testing.B, run func(b *testing.B, addr string)) {
+	for _, mode := range []string{IOModeGoroutine, IOModeEpoll} {
+		b.Run(mode, func(b *testing.B) {
+			cfg := testConfig()
+			cfg.IOMode = mode
+			srv := NewServer(cfg)
+			if err := srv.Listen(); err != nil {
+				b.Fatal(err)
+			}
+			go srv.Start(context.Background())
+			defer srv.Shutdown(context.Background())
+
+			run(b, srv.Addr().String())
+		})
+	}
+}
+
+func BenchmarkServerSet(b *testing.B) {
+	benchmarkModes(b, func(b *testing.B, addr string) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+
+		cmd := handler.SerializeArgs(handler.SetCommand, "foo", "bar")
+		buf := make([]byte, 128)
+
+		for b.Loop() {
+			conn.Write(cmd)
+			conn.Read(buf)
+		}
+	})
+}
+
+// BenchmarkServerManyClients spreads requests over many mostly idle
+// connections, which is where the event loop mode saves memory.
+func BenchmarkServerManyClients(b *testing.B) {
+	const clients = 1000
+
+	benchmarkModes(b, func(b *testing.B, addr string) {
+		conns := make([]net.Conn, clients)
+		for i := range conns {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			conns[i] = conn
+		}
+
+		buf := make([]byte, 128)
+
+		for i := 0; b.Loop(); i++ {
+			conn := conns[i%clients]
+			conn.Write(handler.SerializeArgs(handler.SetCommand, fmt.Sprintf("key_%d", i%clients), "value"))
+			conn.Read(buf)
+		}
+	})
+}
@@ -0,0 +1,701 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/config"
+	"github.com/k1ender/go-stash/internal/handler"
+	"github.com/k1ender/go-stash/internal/tlsconfig"
+	"github.com/k1ender/go-stash/internal/tlsconfig/tlstest"
+)
+
+func testConfig() *config.Config {
+	return &config.Config{
+		Host:              "127.0.0.1",
+		Port:              0,
+		ShutdownTimeoutMs: 1000,
+	}
+}
+
+// startServer starts a server on an ephemeral port and returns it together
+// with the channel Start's result is delivered on.
+func startServer(t *testing.T, ctx context.Context, cfg *config.Config) (*Server, <-chan error) {
+	t.Helper()
+	srv := NewServer(cfg)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan error, 1)
+	go func() { result <- srv.Start(ctx) }()
+	return srv, result
+}
+
+func TestShutdownClosesIdleConnections(t *testing.T) {
+	srv, result := startServer(t, context.Background(), testConfig())
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	conn.Write(handler.SerializeArgs(handler.SetCommand, "k", "v"))
+	if line, err := r.ReadString('\n'); err != nil || line != "OK\r\n" {
+		t.Fatalf("SET = %q, %v", line, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := <-result; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Start = %v, want ErrServerClosed", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadByte(); err == nil {
+		t.Fatal("idle connection still open after Shutdown")
+	}
+	if _, err := net.Dial("tcp", srv.Addr().String()); err == nil {
+		t.Fatal("server still accepting after Shutdown")
+	}
+}
+
+// failingListener fails every Accept, like a listener out of file
+// descriptors.
+type failingListener struct {
+	net.Listener
+	calls atomic.Int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.calls.Add(1)
+	return nil, errors.New("accept: too many open files")
+}
+
+func TestAcceptBacksOff(t *testing.T) {
+	srv := NewServer(testConfig())
+	ln := &failingListener{}
+	ln.Listener, _ = net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Listener.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.accept(ln, nil)
+		close(stopped)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	srv.closing.Store(true)
+	close(srv.done)
+	<-stopped
+
+	// 5, 10, 20, 40 and 80ms of delay fit in 200ms.
+	if calls := ln.calls.Load(); calls > 10 {
+		t.Fatalf("Accept called %d times in 200ms", calls)
+	}
+}
+
+func TestStartFromDefaults(t *testing.T) {
+	cfg, err := config.LoadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Host, cfg.Port = "127.0.0.1", 0
+	srv, result := startServer(t, context.Background(), cfg)
+	defer func() {
+		srv.Shutdown(context.Background())
+		<-result
+	}()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(handler.SerializeArgs(handler.PingCommand))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "PONG\r\n" {
+		t.Fatalf("PIN = %q, %v", line, err)
+	}
+}
+
+func TestStartStopsOnContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv, result := startServer(t, ctx, testConfig())
+
+	hookRan := false
+	srv.RegisterOnShutdown(func(context.Context) error {
+		hookRan = true
+		return nil
+	})
+
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("Start = %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start did not return after cancel")
+	}
+	if !hookRan {
+		t.Fatal("shutdown hook did not run")
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxClients = 1
+	srv, _ := startServer(t, context.Background(), cfg)
+	defer srv.Shutdown(context.Background())
+
+	first, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	// Make sure the first client is registered before the second arrives.
+	first.Write(handler.SerializeArgs(handler.SetCommand, "k", "v"))
+	bufio.NewReader(first).ReadString('\n')
+
+	second, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	if reply, _ := io.ReadAll(second); string(reply) != "ERR" {
+		t.Fatalf("second client got %q", reply)
+	}
+}
+
+func TestMaxClientsSilentTLSClient(t *testing.T) {
+	files := tlstest.Generate(t)
+
+	cfg := testConfig()
+	cfg.MaxClients = 1
+	cfg.TLS.CertFile = files.ServerCert
+	cfg.TLS.KeyFile = files.ServerKey
+	srv, _ := startServer(t, context.Background(), cfg)
+
+	clientCfg, err := tlsconfig.NewClientConfig(tlsconfig.ClientOptions{CAFile: files.CA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := tls.Dial("tcp", srv.Addr().String(), clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.Write(handler.SerializeArgs(handler.SetCommand, "k", "v"))
+	bufio.NewReader(first).ReadString('\n')
+
+	// The rejected client never starts its handshake, so the reply can't be
+	// written. That must not hold up the server.
+	silent, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Shutdown = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown blocked behind the rejected client")
+	}
+}
+
+func TestRuntimeConfig(t *testing.T) {
+	srv, _ := startServer(t, context.Background(), testConfig())
+	defer srv.Shutdown(context.Background())
+
+	first, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.Write(handler.SerializeArgs(handler.ConfigCommand, "SET", "max_clients", "1"))
+	if line, _ := bufio.NewReader(first).ReadString('\n'); line != "OK\r\n" {
+		t.Fatalf("CFG SET got %q", line)
+	}
+	if got := srv.Runtime().Config().MaxClients; got != 1 {
+		t.Fatalf("max_clients = %d", got)
+	}
+
+	second, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if reply, _ := io.ReadAll(second); string(reply) != "ERR" {
+		t.Fatalf("second client got %q", reply)
+	}
+}
+
+func TestFrameLimits(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxFrameSize = 64
+	cfg.IdleTimeoutMs = 100
+	srv, _ := startServer(t, context.Background(), cfg)
+	defer srv.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// Only the length prefix is sent; it must be rejected without waiting
+	// for a gigabyte of value.
+	conn.Write([]byte("SET\x003\x00key\x001000000000\x00"))
+	reply, err := io.ReadAll(conn)
+	if err != nil || string(reply) != "ERR" {
+		t.Fatalf("oversized frame got %q, %v", reply, err)
+	}
+
+	idle, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idle.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle client read = %v, want EOF", err)
+	}
+}
+
+func TestIOModes(t *testing.T) {
+	for _, mode := range []string{IOModeGoroutine, IOModeEpoll} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.IOMode = mode
+			cfg.EventLoops = 2
+			srv, result := startServer(t, context.Background(), cfg)
+
+			conn, err := net.Dial("tcp", srv.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			// Pipelined commands, with the last one split across writes.
+			incr := handler.SerializeArgs(handler.IncrCommand, "n")
+			conn.Write(append(append(handler.SerializeArgs(handler.SetCommand, "n", "1"), incr...), incr[:5]...))
+			time.Sleep(10 * time.Millisecond)
+			conn.Write(incr[5:])
+
+			r := bufio.NewReader(conn)
+			for _, want := range []string{"OK\r\n", "2\r\n", "3\r\n"} {
+				if line, err := r.ReadString('\n'); err != nil || line != want {
+					t.Fatalf("got %q, %v; want %q", line, err, want)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				t.Fatalf("Shutdown: %v", err)
+			}
+			<-result
+			if _, err := r.ReadByte(); err == nil {
+				t.Fatal("connection still open after Shutdown")
+			}
+		})
+	}
+}
+
+func TestEpollSlowCommands(t *testing.T) {
+	cfg := testConfig()
+	cfg.IOMode = IOModeEpoll
+	cfg.EventLoops = 1
+	// Small enough in memory, but p = 16 makes every check take a while.
+	cfg.Users = "alice:scrypt$14$8$16$c2FsdA$a2V5"
+	srv, _ := startServer(t, context.Background(), cfg)
+	defer srv.Shutdown(context.Background())
+
+	authing, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer authing.Close()
+	other, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	// The PIN pipelined after AUT runs once AUT is done.
+	start := time.Now()
+	authing.Write(append(handler.SerializeArgs(handler.AuthCommand, "alice", "wrong"), handler.SerializeArgs(handler.PingCommand)...))
+	authed := make(chan time.Duration, 1)
+	go func() {
+		defer close(authed)
+		r := bufio.NewReader(authing)
+		reply := make([]byte, len(handler.ErrResponse))
+		if _, err := io.ReadFull(r, reply); err != nil || string(reply) != "ERR" {
+			t.Errorf("AUT = %q, %v", reply, err)
+		}
+		authed <- time.Since(start)
+		if line, err := r.ReadString('\n'); err != nil || line != "PONG\r\n" {
+			t.Errorf("PIN after AUT = %q, %v", line, err)
+		}
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	pingStart := time.Now()
+	other.Write(handler.SerializeArgs(handler.PingCommand))
+	if line, err := bufio.NewReader(other).ReadString('\n'); err != nil || line != "PONG\r\n" {
+		t.Fatalf("PIN = %q, %v", line, err)
+	}
+	ping := time.Since(pingStart)
+
+	if auth := <-authed; ping > auth/2 {
+		t.Fatalf("PIN on another connection took %v while AUT took %v", ping, auth)
+	}
+	<-authed
+}
+
+func TestListeners(t *testing.T) {
+	for _, mode := range []string{IOModeGoroutine, IOModeEpoll} {
+		t.Run(mode, func(t *testing.T) {
+			sock := filepath.Join(t.TempDir(), "stash.sock")
+			// A socket file left behind by a server that did not shut down.
+			stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stale.SetUnlinkOnClose(false)
+			stale.Close()
+
+			cfg := testConfig()
+			cfg.IOMode = mode
+			cfg.Listeners = []string{"127.0.0.1:0", config.UnixPrefix + sock + "?mode=600"}
+			srv, result := startServer(t, context.Background(), cfg)
+
+			addrs := srv.Addrs()
+			if len(addrs) != 2 {
+				t.Fatalf("got %d listeners, want 2", len(addrs))
+			}
+			info, err := os.Stat(sock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := info.Mode().Perm(); perm != 0o600 {
+				t.Fatalf("socket mode %o, want 600", perm)
+			}
+
+			for i, addr := range addrs {
+				conn, err := net.Dial(addr.Network(), addr.String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				val := strconv.Itoa(i)
+				conn.Write(append(handler.SerializeArgs(handler.SetCommand, "k", val), handler.SerializeArgs(handler.GetCommand, "k")...))
+				r := bufio.NewReader(conn)
+				for _, want := range []string{"OK\r\n", val + "\r\n"} {
+					if line, err := r.ReadString('\n'); err != nil || line != want {
+						t.Fatalf("%s: got %q, %v; want %q", addr, line, err, want)
+					}
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				t.Fatalf("Shutdown: %v", err)
+			}
+			<-result
+			if _, err := os.Lstat(sock); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("socket not removed after Shutdown: %v", err)
+			}
+		})
+	}
+}
+
+func TestHTTPGateway(t *testing.T) {
+	cfg := testConfig()
+	cfg.HTTPAddr = "127.0.0.1:0"
+	srv, result := startServer(t, context.Background(), cfg)
+	defer func() {
+		srv.Shutdown(context.Background())
+		<-result
+	}()
+
+	req, err := http.NewRequest("PUT", "http://"+srv.HTTPAddr().String()+"/v1/keys/k", strings.NewReader("from http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT: got %d", resp.StatusCode)
+	}
+
+	// HTTP and the binary protocol share the store.
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(handler.SerializeArgs(handler.GetCommand, "k"))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "from http\r\n" {
+		t.Fatalf("GET: got %q, %v", line, err)
+	}
+
+	// WebSocket connections run like connected clients.
+	ws, err := net.Dial("tcp", srv.HTTPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(ws, "GET /v1/ws HTTP/1.1\r\nHost: gostash\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	r := bufio.NewReader(ws)
+	if resp, err := http.ReadResponse(r, nil); err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade: got %v, %v", resp, err)
+	}
+	get := handler.SerializeArgs(handler.GetCommand, "k")
+	// A single masked binary frame, with an all-zero mask.
+	ws.Write(append([]byte{0x82, 0x80 | byte(len(get)), 0, 0, 0, 0}, get...))
+	reply := make([]byte, 2+len("from http\r\n"))
+	if _, err := io.ReadFull(r, reply); err != nil || string(reply[2:]) != "from http\r\n" {
+		t.Fatalf("GET over WebSocket: got %q, %v", reply, err)
+	}
+	srv.mu.Lock()
+	clients := srv.clients.Len()
+	srv.mu.Unlock()
+	if clients != 2 {
+		t.Fatalf("%d clients registered, want the TCP and the WebSocket client", clients)
+	}
+}
+
+func TestShutdownFinishesHTTPRequests(t *testing.T) {
+	cfg := testConfig()
+	cfg.HTTPAddr = "127.0.0.1:0"
+	srv, result := startServer(t, context.Background(), cfg)
+
+	// A request whose body is still being sent when Shutdown starts.
+	body, w := io.Pipe()
+	replies := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest("PUT", "http://"+srv.HTTPAddr().String()+"/v1/keys/k", body)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			replies <- 0
+			return
+		}
+		resp.Body.Close()
+		replies <- resp.StatusCode
+	}()
+	io.WriteString(w, "partial ")
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	io.WriteString(w, "value")
+	w.Close()
+
+	if code := <-replies; code != http.StatusNoContent {
+		t.Fatalf("in-flight PUT got %d, want 204", code)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	<-result
+}
+
+func TestTLS(t *testing.T) {
+	files := tlstest.Generate(t)
+
+	cfg := testConfig()
+	cfg.TLS.CertFile = files.ServerCert
+	cfg.TLS.KeyFile = files.ServerKey
+	cfg.TLS.CAFile = files.CA
+	cfg.TLS.ClientAuth = tlsconfig.ClientAuthRequire
+	srv, _ := startServer(t, context.Background(), cfg)
+	defer srv.Shutdown(context.Background())
+
+	clientCfg, err := tlsconfig.NewClientConfig(tlsconfig.ClientOptions{
+		CAFile:   files.CA,
+		CertFile: files.ClientCert,
+		KeyFile:  files.ClientKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", srv.Addr().String(), clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write(handler.SerializeArgs(handler.SetCommand, "k", "v"))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "OK\r\n" {
+		t.Fatalf("SET over TLS = %q, %v", line, err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	for _, mode := range []string{IOModeGoroutine, IOModeEpoll} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.IOMode = mode
+			cfg.MetricsAddr = "127.0.0.1:0"
+			srv, result := startServer(t, context.Background(), cfg)
+			defer func() {
+				srv.Shutdown(context.Background())
+				<-result
+			}()
+
+			conn, err := net.Dial("tcp", srv.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			r := bufio.NewReader(conn)
+			conn.Write(handler.SerializeArgs(handler.SetCommand, "k", "v"))
+			conn.Write(handler.SerializeArgs(handler.GetCommand, "k"))
+			conn.Write(handler.SerializeArgs(handler.GetCommand, "missing"))
+			for range 2 {
+				if _, err := r.ReadString('\n'); err != nil {
+					t.Fatal(err)
+				}
+			}
+			conn.Write(handler.SerializeArgs(handler.PingCommand))
+			if line, err := r.ReadString('\n'); err != nil || line != "ERRPONG\r\n" {
+				t.Fatalf("got %q, %v", line, err)
+			}
+
+			resp, err := http.Get("http://" + srv.MetricsAddr().String() + "/metrics")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range []string{
+				`gostash_commands_total{command="GET"} 2`,
+				`gostash_commands_total{command="SET"} 1`,
+				`gostash_command_duration_seconds_count{command="GET"} 2`,
+				`gostash_keyspace_hits_total 1`,
+				`gostash_keyspace_misses_total 1`,
+				`gostash_errors_total{type="not_found"} 1`,
+				`gostash_connected_clients 1`,
+				`gostash_net_input_bytes_total `,
+				`gostash_store_bytes{shard="`,
+			} {
+				if !strings.Contains(string(body), want) {
+					t.Errorf("metrics lack %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestClientCommand(t *testing.T) {
+	for _, mode := range []string{IOModeGoroutine, IOModeEpoll} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.IOMode = mode
+			srv, result := startServer(t, context.Background(), cfg)
+			defer func() {
+				srv.Shutdown(context.Background())
+				<-result
+			}()
+
+			dial := func() (net.Conn, func(handler.Command, ...string) []string) {
+				conn, err := net.Dial("tcp", srv.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { conn.Close() })
+				r := bufio.NewReader(conn)
+				// do returns the reply lines, reading a list if the first
+				// line is a count.
+				do := func(command handler.Command, args ...string) []string {
+					conn.Write(handler.SerializeArgs(command, args...))
+					line, err := r.ReadString('\n')
+					if err != nil {
+						t.Fatal(err)
+					}
+					lines := []string{strings.TrimSuffix(line, "\r\n")}
+					if n, err := strconv.Atoi(lines[0]); err == nil && command == handler.ClientCommand && args[0] == "LIST" {
+						lines = nil
+						for range n {
+							line, _ := r.ReadString('\n')
+							lines = append(lines, strings.TrimSuffix(line, "\r\n"))
+						}
+					}
+					return lines
+				}
+				return conn, do
+			}
+
+			worker, doWorker := dial()
+			if got := doWorker(handler.ClientCommand, "SETNAME", "worker"); got[0] != "OK" {
+				t.Fatalf("CLI SETNAME = %q", got)
+			}
+			info := doWorker(handler.ClientCommand, "INFO")[0]
+			if !strings.HasPrefix(info, "id=1 addr="+worker.LocalAddr().String()+" name=worker ") || !strings.Contains(info, " cmd=CLI ") {
+				t.Fatalf("CLI INFO = %q", info)
+			}
+
+			_, doAdmin := dial()
+			list := doAdmin(handler.ClientCommand, "LIST")
+			if len(list) != 2 || !strings.Contains(list[0], "name=worker") || !strings.HasPrefix(list[1], "id=2 ") || !strings.Contains(list[1], " cmd=CLI ") {
+				t.Fatalf("CLI LIST = %q", list)
+			}
+
+			if got := doAdmin(handler.ClientCommand, "KILL", "ADDR", worker.LocalAddr().String()); got[0] != "1" {
+				t.Fatalf("CLI KILL ADDR = %q", got)
+			}
+			worker.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := worker.Read(make([]byte, 1)); err == nil {
+				t.Fatal("killed client still connected")
+			}
+
+			deadline := time.Now().Add(time.Second)
+			for len(doAdmin(handler.ClientCommand, "LIST")) != 1 {
+				if time.Now().After(deadline) {
+					t.Fatal("killed client still listed")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if got := doAdmin(handler.ClientCommand, "KILL", "IDLE", "60"); got[0] != "0" {
+				t.Fatalf("CLI KILL IDLE = %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// Package slowlog keeps the most recent commands that took longer than a
+// threshold to run.
+package slowlog
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxKeyLen is the number of bytes of a key kept in an entry.
+const MaxKeyLen = 64
+
+// Entry is a command that exceeded the threshold.
+type Entry struct {
+	// ID increases by one for every entry ever recorded, so it identifies
+	// entries across calls to Entries and Reset.
+	ID       uint64
+	Time     time.Time
+	Duration time.Duration
+	Client   string
+	Command  string
+	// Key is the first key of the command, truncated to MaxKeyLen bytes.
+	Key string
+}
+
+// Log is a fixed size ring of entries. It is safe for concurrent use.
+type Log struct {
+	// threshold is in microseconds; negative disables the log.
+	threshold atomic.Int64
+
+	mu      sync.Mutex
+	entries []Entry
+	next    int
+	len     int
+	nextID  uint64
+}
+
+// New returns a log keeping up to maxLen entries of commands slower than
+// threshold. A negative threshold disables logging; zero logs every
+// command.
+func New(threshold time.Duration, maxLen int) *Log {
+	l := &Log{entries: make([]Entry, max(maxLen, 0))}
+	l.SetThreshold(threshold)
+	return l
+}
+
+// Threshold returns the current threshold, negative if the log is disabled.
+func (l *Log) Threshold() time.Duration {
+	return time.Duration(l.threshold.Load()) * time.Microsecond
+}
+
+// SetThreshold changes the threshold, taking effect for commands that finish
+// afterwards. A negative threshold disables the log.
+func (l *Log) SetThreshold(d time.Duration) {
+	if d < 0 {
+		l.threshold.Store(-1)
+		return
+	}
+	l.threshold.Store(int64(d / time.Microsecond))
+}
+
+// Slow reports whether a command that took d is logged.
+func (l *Log) Slow(d time.Duration) bool {
+	threshold := l.threshold.Load()
+	return threshold >= 0 && d >= time.Duration(threshold)*time.Microsecond
+}
+
+// Add records e, replacing the oldest entry if the log is full. ID is
+// assigned by the log and the key is truncated.
+func (l *Log) Add(e Entry) {
+	e.Key = truncate(e.Key)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.ID = l.nextID
+	l.nextID++
+	if len(l.entries) == 0 {
+		return
+	}
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+	l.len = min(l.len+1, len(l.entries))
+}
+
+// Entries returns up to n entries, newest first. A negative n returns all of
+// them.
+func (l *Log) Entries(n int) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n < 0 || n > l.len {
+		n = l.len
+	}
+	entries := make([]Entry, n)
+	for i := range entries {
+		entries[i] = l.entries[(l.next-1-i+len(l.entries))%len(l.entries)]
+	}
+	return entries
+}
+
+// Len returns the number of entries in the log.
+func (l *Log) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.len
+}
+
+// MaxLen returns the number of entries the log keeps.
+func (l *Log) MaxLen() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// SetMaxLen changes the number of entries the log keeps, dropping the
+// oldest ones if there are more than n.
+func (l *Log) SetMaxLen(n int) {
+	n = max(n, 0)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n == len(l.entries) {
+		return
+	}
+	entries := make([]Entry, n)
+	kept := min(l.len, n)
+	// Copy the newest entries, oldest first.
+	for i := range kept {
+		entries[i] = l.entries[(l.next-kept+i+len(l.entries))%len(l.entries)]
+	}
+	l.entries = entries
+	l.len = kept
+	l.next = 0
+	if n > 0 {
+		l.next = kept % n
+	}
+}
+
+// Reset removes every entry.
+func (l *Log) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	clear(l.entries)
+	l.next = 0
+	l.len = 0
+}
+
+// truncate shortens long keys like Redis does, noting how much was cut.
+func truncate(key string) string {
+	if len(key) <= MaxKeyLen {
+		return key
+	}
+	return key[:MaxKeyLen] + "... (" + strconv.Itoa(len(key)-MaxKeyLen) + " more bytes)"
+}
@@ -0,0 +1,59 @@
+package slowlog
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	l := New(time.Millisecond, 3)
+
+	if l.Slow(999 * time.Microsecond) {
+		t.Fatal("command below the threshold is slow")
+	}
+	if !l.Slow(time.Millisecond) {
+		t.Fatal("command at the threshold is not slow")
+	}
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		l.Add(Entry{Command: "GET", Key: key})
+	}
+	if l.Len() != 3 {
+		t.Fatalf("Len = %d, want 3", l.Len())
+	}
+	entries := l.Entries(2)
+	if len(entries) != 2 || entries[0].Key != "d" || entries[0].ID != 3 || entries[1].Key != "c" {
+		t.Fatalf("Entries(2) = %+v", entries)
+	}
+	if entries := l.Entries(-1); len(entries) != 3 || entries[2].Key != "b" {
+		t.Fatalf("Entries(-1) = %+v", entries)
+	}
+
+	l.Reset()
+	l.Add(Entry{Key: strings.Repeat("k", MaxKeyLen+10)})
+	entries = l.Entries(-1)
+	if len(entries) != 1 || entries[0].ID != 4 {
+		t.Fatalf("Entries after Reset = %+v", entries)
+	}
+	if want := strings.Repeat("k", MaxKeyLen) + "... (10 more bytes)"; entries[0].Key != want {
+		t.Fatalf("Key = %q, want %q", entries[0].Key, want)
+	}
+
+	l.Add(Entry{Key: "e"})
+	l.Add(Entry{Key: "f"})
+	l.SetMaxLen(2)
+	if entries := l.Entries(-1); len(entries) != 2 || entries[0].Key != "f" || entries[1].Key != "e" {
+		t.Fatalf("Entries after SetMaxLen(2) = %+v", entries)
+	}
+	l.SetMaxLen(4)
+	l.Add(Entry{Key: "g"})
+	if entries := l.Entries(-1); len(entries) != 3 || entries[0].Key != "g" || entries[2].Key != "e" {
+		t.Fatalf("Entries after SetMaxLen(4) = %+v", entries)
+	}
+
+	l.SetThreshold(-1)
+	if l.Slow(time.Hour) {
+		t.Fatal("disabled log reports a slow command")
+	}
+}
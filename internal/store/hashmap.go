@@ -1,86 +1,101 @@
 package store
 
-import (
-	"errors"
-	"strconv"
-	"sync"
-
-	"github.com/k1ender/go-stash/internal/utils"
-)
-
+// HashMapStore is a Store guarded by a single lock. It shares its map
+// operations with the shards of ShardedStore.
 type HashMapStore struct {
-	data map[string]string
-	rw   sync.RWMutex
+	sh shard
 }
 
 func NewHashMapStore() *HashMapStore {
 	return &HashMapStore{
-		data: make(map[string]string),
+		sh: shard{
+			m:   make(map[string]string),
+			ver: make(map[string]uint64),
+		},
 	}
 }
 
 func (s *HashMapStore) Get(key string) (string, error) {
-	s.rw.RLock()
-	defer s.rw.RUnlock()
-	if value, exists := s.data[key]; exists {
+	s.sh.rw.RLock()
+	defer s.sh.rw.RUnlock()
+	if value, exists := s.sh.m[key]; exists {
 		return value, nil
 	}
 	return "", ErrNotFound
 }
 
 func (s *HashMapStore) Set(key, value string) error {
-	s.rw.Lock()
-	defer s.rw.Unlock()
-	s.data[key] = value
+	s.sh.rw.Lock()
+	defer s.sh.rw.Unlock()
+	s.sh.set(key, value)
 	return nil
 }
 
 func (s *HashMapStore) Incr(key string) (int, error) {
-	s.rw.Lock()
-	defer s.rw.Unlock()
-	value, exists := s.data[key]
-	if !exists {
-		s.data[key] = "1"
-		return 1, nil
-	}
-
-	val, err := utils.FastStringToInt(value)
-	if err != nil {
-		return 0, errors.New("value is not an integer")
-	}
-
-	intValue := val + 1
-	s.data[key] = strconv.Itoa(intValue)
-	return intValue, nil
+	s.sh.rw.Lock()
+	defer s.sh.rw.Unlock()
+	return s.sh.incrBy(key, 1)
 }
 
 func (s *HashMapStore) Decr(key string) (int, error) {
-	s.rw.Lock()
-	defer s.rw.Unlock()
+	s.sh.rw.Lock()
+	defer s.sh.rw.Unlock()
+	return s.sh.incrBy(key, -1)
+}
 
-	value, exists := s.data[key]
-	if !exists {
-		s.data[key] = "-1"
-		return -1, nil
-	}
+func (s *HashMapStore) Del(key string) error {
+	s.sh.rw.Lock()
+	defer s.sh.rw.Unlock()
+	return s.sh.del(key)
+}
 
-	val, err := utils.FastStringToInt(value)
-	if err != nil {
-		return 0, errors.New("value is not an integer")
-	}
+func (s *HashMapStore) Version(key string) uint64 {
+	s.sh.rw.RLock()
+	defer s.sh.rw.RUnlock()
+	return s.sh.version(key)
+}
 
-	intValue := val - 1
-	s.data[key] = strconv.Itoa(intValue)
-	return intValue, nil
+// Stats reports the store as a single shard.
+func (s *HashMapStore) Stats() []ShardStats {
+	return []ShardStats{s.sh.stats()}
 }
 
-func (s *HashMapStore) Del(key string) error {
-	s.rw.Lock()
-	defer s.rw.Unlock()
+// Atomic holds the store lock while fn runs. Since there is only one lock,
+// every key is accessible through tx regardless of keys.
+func (s *HashMapStore) Atomic(keys []string, fn func(tx Tx) error) error {
+	s.sh.rw.Lock()
+	defer s.sh.rw.Unlock()
+	return fn(hashMapTx{sh: &s.sh})
+}
 
-	if _, exists := s.data[key]; !exists {
-		return ErrNotFound
+type hashMapTx struct {
+	sh *shard
+}
+
+func (tx hashMapTx) Get(key string) (string, error) {
+	if value, exists := tx.sh.m[key]; exists {
+		return value, nil
 	}
-	delete(s.data, key)
+	return "", ErrNotFound
+}
+
+func (tx hashMapTx) Set(key, value string) error {
+	tx.sh.set(key, value)
 	return nil
 }
+
+func (tx hashMapTx) Incr(key string) (int, error) {
+	return tx.sh.incrBy(key, 1)
+}
+
+func (tx hashMapTx) Decr(key string) (int, error) {
+	return tx.sh.incrBy(key, -1)
+}
+
+func (tx hashMapTx) Del(key string) error {
+	return tx.sh.del(key)
+}
+
+func (tx hashMapTx) Version(key string) uint64 {
+	return tx.sh.version(key)
+}
@@ -1,8 +1,8 @@
 package store
 
 import (
-	"errors"
 	"runtime"
+	"slices"
 	"strconv"
 	"sync"
 
@@ -12,6 +12,74 @@ import (
 type shard struct {
 	m  map[string]string
 	rw sync.RWMutex
+
+	// ver holds the shard sequence number of the last write to each key and
+	// backs Version for optimistic transactions. Keys that do not exist have
+	// the sequence number of the last delete, so a key deleted after being
+	// watched never returns to the version it was watched at.
+	ver     map[string]uint64
+	seq     uint64
+	lastDel uint64
+
+	// bytes estimates the memory held by the keys and values in m.
+	bytes int
+}
+
+// entryOverhead approximates what a map entry costs beyond its key and
+// value bytes: two string headers and a version.
+const entryOverhead = 40
+
+func (sh *shard) set(key, value string) {
+	if old, exists := sh.m[key]; exists {
+		sh.bytes += len(value) - len(old)
+	} else {
+		sh.bytes += len(key) + len(value) + entryOverhead
+	}
+	sh.m[key] = value
+	sh.touch(key)
+}
+
+func (sh *shard) touch(key string) {
+	sh.seq++
+	sh.ver[key] = sh.seq
+}
+
+func (sh *shard) incrBy(key string, delta int) (int, error) {
+	value, exists := sh.m[key]
+	if !exists {
+		sh.set(key, strconv.Itoa(delta))
+		return delta, nil
+	}
+
+	val, err := utils.FastStringToInt(value)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+
+	intValue := val + delta
+	sh.set(key, strconv.Itoa(intValue))
+	return intValue, nil
+}
+
+func (sh *shard) del(key string) error {
+	value, exists := sh.m[key]
+	if !exists {
+		return ErrNotFound
+	}
+
+	sh.bytes -= len(key) + len(value) + entryOverhead
+	delete(sh.m, key)
+	delete(sh.ver, key)
+	sh.seq++
+	sh.lastDel = sh.seq
+	return nil
+}
+
+func (sh *shard) version(key string) uint64 {
+	if v, ok := sh.ver[key]; ok {
+		return v
+	}
+	return sh.lastDel
 }
 
 type ShardedStore struct {
@@ -30,7 +98,8 @@ func NewShardedStore(numShards int) *ShardedStore {
 	shards := make([]*shard, numShards)
 	for i := range numShards {
 		shards[i] = &shard{
-			m: make(map[string]string),
+			m:   make(map[string]string),
+			ver: make(map[string]uint64),
 		}
 	}
 	return &ShardedStore{
@@ -48,9 +117,12 @@ func fastHash(s string) uint32 {
 	return h ^ (h >> 16)
 }
 
+func (s *ShardedStore) shardIndex(key string) int {
+	return int(fastHash(key) % uint32(s.numShards))
+}
+
 func (s *ShardedStore) getShard(key string) *shard {
-	hash := fastHash(key)
-	return s.shards[hash%uint32(s.numShards)]
+	return s.shards[s.shardIndex(key)]
 }
 
 func (s *ShardedStore) Get(key string) (string, error) {
@@ -71,7 +143,7 @@ func (s *ShardedStore) Set(key string, value string) error {
 	sh := s.getShard(key)
 
 	sh.rw.Lock()
-	sh.m[key] = value
+	sh.set(key, value)
 	sh.rw.Unlock()
 
 	return nil
@@ -82,52 +154,137 @@ func (s *ShardedStore) Incr(key string) (int, error) {
 	sh.rw.Lock()
 	defer sh.rw.Unlock()
 
-	value, exists := sh.m[key]
-	if !exists {
-		sh.m[key] = "1"
-		return 1, nil
-	}
+	return sh.incrBy(key, 1)
+}
 
-	val, err := utils.FastStringToInt(value)
-	if err != nil {
-		return 0, errors.New("value is not an integer")
-	}
+func (s *ShardedStore) Decr(key string) (int, error) {
+	sh := s.getShard(key)
+	sh.rw.Lock()
+	defer sh.rw.Unlock()
 
-	intValue := val + 1
-	sh.m[key] = strconv.Itoa(intValue)
-	return intValue, nil
+	return sh.incrBy(key, -1)
 }
 
-func (s *ShardedStore) Decr(key string) (int, error) {
+func (s *ShardedStore) Del(key string) error {
 	sh := s.getShard(key)
 	sh.rw.Lock()
 	defer sh.rw.Unlock()
 
+	return sh.del(key)
+}
+
+func (s *ShardedStore) Version(key string) uint64 {
+	sh := s.getShard(key)
+
+	sh.rw.RLock()
+	defer sh.rw.RUnlock()
+
+	return sh.version(key)
+}
+
+// Atomic write-locks every shard owning one of keys in ascending shard order,
+// runs fn and unlocks them in reverse order.
+func (s *ShardedStore) Atomic(keys []string, fn func(tx Tx) error) error {
+	locked := make([]int, 0, len(keys))
+	for _, key := range keys {
+		locked = append(locked, s.shardIndex(key))
+	}
+	slices.Sort(locked)
+	locked = slices.Compact(locked)
+
+	for _, i := range locked {
+		s.shards[i].rw.Lock()
+	}
+	defer func() {
+		for _, i := range slices.Backward(locked) {
+			s.shards[i].rw.Unlock()
+		}
+	}()
+
+	return fn(&shardedTx{store: s, locked: locked})
+}
+
+// shardedTx accesses the shards of a ShardedStore without locking, relying on
+// the locks taken by Atomic.
+type shardedTx struct {
+	store  *ShardedStore
+	locked []int
+}
+
+func (tx *shardedTx) shard(key string) (*shard, error) {
+	i := tx.store.shardIndex(key)
+	if _, ok := slices.BinarySearch(tx.locked, i); !ok {
+		return nil, ErrKeyNotLocked
+	}
+	return tx.store.shards[i], nil
+}
+
+func (tx *shardedTx) Get(key string) (string, error) {
+	sh, err := tx.shard(key)
+	if err != nil {
+		return "", err
+	}
+
 	value, exists := sh.m[key]
 	if !exists {
-		sh.m[key] = "-1"
-		return -1, nil
+		return "", ErrNotFound
 	}
+	return value, nil
+}
 
-	val, err := utils.FastStringToInt(value)
+func (tx *shardedTx) Set(key, value string) error {
+	sh, err := tx.shard(key)
 	if err != nil {
-		return 0, errors.New("value is not an integer")
+		return err
 	}
 
-	intValue := val - 1
-	sh.m[key] = strconv.Itoa(intValue)
-	return intValue, nil
+	sh.set(key, value)
+	return nil
 }
 
-func (s *ShardedStore) Del(key string) error {
-	sh := s.getShard(key)
-	sh.rw.Lock()
-	defer sh.rw.Unlock()
+func (tx *shardedTx) Incr(key string) (int, error) {
+	sh, err := tx.shard(key)
+	if err != nil {
+		return 0, err
+	}
+	return sh.incrBy(key, 1)
+}
 
-	if _, exists := sh.m[key]; !exists {
-		return ErrNotFound
+func (tx *shardedTx) Decr(key string) (int, error) {
+	sh, err := tx.shard(key)
+	if err != nil {
+		return 0, err
 	}
+	return sh.incrBy(key, -1)
+}
 
-	delete(sh.m, key)
-	return nil
+func (tx *shardedTx) Del(key string) error {
+	sh, err := tx.shard(key)
+	if err != nil {
+		return err
+	}
+	return sh.del(key)
+}
+
+func (tx *shardedTx) Version(key string) uint64 {
+	sh, err := tx.shard(key)
+	if err != nil {
+		return 0
+	}
+	return sh.version(key)
+}
+
+func (sh *shard) stats() ShardStats {
+	sh.rw.RLock()
+	defer sh.rw.RUnlock()
+	return ShardStats{Keys: len(sh.m), Bytes: sh.bytes}
+}
+
+// Stats reports the size of every shard, in shard order.
+func (s *ShardedStore) Stats() []ShardStats {
+	stats := make([]ShardStats, len(s.shards))
+	for i, sh := range s.shards {
+		stats[i] = sh.stats()
+	}
+	return stats
 }
@@ -3,7 +3,9 @@ package store
 import "errors"
 
 var (
-	ErrNotFound = errors.New("key not found")
+	ErrNotFound     = errors.New("key not found")
+	ErrNotInteger   = errors.New("value is not an integer")
+	ErrKeyNotLocked = errors.New("key was not declared for the atomic operation")
 )
 
 type Store interface {
@@ -13,3 +15,38 @@ type Store interface {
 	Decr(key string) (int, error)
 	Del(key string) error
 }
+
+// Tx is the view of the store handed to an Atomic callback. It is only valid
+// until the callback returns and may only touch the keys passed to Atomic.
+type Tx interface {
+	Store
+	Version(key string) uint64
+}
+
+// Transactional is implemented by stores that can run a group of operations
+// atomically with respect to all other clients.
+type Transactional interface {
+	Store
+
+	// Atomic locks everything needed to access keys, runs fn and releases the
+	// locks again. Locks are always taken in the same order, so concurrent
+	// Atomic calls cannot deadlock.
+	Atomic(keys []string, fn func(tx Tx) error) error
+
+	// Version returns a number that changes every time key is written or
+	// deleted. A version is never reused, so a key that is set and deleted
+	// again does not return to the version it had before.
+	Version(key string) uint64
+}
+
+// ShardStats describes the contents of one shard of a store.
+type ShardStats struct {
+	Keys int
+	// Bytes estimates the memory used by the shard's keys and values.
+	Bytes int
+}
+
+// StatsReporter is implemented by stores that can report their size.
+type StatsReporter interface {
+	Stats() []ShardStats
+}
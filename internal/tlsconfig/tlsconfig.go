@@ -0,0 +1,190 @@
+// Package tlsconfig builds the crypto/tls configurations used by the server
+// and the client, including reloading certificates when their files change.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// reloadInterval is the minimum time between two checks of the certificate
+// files for changes.
+const reloadInterval = time.Second
+
+type ServerOptions struct {
+	CertFile string
+	KeyFile  string
+	// CAFile holds the certificates client certificates are verified against.
+	CAFile string
+	// ClientAuth is one of ClientAuthNone, ClientAuthOptional or
+	// ClientAuthRequire.
+	ClientAuth string
+}
+
+type ClientOptions struct {
+	// CAFile holds the certificates the server is verified against. The
+	// system roots are used if it is empty.
+	CAFile string
+	// CertFile and KeyFile hold the client certificate for mutual TLS.
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	// InsecureSkipVerify disables verification of the server certificate.
+	InsecureSkipVerify bool
+}
+
+// NewServerConfig returns a TLS configuration that serves the certificate in
+// opts and, depending on opts.ClientAuth, verifies client certificates. The
+// certificate, key and CA files are re-read whenever they change, so renewed
+// certificates are picked up by new connections without a restart.
+func NewServerConfig(opts ServerOptions) (*tls.Config, error) {
+	var clientAuth tls.ClientAuthType
+	switch opts.ClientAuth {
+	case ClientAuthNone, "":
+		clientAuth = tls.NoClientCert
+	case ClientAuthOptional:
+		clientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid client auth mode %q", opts.ClientAuth)
+	}
+	if clientAuth != tls.NoClientCert && opts.CAFile == "" {
+		return nil, errors.New("client certificate verification requires a CA file")
+	}
+
+	r := &reloader{certFile: opts.CertFile, keyFile: opts.KeyFile, caFile: opts.CAFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientAuth:   clientAuth,
+				ClientCAs:    pool,
+			}, nil
+		},
+	}, nil
+}
+
+func NewClientConfig(opts ClientOptions) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+
+	if opts.CAFile != "" {
+		pool, err := loadPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// reloader keeps the most recently loaded certificate and CA pool.
+type reloader struct {
+	certFile, keyFile, caFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes [3]time.Time
+	checked  time.Time
+}
+
+func (r *reloader) files() [3]string {
+	return [3]string{r.certFile, r.keyFile, r.caFile}
+}
+
+func (r *reloader) stat() [3]time.Time {
+	var modTimes [3]time.Time
+	for i, file := range r.files() {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (r *reloader) load() error {
+	modTimes := r.stat()
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load server certificate: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		if pool, err = loadPool(r.caFile); err != nil {
+			return err
+		}
+	}
+
+	r.cert, r.pool, r.modTimes = &cert, pool, modTimes
+	return nil
+}
+
+// current returns the certificate and CA pool to use for a new connection,
+// reloading them first if their files changed. A failed reload is logged and
+// the previous certificate stays in use.
+func (r *reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now := time.Now(); now.Sub(r.checked) >= reloadInterval {
+		r.checked = now
+		if r.stat() != r.modTimes {
+			if err := r.load(); err != nil {
+				slog.Error("failed to reload TLS certificates, keeping the previous ones", "error", err)
+			} else {
+				slog.Info("reloaded TLS certificates", "cert", r.certFile)
+			}
+		}
+	}
+	return r.cert, r.pool
+}
+
+func loadPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,128 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/tlsconfig/tlstest"
+)
+
+// serve accepts TLS connections until the test ends, completing the
+// handshake of each.
+func serve(t *testing.T, cfg *tls.Config) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func dial(addr string, opts ClientOptions) (*tls.ConnectionState, error) {
+	cfg, err := NewClientConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// With TLS 1.3 a rejected client certificate is only reported on the
+	// first read.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	state := conn.ConnectionState()
+	return &state, nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	files := tlstest.Generate(t)
+
+	cfg, err := NewServerConfig(ServerOptions{
+		CertFile:   files.ServerCert,
+		KeyFile:    files.ServerKey,
+		CAFile:     files.CA,
+		ClientAuth: ClientAuthRequire,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, cfg)
+
+	if _, err := dial(addr, ClientOptions{CAFile: files.CA}); err == nil {
+		t.Fatal("handshake without client certificate succeeded")
+	}
+
+	_, err = dial(addr, ClientOptions{
+		CAFile:   files.CA,
+		CertFile: files.ClientCert,
+		KeyFile:  files.ClientKey,
+	})
+	if err != nil {
+		t.Fatalf("handshake with client certificate: %v", err)
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := tlstest.NewCA(t, dir)
+	certFile, keyFile := ca.Issue(t, dir, "server", "first")
+
+	cfg, err := NewServerConfig(ServerOptions{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, cfg)
+
+	commonName := func() string {
+		t.Helper()
+		state, err := dial(addr, ClientOptions{CAFile: ca.Path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state.PeerCertificates[0].Subject.CommonName
+	}
+
+	if got := commonName(); got != "first" {
+		t.Fatalf("served %q, want first", got)
+	}
+
+	newCert, newKey := ca.Issue(t, t.TempDir(), "server", "second")
+	for _, f := range [][2]string{{newCert, certFile}, {newKey, keyFile}} {
+		data, err := os.ReadFile(f[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f[1], data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// Make the change visible even on filesystems with coarse mtimes.
+		future := time.Now().Add(time.Minute)
+		os.Chtimes(f[1], future, future)
+	}
+
+	time.Sleep(reloadInterval)
+	if got := commonName(); got != "second" {
+		t.Fatalf("served %q after reload, want second", got)
+	}
+}
@@ -0,0 +1,129 @@
+// Package tlstest generates throwaway certificates for tests.
+package tlstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Files are the paths of a generated CA and a server and client certificate
+// signed by it. The server certificate is valid for localhost and 127.0.0.1.
+type Files struct {
+	CA         string
+	ServerCert string
+	ServerKey  string
+	ClientCert string
+	ClientKey  string
+}
+
+type CA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	Path string
+}
+
+// Generate writes a fresh CA, server and client certificate to a temporary
+// directory that is removed when the test ends.
+func Generate(tb testing.TB) Files {
+	tb.Helper()
+	dir := tb.TempDir()
+
+	ca := NewCA(tb, dir)
+	files := Files{CA: ca.Path}
+	files.ServerCert, files.ServerKey = ca.Issue(tb, dir, "server", "server")
+	files.ClientCert, files.ClientKey = ca.Issue(tb, dir, "client", "client")
+	return files
+}
+
+func NewCA(tb testing.TB, dir string) *CA {
+	tb.Helper()
+
+	key := newKey(tb)
+	tmpl := &x509.Certificate{
+		SerialNumber:          newSerial(tb),
+		Subject:               pkix.Name{CommonName: "gostash test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "ca.pem")
+	writePEM(tb, path, "CERTIFICATE", der)
+	return &CA{cert: cert, key: key, Path: path}
+}
+
+// Issue writes a certificate with the given common name, signed by the CA,
+// as <name>.pem and <name>-key.pem in dir and returns both paths.
+func (ca *CA) Issue(tb testing.TB, dir, name, commonName string) (certFile, keyFile string) {
+	tb.Helper()
+
+	key := newKey(tb)
+	tmpl := &x509.Certificate{
+		SerialNumber: newSerial(tb),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+"-key.pem")
+	writePEM(tb, certFile, "CERTIFICATE", der)
+	writePEM(tb, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func newKey(tb testing.TB) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return key
+}
+
+func newSerial(tb testing.TB) *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return serial
+}
+
+func writePEM(tb testing.TB, path, typ string, der []byte) {
+	tb.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		tb.Fatal(err)
+	}
+}
@@ -0,0 +1,451 @@
+// Package websocket implements the server side of the WebSocket protocol,
+// RFC 6455, on top of net/http.
+//
+// Upgrade takes over the connection of an HTTP request. Messages are then
+// read with ReadMessage, which answers pings and close frames itself, and
+// written with WriteMessage, which may be called from several goroutines.
+// Extensions and subprotocols are not supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageType is the type of a data message.
+type MessageType int
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+// Opcodes of frames.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Status codes of close frames.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+)
+
+// acceptGUID is appended to the key of the client to compute
+// Sec-WebSocket-Accept.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxControlPayload is the largest payload of a ping, pong or close frame.
+const maxControlPayload = 125
+
+var (
+	ErrBadHandshake    = errors.New("websocket: not a valid upgrade request")
+	ErrOrigin          = errors.New("websocket: origin not allowed")
+	ErrMessageTooLarge = errors.New("websocket: message exceeds the maximum message size")
+	ErrClosed          = errors.New("websocket: connection closed")
+)
+
+// CloseError is returned by ReadMessage when the peer closed the connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed by peer with status %d %s", e.Code, e.Reason)
+}
+
+// protocolError is a frame breaking the rules of RFC 6455.
+type protocolError struct {
+	code int
+	msg  string
+}
+
+func (e *protocolError) Error() string { return "websocket: " + e.msg }
+
+type Options struct {
+	// MaxMessageSize bounds the payload of a message, in bytes. Larger
+	// messages close the connection with status 1009. Zero disables the
+	// limit.
+	MaxMessageSize int64
+	// PingInterval is how often the connection is pinged. It is closed
+	// when nothing, not even a pong, was received for two intervals. Zero
+	// disables pings.
+	PingInterval time.Duration
+	// CheckOrigin reports whether a request may be upgraded. If it is nil,
+	// requests without an Origin header and those whose Origin matches
+	// their Host are accepted.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// Conn is an upgraded connection.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	opts Options
+
+	// wmu serializes writes, so frames are never interleaved.
+	wmu           sync.Mutex
+	writeDeadline time.Time
+	closeSent     bool
+
+	// lastRead is when the last frame arrived, in Unix nanoseconds.
+	lastRead atomic.Int64
+	done     chan struct{}
+	close    sync.Once
+}
+
+// Upgrade completes the WebSocket handshake of r and takes over its
+// connection. If the request is not a valid upgrade request, Upgrade answers
+// it with an HTTP error and returns ErrBadHandshake or ErrOrigin.
+func Upgrade(w http.ResponseWriter, r *http.Request, opts Options) (*Conn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "expected a WebSocket upgrade request", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	checkOrigin := opts.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = SameOrigin
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, ErrOrigin
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "connection can not be upgraded", http.StatusInternalServerError)
+		return nil, err
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n"
+	// The server may have set a deadline for writing the response.
+	conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &Conn{
+		conn: conn,
+		r:    rw.Reader,
+		opts: opts,
+		done: make(chan struct{}),
+	}
+	c.lastRead.Store(time.Now().UnixNano())
+	if opts.PingInterval > 0 {
+		go c.keepAlive()
+	}
+	return c, nil
+}
+
+// AcceptKey returns the Sec-WebSocket-Accept header answering the
+// Sec-WebSocket-Key key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// SameOrigin accepts requests without an Origin header, sent by clients
+// other than browsers, and those whose Origin has the host of the request.
+func SameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// headerContains reports whether a comma separated header holds token.
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for part := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// SetReadDeadline sets the deadline of ReadMessage.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline of the following WriteMessage calls.
+// Pings sent in between use their own deadline.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// ReadMessage reads the next data message. Pings are answered and pongs
+// are skipped while waiting for it. When the peer closes the connection, the
+// close is acknowledged and a *CloseError returned. Frames breaking the
+// protocol and messages over the maximum size close the connection with the
+// matching status.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	var (
+		typ     MessageType
+		message []byte
+	)
+	for {
+		fin, op, payload, err := c.readFrame(len(message))
+		if err != nil {
+			var pe *protocolError
+			if errors.As(err, &pe) {
+				c.CloseWithCode(pe.code, pe.msg)
+			} else if errors.Is(err, ErrMessageTooLarge) {
+				c.CloseWithCode(CloseMessageTooBig, "message too big")
+			}
+			return 0, nil, err
+		}
+
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload, c.deadline()); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.closed(payload)
+		case opText, opBinary:
+			if typ != 0 {
+				c.CloseWithCode(CloseProtocolError, "expected a continuation frame")
+				return 0, nil, &protocolError{CloseProtocolError, "expected a continuation frame"}
+			}
+			typ = MessageType(op)
+		case opContinuation:
+			if typ == 0 {
+				c.CloseWithCode(CloseProtocolError, "unexpected continuation frame")
+				return 0, nil, &protocolError{CloseProtocolError, "unexpected continuation frame"}
+			}
+		}
+
+		message = append(message, payload...)
+		if !fin {
+			continue
+		}
+		if typ == TextMessage && !utf8.Valid(message) {
+			c.CloseWithCode(CloseInvalidPayload, "invalid UTF-8")
+			return 0, nil, &protocolError{CloseInvalidPayload, "text message is not valid UTF-8"}
+		}
+		return typ, message, nil
+	}
+}
+
+// readFrame reads a single frame. buffered is the size of the message read
+// so far, counted against the maximum message size.
+func (c *Conn) readFrame(buffered int) (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	c.lastRead.Store(time.Now().UnixNano())
+
+	fin, op = head[0]&0x80 != 0, head[0]&0x0f
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, &protocolError{CloseProtocolError, "reserved bits set without an extension"}
+	}
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, &protocolError{CloseProtocolError, "client frames must be masked"}
+	}
+	switch op {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+	default:
+		return false, 0, nil, &protocolError{CloseProtocolError, fmt.Sprintf("unknown opcode %#x", op)}
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return false, 0, nil, &protocolError{CloseProtocolError, "invalid payload length"}
+		}
+	}
+
+	if op >= opClose {
+		if !fin || length > maxControlPayload {
+			return false, 0, nil, &protocolError{CloseProtocolError, "invalid control frame"}
+		}
+	} else if max := c.opts.MaxMessageSize; max > 0 && length > uint64(max)-uint64(min(int64(buffered), max)) {
+		// Checked before reading, so the length alone can never make us
+		// allocate more than the maximum message size.
+		return false, 0, nil, ErrMessageTooLarge
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// closed acknowledges a close frame with payload and returns the error
+// describing it.
+func (c *Conn) closed(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	if len(payload) >= 2 {
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+	}
+	code := closeErr.Code
+	if code == CloseNoStatus {
+		code = CloseNormal
+	}
+	c.CloseWithCode(code, "")
+	return closeErr
+}
+
+// WriteMessage sends data as a single frame.
+func (c *Conn) WriteMessage(typ MessageType, data []byte) error {
+	return c.writeFrame(byte(typ), data, time.Time{})
+}
+
+// deadline returns the write deadline set with SetWriteDeadline.
+func (c *Conn) deadline() time.Time {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeDeadline
+}
+
+// writeFrame writes an unmasked frame. A zero deadline means the one set
+// with SetWriteDeadline.
+func (c *Conn) writeFrame(op byte, payload []byte, deadline time.Time) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|op)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	if deadline.IsZero() {
+		deadline = c.writeDeadline
+	}
+	c.conn.SetWriteDeadline(deadline)
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close sends a normal close frame and closes the connection.
+func (c *Conn) Close() error {
+	return c.CloseWithCode(CloseNormal, "")
+}
+
+// CloseWithCode sends a close frame with code and reason, unless one was
+// sent already, and closes the connection. It does not wait for the peer
+// to acknowledge the close.
+func (c *Conn) CloseWithCode(code int, reason string) error {
+	var err error
+	c.close.Do(func() {
+		close(c.done)
+		payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason[:min(len(reason), maxControlPayload-2)]...)
+		c.writeFrame(opClose, payload, time.Now().Add(time.Second))
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// keepAlive pings the peer every PingInterval and closes the connection
+// once nothing was received for two intervals.
+func (c *Conn) keepAlive() {
+	ticker := time.NewTicker(c.opts.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, c.lastRead.Load())) > 2*c.opts.PingInterval {
+				c.CloseWithCode(CloseGoingAway, "ping timeout")
+				return
+			}
+			if err := c.writeFrame(opPing, nil, time.Now().Add(c.opts.PingInterval)); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// The example of RFC 6455, section 1.3.
+	if got := AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("AcceptKey = %q", got)
+	}
+}
+
+// client is the raw client side of a connection.
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dial upgrades a connection to srv, with headers given as alternating
+// names and values.
+func dial(t *testing.T, srv *httptest.Server, headers ...string) (*client, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	c := &client{conn: conn, r: bufio.NewReader(conn)}
+	resp, err := http.ReadResponse(c.r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, resp
+}
+
+// send writes a masked frame.
+func (c *client) send(t *testing.T, fin bool, op byte, payload []byte) {
+	t.Helper()
+	head := op
+	if fin {
+		head |= 0x80
+	}
+	frame := []byte{head}
+	if len(payload) < 126 {
+		frame = append(frame, 0x80|byte(len(payload)))
+	} else {
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive reads an unmasked frame.
+func (c *client) receive(t *testing.T) (byte, []byte) {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	if head[1]&0x80 != 0 {
+		t.Fatal("server frame is masked")
+	}
+	n := int(head[1])
+	if n == 126 {
+		var ext [2]byte
+		io.ReadFull(c.r, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0f, payload
+}
+
+// expectClose reads a close frame with code.
+func (c *client) expectClose(t *testing.T, code int) {
+	t.Helper()
+	op, payload := c.receive(t)
+	if op != opClose || len(payload) < 2 || int(binary.BigEndian.Uint16(payload)) != code {
+		t.Fatalf("got frame %#x %q, want a close with status %d", op, payload, code)
+	}
+}
+
+// echoServer echoes every message and reports the error ending the
+// connection on errs.
+func echoServer(t *testing.T, opts Options) (*httptest.Server, chan error) {
+	errs := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := Upgrade(w, r, opts)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			typ, msg, err := ws.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			ws.WriteMessage(typ, msg)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, errs
+}
+
+func TestConn(t *testing.T) {
+	srv, errs := echoServer(t, Options{MaxMessageSize: 200})
+
+	c, resp := dial(t, srv)
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake: got %d, accept %q", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	c.send(t, true, opText, []byte("hello"))
+	if op, msg := c.receive(t); op != opText || string(msg) != "hello" {
+		t.Fatalf("echo: got %#x %q", op, msg)
+	}
+
+	// A fragmented message, interrupted by a ping.
+	c.send(t, false, opBinary, []byte("abc"))
+	c.send(t, true, opPing, []byte("p"))
+	c.send(t, true, opContinuation, []byte(strings.Repeat("d", 150)))
+	if op, msg := c.receive(t); op != opPong || string(msg) != "p" {
+		t.Fatalf("ping: got %#x %q, want a pong", op, msg)
+	}
+	if op, msg := c.receive(t); op != opBinary || string(msg) != "abc"+strings.Repeat("d", 150) {
+		t.Fatalf("fragmented: got %#x %q", op, msg)
+	}
+
+	c.send(t, true, opClose, binary.BigEndian.AppendUint16(nil, CloseGoingAway))
+	c.expectClose(t, CloseGoingAway)
+	var closeErr *CloseError
+	if err := <-errs; !errors.As(err, &closeErr) || closeErr.Code != CloseGoingAway {
+		t.Fatalf("ReadMessage after close = %v", err)
+	}
+}
+
+func TestConnErrors(t *testing.T) {
+	srv, errs := echoServer(t, Options{MaxMessageSize: 200})
+
+	for _, tc := range []struct {
+		name string
+		send func(c *client)
+		code int
+		err  error
+	}{
+		{"too large", func(c *client) {
+			c.send(t, false, opBinary, make([]byte, 150))
+			c.send(t, true, opContinuation, make([]byte, 51))
+		}, CloseMessageTooBig, ErrMessageTooLarge},
+		{"unmasked", func(c *client) {
+			c.conn.Write([]byte{0x80 | opText, 1, 'x'})
+		}, CloseProtocolError, nil},
+		{"invalid UTF-8", func(c *client) {
+			c.send(t, true, opText, []byte{0xff})
+		}, CloseInvalidPayload, nil},
+		{"unexpected continuation", func(c *client) {
+			c.send(t, true, opContinuation, []byte("x"))
+		}, CloseProtocolError, nil},
+		{"fragmented ping", func(c *client) {
+			c.send(t, false, opPing, nil)
+		}, CloseProtocolError, nil},
+	} {
+		c, _ := dial(t, srv)
+		tc.send(c)
+		c.expectClose(t, tc.code)
+		err := <-errs
+		if tc.err != nil && !errors.Is(err, tc.err) {
+			t.Errorf("%s: ReadMessage = %v, want %v", tc.name, err, tc.err)
+		}
+		if err == nil {
+			t.Errorf("%s: ReadMessage succeeded", tc.name)
+		}
+	}
+}
+
+func TestUpgradeErrors(t *testing.T) {
+	srv, _ := echoServer(t, Options{})
+
+	if _, resp := dial(t, srv, "Origin", "http://evil.example"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("foreign origin: got %d", resp.StatusCode)
+	}
+	if _, resp := dial(t, srv, "Origin", "http://"+srv.Listener.Addr().String()); resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("same origin: got %d", resp.StatusCode)
+	}
+	if _, resp := dial(t, srv, "Sec-WebSocket-Version", "8"); resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Errorf("version 8: got %d", resp.StatusCode)
+	}
+	if _, resp := dial(t, srv, "Sec-WebSocket-Key", "short"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid key: got %d", resp.StatusCode)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	srv, errs := echoServer(t, Options{PingInterval: 50 * time.Millisecond})
+
+	c, _ := dial(t, srv)
+	// Answering pings keeps the connection open.
+	for range 3 {
+		op, payload := c.receive(t)
+		if op != opPing {
+			t.Fatalf("got frame %#x, want a ping", op)
+		}
+		c.send(t, true, opPong, payload)
+	}
+	// Ignoring them closes it.
+	for {
+		if op, _ := c.receive(t); op == opClose {
+			break
+		}
+	}
+	if err := <-errs; err == nil {
+		t.Fatal("ReadMessage succeeded after the ping timeout")
+	}
+}
@@ -0,0 +1,148 @@
+// Package stash runs a GoStash server inside another program, for example
+// to give an integration test its own instance:
+//
+//	srv, err := stash.New(stash.Options{Addr: "127.0.0.1:0"})
+//	if err != nil {
+//		return err
+//	}
+//	go srv.Serve()
+//	defer srv.Close()
+//
+//	conn, err := net.Dial("tcp", srv.Addr().String())
+//
+// Package stashtest wraps this for tests.
+package stash
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/k1ender/go-stash/internal/config"
+	"github.com/k1ender/go-stash/internal/server"
+	"github.com/k1ender/go-stash/internal/store"
+)
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = server.ErrServerClosed
+
+// Store is the key-value store a server serves.
+type Store = store.Store
+
+// StoreKind selects the store a server creates.
+type StoreKind string
+
+const (
+	// Sharded spreads keys over several independently locked maps.
+	Sharded StoreKind = server.StoreSharded
+	// HashMap keeps all keys in a single map behind one lock.
+	HashMap StoreKind = server.StoreHashMap
+)
+
+// DefaultShutdownTimeout is used by Close when Options.ShutdownTimeout is
+// zero.
+const DefaultShutdownTimeout = 10 * time.Second
+
+type Options struct {
+	// Addr is the TCP address to listen on, "127.0.0.1:0" if empty. It is
+	// ignored if Listener is set.
+	Addr string
+	// Listener, if set, is used to accept connections instead of listening
+	// on Addr. Close closes it.
+	Listener net.Listener
+
+	// Store selects the store, Sharded if empty.
+	Store StoreKind
+	// Shards is the number of shards of a Sharded store. Zero picks a
+	// number based on GOMAXPROCS; at most 16 are used.
+	Shards int
+
+	// Users and ACL enable authentication and access control, in the
+	// format of the users and acl configuration options.
+	Users string
+	ACL   string
+
+	// ShutdownTimeout bounds how long Close waits for connected clients.
+	ShutdownTimeout time.Duration
+}
+
+// Server is a GoStash server running in the current process.
+type Server struct {
+	srv     *server.Server
+	timeout time.Duration
+}
+
+// New creates a server and binds its listener, so Addr is valid as soon as
+// New returns. Call Serve to start accepting clients.
+func New(opts Options) (*Server, error) {
+	switch opts.Store {
+	case "":
+		opts.Store = Sharded
+	case Sharded, HashMap:
+	default:
+		return nil, fmt.Errorf("stash: unknown store %q", opts.Store)
+	}
+
+	cfg := config.Default()
+	cfg.Store = string(opts.Store)
+	cfg.Shards = opts.Shards
+	cfg.Users = opts.Users
+	cfg.ACL = opts.ACL
+
+	var args []server.Arg
+	if opts.Listener != nil {
+		args = append(args, server.WithListener(opts.Listener))
+	} else {
+		addr := opts.Addr
+		if addr == "" {
+			addr = "127.0.0.1:0"
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Port, err = net.LookupPort("tcp", port); err != nil {
+			return nil, err
+		}
+		cfg.Host = host
+	}
+
+	timeout := opts.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	cfg.ShutdownTimeoutMs = int(timeout / time.Millisecond)
+
+	srv := server.NewServer(cfg, args...)
+	if err := srv.Listen(); err != nil {
+		return nil, err
+	}
+	return &Server{srv: srv, timeout: timeout}, nil
+}
+
+// Serve accepts and serves clients until Close is called, then returns
+// ErrServerClosed. It returns other errors if the server fails to start.
+func (s *Server) Serve() error {
+	return s.srv.Start(context.Background())
+}
+
+// Close stops accepting clients and waits up to the shutdown timeout for
+// connected clients to finish their current command before disconnecting
+// them.
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.srv.Addr()
+}
+
+// Store returns the store the server serves. Reads and writes through it
+// are visible to clients and vice versa.
+func (s *Server) Store() Store {
+	return s.srv.Store()
+}
@@ -0,0 +1,74 @@
+package stash_test
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/k1ender/go-stash/stash"
+	"github.com/k1ender/go-stash/stash/stashtest"
+)
+
+func roundTrip(t *testing.T, addr string, frame string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(frame)); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func TestServer(t *testing.T) {
+	for _, kind := range []stash.StoreKind{stash.Sharded, stash.HashMap} {
+		t.Run(string(kind), func(t *testing.T) {
+			srv := stashtest.New(t, stash.Options{Store: kind, Shards: 4})
+
+			if got := roundTrip(t, srv.Addr().String(), "SET\x003\x00key\x005\x00value\r\n"); got != "OK\r\n" {
+				t.Fatalf("SET = %q", got)
+			}
+			if got, err := srv.Store().Get("key"); err != nil || got != "value" {
+				t.Fatalf("Store().Get = %q, %v", got, err)
+			}
+
+			if err := srv.Store().Set("other", "direct"); err != nil {
+				t.Fatal(err)
+			}
+			if got := roundTrip(t, srv.Addr().String(), "GET\x005\x00other\r\n"); got != "direct\r\n" {
+				t.Fatalf("GET = %q", got)
+			}
+		})
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := stashtest.New(t, stash.Options{Listener: ln})
+
+	if srv.Addr().String() != ln.Addr().String() {
+		t.Fatalf("Addr() = %v, want %v", srv.Addr(), ln.Addr())
+	}
+	if got := roundTrip(t, ln.Addr().String(), "PIN\r\n"); got != "PONG\r\n" {
+		t.Fatalf("PIN = %q", got)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	if _, err := stash.New(stash.Options{Store: "disk"}); err == nil {
+		t.Error("unknown store accepted")
+	}
+	if _, err := stash.New(stash.Options{Addr: "no port"}); err == nil {
+		t.Error("invalid address accepted")
+	}
+}
@@ -0,0 +1,33 @@
+// Package stashtest starts GoStash servers for tests.
+package stashtest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/k1ender/go-stash/stash"
+)
+
+// New starts a server with opts, listening on 127.0.0.1:0 unless opts say
+// otherwise, and closes it when the test ends.
+func New(tb testing.TB, opts stash.Options) *stash.Server {
+	tb.Helper()
+
+	srv, err := stash.New(opts)
+	if err != nil {
+		tb.Fatalf("stashtest: %v", err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve() }()
+
+	tb.Cleanup(func() {
+		if err := srv.Close(); err != nil {
+			tb.Errorf("stashtest: close: %v", err)
+		}
+		if err := <-served; !errors.Is(err, stash.ErrServerClosed) {
+			tb.Errorf("stashtest: serve: %v", err)
+		}
+	})
+	return srv
+}